@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// userInfoURL is Google's OAuth2 endpoint describing a token's user.
+	userInfoURL = "https://www.googleapis.com/oauth2/v1/userinfo"
+
+	// tokenInfoURL is Google's OAuth2 endpoint describing a token itself,
+	// including the client it was issued to.
+	tokenInfoURL = "https://www.googleapis.com/oauth2/v1/tokeninfo"
+
+	// apiKeyHeader is the request header carrying an API key.
+	apiKeyHeader = "X-API-Key"
+)
+
+var (
+	errUnauthorized = errors.New("unauthorized")
+
+	// errUpstream means the upstream auth service couldn't be reached or
+	// failed, so it's unknown whether the request is authorized.
+	errUpstream = errors.New("upstream auth error")
+
+	// errUpstreamTimeout means the upstream auth service didn't respond in
+	// time.
+	errUpstreamTimeout = errors.New("upstream auth timeout")
+)
+
+// Authenticator identifies the user making a request.
+type Authenticator interface {
+	// UserID returns the ID of the user making the request. It returns
+	// errUnauthorized if the request doesn't identify a valid user, and
+	// errUpstream or errUpstreamTimeout if the user couldn't be identified
+	// because of a failure elsewhere.
+	UserID(r *http.Request) (string, error)
+}
+
+// googleAuth authenticates requests bearing a Google OAuth2 access token,
+// either in an "Authorization: Bearer" header or an access_token param.
+type googleAuth struct {
+	// client makes requests to Google. It should have a Timeout, so a slow
+	// response from Google doesn't tie up requests.
+	client *http.Client
+
+	// clientID, if set, is the OAuth2 client ID tokens must have been issued
+	// to. Without it, a token issued to any application is accepted.
+	clientID string
+}
+
+func (a googleAuth) UserID(r *http.Request) (string, error) {
+	tok := r.URL.Query().Get("access_token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		tok = strings.TrimPrefix(h, "Bearer ")
+	}
+	if tok == "" {
+		return "", errUnauthorized
+	}
+	if a.clientID != "" {
+		if err := a.checkAudience(tok); err != nil {
+			return "", err
+		}
+	}
+
+	req, err := http.NewRequest("GET", userInfoURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, err := a.httpClient().Do(req)
+	if err != nil {
+		log.Printf("userinfo: %v", err)
+		return "", upstreamError(err)
+	}
+	defer resp.Body.Close()
+	if err := checkStatus("userinfo", resp); err != nil {
+		return "", err
+	}
+	var info struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		log.Printf("userinfo json: %v", err)
+		return "", upstreamError(err)
+	}
+	if info.ID == "" {
+		return "", errUnauthorized
+	}
+	return info.ID, nil
+}
+
+// upstreamError maps an error talking to Google to errUpstreamTimeout if it
+// timed out, or errUpstream otherwise.
+func upstreamError(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return errUpstreamTimeout
+	}
+	return errUpstream
+}
+
+// checkStatus maps the status of a response from a Google auth endpoint to an
+// error: server errors mean Google is having trouble, and any other non-200
+// status means the token isn't valid.
+func checkStatus(endpoint string, resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode >= 500:
+		log.Printf("%s: %s", endpoint, resp.Status)
+		return errUpstream
+	}
+	return errUnauthorized
+}
+
+func (a googleAuth) httpClient() *http.Client {
+	if a.client == nil {
+		return http.DefaultClient
+	}
+	return a.client
+}
+
+// checkAudience checks that tok was issued to the configured client ID, so
+// that a token obtained by some other application can't be substituted.
+func (a googleAuth) checkAudience(tok string) error {
+	resp, err := a.httpClient().Get(tokenInfoURL + "?access_token=" + url.QueryEscape(tok))
+	if err != nil {
+		log.Printf("tokeninfo: %v", err)
+		return upstreamError(err)
+	}
+	defer resp.Body.Close()
+	if err := checkStatus("tokeninfo", resp); err != nil {
+		return err
+	}
+	var info struct {
+		Audience string `json:"audience"`
+		Aud      string `json:"aud"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		log.Printf("tokeninfo json: %v", err)
+		return upstreamError(err)
+	}
+	if info.Audience != a.clientID && info.Aud != a.clientID {
+		return errUnauthorized
+	}
+	return nil
+}
+
+// apiKeyAuth authenticates server-to-server clients by a static API key sent
+// in the X-API-Key header. It maps API keys to user IDs.
+type apiKeyAuth map[string]string
+
+func (a apiKeyAuth) UserID(r *http.Request) (string, error) {
+	userID, found := a[r.Header.Get(apiKeyHeader)]
+	if !found {
+		return "", errUnauthorized
+	}
+	return userID, nil
+}
+
+// selectAuth authenticates requests with an X-API-Key header using apiKey,
+// and all other requests using google. Either may be nil, in which case
+// requests it would authenticate are unauthorized.
+type selectAuth struct {
+	apiKey, google Authenticator
+}
+
+func (a selectAuth) UserID(r *http.Request) (string, error) {
+	auth := a.google
+	if r.Header.Get(apiKeyHeader) != "" {
+		auth = a.apiKey
+	}
+	if auth == nil {
+		return "", errUnauthorized
+	}
+	return auth.UserID(r)
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// stubTransport responds to every request with a canned status and body,
+// recording the last request it saw. Requests for URLs in byURL get that
+// response instead.
+type stubTransport struct {
+	code  int
+	body  string
+	byURL map[string]stubResponse
+	req   *http.Request
+}
+
+type stubResponse struct {
+	code int
+	body string
+}
+
+func (t *stubTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.req = r
+	code, body := t.code, t.body
+	u := *r.URL
+	u.RawQuery = ""
+	if resp, found := t.byURL[u.String()]; found {
+		code, body = resp.code, resp.body
+	}
+	return &http.Response{
+		StatusCode: code,
+		Status:     http.StatusText(code),
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Header:     http.Header{},
+		Request:    r,
+	}, nil
+}
+
+func TestGoogleAuth(t *testing.T) {
+	st := &stubTransport{code: http.StatusOK, body: `{"id":"12345"}`}
+	a := googleAuth{client: &http.Client{Transport: st}}
+
+	r, _ := http.NewRequest("GET", "/Data", nil)
+	r.Header.Set("Authorization", "Bearer tok")
+	userID, err := a.UserID(r)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if userID != "12345" {
+		t.Errorf("UserID; got %s want 12345", userID)
+	}
+	if got := st.req.URL.String(); got != userInfoURL {
+		t.Errorf("requested %s, want %s", got, userInfoURL)
+	}
+	if got := st.req.Header.Get("Authorization"); got != "Bearer tok" {
+		t.Errorf("sent Authorization %q, want %q", got, "Bearer tok")
+	}
+
+	r, _ = http.NewRequest("GET", "/Data?access_token=param", nil)
+	if userID, err := a.UserID(r); err != nil || userID != "12345" {
+		t.Errorf("UserID with access_token param; got %s,%v", userID, err)
+	}
+	if got := st.req.Header.Get("Authorization"); got != "Bearer param" {
+		t.Errorf("sent Authorization %q, want %q", got, "Bearer param")
+	}
+
+	r, _ = http.NewRequest("GET", "/Data", nil)
+	if _, err := a.UserID(r); err != errUnauthorized {
+		t.Errorf("UserID without token; got %v want %v", err, errUnauthorized)
+	}
+}
+
+func TestGoogleAuthAudience(t *testing.T) {
+	for _, c := range []struct {
+		tokenInfo string
+		wantErr   error
+	}{
+		{`{"audience":"my-client","user_id":"12345"}`, nil},
+		{`{"aud":"my-client","sub":"12345"}`, nil},
+		{`{"audience":"other-client","user_id":"12345"}`, errUnauthorized},
+	} {
+		st := &stubTransport{code: http.StatusOK, body: `{"id":"12345"}`, byURL: map[string]stubResponse{
+			tokenInfoURL: {http.StatusOK, c.tokenInfo},
+		}}
+		a := googleAuth{&http.Client{Transport: st}, "my-client"}
+		r, _ := http.NewRequest("GET", "/Data", nil)
+		r.Header.Set("Authorization", "Bearer tok")
+		userID, err := a.UserID(r)
+		if err != c.wantErr {
+			t.Errorf("UserID with tokeninfo %s; got error %v want %v", c.tokenInfo, err, c.wantErr)
+		} else if err == nil && userID != "12345" {
+			t.Errorf("UserID with tokeninfo %s; got %s want 12345", c.tokenInfo, userID)
+		}
+	}
+
+	// The mismatch is rejected as unauthorized.
+	s, done := newTestServer(t)
+	defer done()
+	st := &stubTransport{code: http.StatusOK, body: `{"id":"12345"}`, byURL: map[string]stubResponse{
+		tokenInfoURL: {http.StatusOK, `{"audience":"other-client"}`},
+	}}
+	s.auth = googleAuth{&http.Client{Transport: st}, "my-client"}
+	w := do(s, "GET", "/Data?access_token=tok", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET with mismatched audience: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	a := apiKeyAuth{"secret": "backend"}
+
+	r, _ := http.NewRequest("GET", "/Data", nil)
+	r.Header.Set(apiKeyHeader, "secret")
+	if userID, err := a.UserID(r); err != nil || userID != "backend" {
+		t.Errorf("UserID; got %s,%v want backend", userID, err)
+	}
+	r.Header.Set(apiKeyHeader, "wrong")
+	if _, err := a.UserID(r); err != errUnauthorized {
+		t.Errorf("UserID with wrong key; got %v want %v", err, errUnauthorized)
+	}
+}
+
+func TestSelectAuth(t *testing.T) {
+	st := &stubTransport{code: http.StatusOK, body: `{"id":"google-user"}`}
+	a := selectAuth{
+		apiKey: apiKeyAuth{"secret": "backend"},
+		google: googleAuth{client: &http.Client{Transport: st}},
+	}
+
+	r, _ := http.NewRequest("GET", "/Data", nil)
+	r.Header.Set(apiKeyHeader, "secret")
+	if userID, err := a.UserID(r); err != nil || userID != "backend" {
+		t.Errorf("UserID with API key; got %s,%v want backend", userID, err)
+	}
+	r, _ = http.NewRequest("GET", "/Data", nil)
+	r.Header.Set("Authorization", "Bearer tok")
+	if userID, err := a.UserID(r); err != nil || userID != "google-user" {
+		t.Errorf("UserID with token; got %s,%v want google-user", userID, err)
+	}
+
+	a.google = nil
+	if _, err := a.UserID(r); err != errUnauthorized {
+		t.Errorf("UserID without google; got %v want %v", err, errUnauthorized)
+	}
+}
+
+func TestAuthNamespacing(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.auth = apiKeyAuth{"key1": "alice", "key2": "bob", "key3": "bad--user"}
+
+	req := func(method, path, key, body string) int {
+		r, _ := http.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(apiKeyHeader, key)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := req("PUT", "/Data/a", "key1", `{"a":1}`); code != http.StatusOK {
+		t.Fatalf("PUT: got %d", code)
+	}
+	if code := req("GET", "/Data/a", "key1", ""); code != http.StatusOK {
+		t.Errorf("GET own entity: got %d", code)
+	}
+	if code := req("GET", "/Data/a", "key2", ""); code != http.StatusNotFound {
+		t.Errorf("GET other user's entity: got %d, want %d", code, http.StatusNotFound)
+	}
+	if code := req("GET", "/Data/a", "wrong", ""); code != http.StatusUnauthorized {
+		t.Errorf("GET with bad key: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := req("GET", "/Data/a", "key3", ""); code != http.StatusUnauthorized {
+		t.Errorf("GET with invalid user ID: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := req("GET", "/Da--ta/a", "key1", ""); code != http.StatusBadRequest {
+		t.Errorf("GET kind with separator: got %d, want %d", code, http.StatusBadRequest)
+	}
+
+	// Config is per-user, too.
+	if code := req("PUT", "/_config/Data", "key2", `{"defaults":{"status":"new"}}`); code != http.StatusOK {
+		t.Fatalf("PUT config: got %d", code)
+	}
+	r, _ := http.NewRequest("POST", "/Data", strings.NewReader(`{}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(apiKeyHeader, "key2")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if got := decode(t, w)["status"]; got != "new" {
+		t.Errorf("POST with config: got status=%v, want new", got)
+	}
+	r, _ = http.NewRequest("POST", "/Data", strings.NewReader(`{}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(apiKeyHeader, "key1")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if _, found := decode(t, w)["status"]; found {
+		t.Errorf("POST as other user: got status, want none")
+	}
+}
+
+func TestAuthNamespaceCollision(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.auth = apiKeyAuth{"key1": "a-", "key2": "a"}
+
+	req := func(method, path, key, body string) int {
+		r, _ := http.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(apiKeyHeader, key)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	// User "a-" with kind "Data" and user "a" with kind "-Data" would
+	// share the bucket "a---Data", so neither is allowed.
+	if code := req("PUT", "/Data/secret", "key1", `{"a":1}`); code != http.StatusUnauthorized {
+		t.Errorf("PUT as a-: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := req("GET", "/-Data/secret", "key2", ""); code != http.StatusBadRequest {
+		t.Errorf("GET -Data as a: got %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := req("PUT", "/-Data/secret", "key2", `{"a":1}`); code != http.StatusBadRequest {
+		t.Errorf("PUT -Data as a: got %d, want %d", code, http.StatusBadRequest)
+	}
+	s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("a---Data")) != nil {
+			t.Errorf("got bucket a---Data, want none")
+		}
+		return nil
+	})
+}
+
+func TestPurgeNamespace(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.auth = apiKeyAuth{"key1": "a"}
+
+	// "a---Data" is user "a-"'s, from before such user IDs were rejected,
+	// even though its name starts with user "a"'s namespace.
+	s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"a--Data", "a---Data"} {
+			b, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.Put([]byte("x"), []byte(`{"_id":"x","_expires":1}`))
+		}
+		return nil
+	})
+	r, _ := http.NewRequest("POST", "/_purge", nil)
+	r.Header.Set(apiKeyHeader, "key1")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if got := decode(t, w)["deleted"]; got != 1.0 {
+		t.Errorf("purge: got deleted=%v, want 1", got)
+	}
+	s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("a---Data")).Get([]byte("x")) == nil {
+			t.Errorf("purge: deleted a-'s entity")
+		}
+		return nil
+	})
+}
+
+// failingTransport fails every request, as if the network were down.
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestGetByKey(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.auth = apiKeyAuth{"key1": "alice", "key2": "bob"}
+
+	req := func(method, path, key, body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(apiKeyHeader, key)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	if w := req("PUT", "/Data/a", "key1", `{"a":1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	key := req("GET", "/Data/a", "key1", "").Header().Get("X-Key")
+	if key == "" {
+		t.Fatal("GET: no X-Key")
+	}
+
+	w := req("GET", "/_key/"+key, "key1", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET own key: got %d", w.Code)
+	}
+	if m := decode(t, w); m[idKey] != "a" || m["a"] != 1.0 {
+		t.Errorf("GET own key: got %v", m)
+	}
+	if w := req("PUT", "/Data/a", "key2", `{"b":1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	for _, c := range []struct {
+		key, apiKey string
+		want        int
+	}{
+		// Another user's key is forbidden, even if they have an entity
+		// with the same kind and ID.
+		{key, "key2", http.StatusForbidden},
+		{encodeKey("Data", "a"), "key1", http.StatusForbidden},
+		{encodeKey("alice--Data", "missing"), "key1", http.StatusNotFound},
+		{"not a key", "key1", http.StatusBadRequest},
+		{encodeKey("alice--Data", ""), "key1", http.StatusBadRequest},
+	} {
+		if w := req("GET", "/_key/"+c.key, c.apiKey, ""); w.Code != c.want {
+			t.Errorf("GET key %q as %s: got %d, want %d", c.key, c.apiKey, w.Code, c.want)
+		}
+	}
+	if w := req("DELETE", "/_key/"+key, "key1", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: got %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAuthErrorStatus(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, c := range []struct {
+		desc      string
+		transport http.RoundTripper
+		clientID  string
+		want      int
+	}{
+		{"bad token", &stubTransport{code: http.StatusUnauthorized, body: `{}`}, "", http.StatusUnauthorized},
+		{"no user ID", &stubTransport{code: http.StatusOK, body: `{}`}, "", http.StatusUnauthorized},
+		{"bad token at tokeninfo", &stubTransport{code: http.StatusBadRequest, body: `{}`}, "my-client", http.StatusUnauthorized},
+		{"userinfo outage", &stubTransport{code: http.StatusServiceUnavailable, body: ``}, "", http.StatusBadGateway},
+		{"malformed userinfo", &stubTransport{code: http.StatusOK, body: `<html>`}, "", http.StatusBadGateway},
+		{"network error", failingTransport{}, "", http.StatusBadGateway},
+		{"network error at tokeninfo", failingTransport{}, "my-client", http.StatusBadGateway},
+	} {
+		s.auth = googleAuth{&http.Client{Transport: c.transport}, c.clientID}
+		if w := do(s, "GET", "/Data?access_token=tok", ""); w.Code != c.want {
+			t.Errorf("%s: got %d, want %d", c.desc, w.Code, c.want)
+		}
+	}
+}
+
+// slowTransport doesn't respond until the request is canceled.
+type slowTransport struct{}
+
+func (slowTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	select {
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	case <-time.After(10 * time.Second):
+		return nil, errors.New("test timed out")
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, clientID := range []string{"", "my-client"} {
+		s.auth = googleAuth{&http.Client{Transport: slowTransport{}, Timeout: 10 * time.Millisecond}, clientID}
+		if w := do(s, "GET", "/Data?access_token=tok", ""); w.Code != http.StatusGatewayTimeout {
+			t.Errorf("GET with slow Google (clientID %q): got %d, want %d", clientID, w.Code, http.StatusGatewayTimeout)
+		}
+	}
+}
+
+func TestMigrateSharedPrefix(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.auth = apiKeyAuth{"a": "a", "ab": "ab", "b": "b"}
+
+	req := func(method, path, key, from, body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(apiKeyHeader, key)
+		if from != "" {
+			r.Header.Set(migrateFromPrefix+apiKeyHeader, from)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	for _, key := range []string{"a", "ab"} {
+		if w := req("PUT", "/Data/x", key, "", `{"owner":"`+key+`"}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT as %s: got %d", key, w.Code)
+		}
+	}
+	// "a---Data" is user "a-"'s, from before such user IDs were rejected.
+	s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("a---Data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("y"), []byte(`{"_id":"y"}`))
+	})
+
+	w := req("POST", "/_migrate", "b", "a", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("migrate: got %d %s", w.Code, w.Body.String())
+	}
+	if got := decode(t, w)["moved"]; got != 1.0 {
+		t.Errorf("moved: got %v, want 1", got)
+	}
+	if w := req("GET", "/Data/x", "ab", "", ""); decode(t, w)["owner"] != "ab" {
+		t.Errorf("GET as ab: got %d %s", w.Code, w.Body.String())
+	}
+	s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte("a---Data")); b == nil || b.Get([]byte("y")) == nil {
+			t.Errorf("migrate: moved a-'s entity")
+		}
+		return nil
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.auth = apiKeyAuth{"old": "alice-old", "new": "alice", "other": "bob"}
+
+	req := func(method, path, key, from, body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(apiKeyHeader, key)
+		if from != "" {
+			r.Header.Set(migrateFromPrefix+apiKeyHeader, from)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	for _, path := range []string{"/Data/a", "/Data/b", "/Posts/p", "/_config/Data"} {
+		if w := req("PUT", path, "old", "", `{"x":1}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", path, w.Code)
+		}
+	}
+	if w := req("PUT", "/Data/c", "new", "", `{"x":2}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+
+	// Both accounts' credentials are needed.
+	for _, from := range []string{"", "wrong"} {
+		if w := req("POST", "/_migrate", "new", from, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("from %q: got %d, want %d", from, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if w := req("POST", "/_migrate", "new", "new", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("to itself: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w := req("POST", "/_migrate", "new", "old", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("migrate: got %d %s", w.Code, w.Body.String())
+	}
+	if got := decode(t, w)["moved"]; got != float64(4) {
+		t.Errorf("moved: got %v, want 4", got)
+	}
+	if got := listIDs(t, req("GET", "/Data", "new", "", "")); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("new Data: got %v", got)
+	}
+	for _, path := range []string{"/Posts/p", "/_config/Data"} {
+		if w := req("GET", path, "new", "", ""); w.Code != http.StatusOK {
+			t.Errorf("new GET %s: got %d", path, w.Code)
+		}
+		if w := req("GET", path, "old", "", ""); w.Code != http.StatusNotFound {
+			t.Errorf("old GET %s: got %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+	if got := decode(t, req("GET", "/_kinds", "old", "", ""))["kinds"]; !reflect.DeepEqual(got, []interface{}{}) {
+		t.Errorf("old kinds: got %v", got)
+	}
+
+	// An entity in both accounts stops the migration, and the rest of its
+	// batch stays where it was.
+	for _, key := range []string{"other", "new"} {
+		if w := req("PUT", "/Data/c", key, "", `{"x":3}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	if w := req("PUT", "/Data/d", "other", "", `{}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if w := req("POST", "/_migrate", "new", "other", ""); w.Code != http.StatusConflict {
+		t.Errorf("conflict: got %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := req("GET", "/Data/d", "other", "", ""); w.Code != http.StatusOK {
+		t.Errorf("after conflict: got %d", w.Code)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+)
+
+// errRollback abandons a transaction without it being reported as a failure.
+var errRollback = errors.New("rollback")
+
+// batchResult is the outcome of inserting one entity of a batch.
+type batchResult struct {
+	Status int    `json:"status"`
+	ID     string `json:"_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// isBatch reports whether a request body is a JSON array, i.e. a batch of
+// entities to insert, rather than a single entity.
+func isBatch(body []byte) bool {
+	b := bytes.TrimLeft(body, " \t\r\n")
+	return len(b) > 0 && b[0] == '['
+}
+
+// ndjsonArray reads newline-delimited JSON values from r and returns them as a
+// JSON array, to be inserted as a batch.
+func ndjsonArray(r io.Reader) ([]byte, error) {
+	items := []json.RawMessage{}
+	dec := json.NewDecoder(r)
+	for {
+		var item json.RawMessage
+		if err := dec.Decode(&item); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("line %d: %v", len(items)+1, err)
+		}
+		items = append(items, item)
+	}
+	return json.Marshal(items)
+}
+
+// insertBatch inserts each entity of a JSON array into a kind, in a single
+// transaction, and returns {"items":[...]} with a batchResult for each.
+//
+// If atomic is false, invalid entities are skipped and the rest are stored;
+// the status is OK if all were stored and 207 Multi-Status otherwise. If
+// atomic is true, nothing is stored unless every entity is valid, and the
+// status and message are those of the first invalid entity, prefixed with its
+// index.
+func (s *Server) insertBatch(lt logTags, kind string, body []byte, atomic bool) ([]byte, int) {
+	var entities []json.RawMessage
+	if err := json.Unmarshal(body, &entities); err != nil {
+		return []byte(err.Error()), http.StatusBadRequest
+	}
+	var results []batchResult
+	var msg []byte
+	code := http.StatusOK
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for i, e := range entities {
+			if m, err := fromJSON(e); err != nil || m == nil {
+				results = append(results, batchResult{Status: http.StatusBadRequest, Error: "not an object"})
+				if atomic {
+					code, msg = http.StatusBadRequest, []byte(fmt.Sprintf("item %d: not an object", i))
+					return errRollback
+				}
+				code = http.StatusMultiStatus
+				continue
+			}
+			out, c, err := s.insertTx(lt, tx, kind, "", e, false)
+			if err != nil {
+				return err
+			}
+			if c != http.StatusOK {
+				text := string(out)
+				if text == "" {
+					text = http.StatusText(c)
+				}
+				results = append(results, batchResult{Status: c, Error: text})
+				if atomic {
+					code, msg = c, []byte(fmt.Sprintf("item %d: %s", i, text))
+					return errRollback
+				}
+				code = http.StatusMultiStatus
+				continue
+			}
+			m, err := fromJSON(out)
+			if err != nil {
+				lt.printf("json: %v", err)
+				return err
+			}
+			results = append(results, batchResult{Status: c, ID: m[idKey].(string)})
+		}
+		return nil
+	})
+	if err == errRollback {
+		return msg, code
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+	out, err := toJSON(map[string]interface{}{"items": results})
+	if err != nil {
+		lt.printf("json: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	return out, code
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// listCache holds the responses of recent list requests, so repeated
+// identical queries of a kind are answered without reading it. Writing to a
+// kind invalidates its cached lists, and a list is never served after an
+// entity on it, or on its way to it, expires.
+//
+// Entries are keyed by a hash of the namespaced kind and the query's params,
+// so users never see each other's lists. Invalidation bumps a kind's
+// generation rather than finding its entries; stale entries are dropped when
+// next looked up, or when they're the least recently used.
+type listCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[uint64]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used first
+	gens    map[string]uint64
+	gen     uint64 // added to every kind's generation, bumped to invalidate all
+}
+
+// cacheEntry is a cached list response.
+type cacheEntry struct {
+	key     uint64
+	kind    string
+	gen     uint64
+	expires int64 // Unix time the entry goes stale, or 0 if never
+	header  http.Header
+	body    []byte
+}
+
+func newListCache(size int) *listCache {
+	return &listCache{
+		size:    size,
+		entries: map[uint64]*list.Element{},
+		lru:     list.New(),
+		gens:    map[string]uint64{},
+	}
+}
+
+// cacheKey returns the key of a list request's response: a hash of the
+// namespaced kind and the request's params, in a canonical order.
+func cacheKey(kind string, r *http.Request) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, kind)
+	h.Write([]byte{0})
+	io.WriteString(h, r.URL.Query().Encode())
+	return h.Sum64()
+}
+
+// generation returns the current generation of a kind. Callers get it before
+// reading the kind, so an entry made from data that a concurrent write has
+// since changed is already stale when it's added.
+func (c *listCache) generation(kind string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen + c.gens[kind]
+}
+
+// get returns the cached response for a key, if there's a fresh one.
+func (c *listCache) get(key uint64) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if e.gen != c.gen+c.gens[e.kind] || (e.expires != 0 && e.expires <= nowFunc().Unix()) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e, true
+}
+
+// add caches a response, evicting the least recently used if the cache is
+// full.
+func (c *listCache) add(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.lru.Remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		old := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, old.key)
+	}
+}
+
+// invalidate makes the cached lists of a kind stale.
+func (c *listCache) invalidate(kind string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gens[kind]++
+}
+
+// invalidateAll makes every cached list stale.
+func (c *listCache) invalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+}
+
+// cacheWriter records a list response as it's written, for caching. list
+// marks the response complete once it has all been written.
+type cacheWriter struct {
+	http.ResponseWriter
+	code    int
+	body    bytes.Buffer
+	done    bool
+	expires int64
+}
+
+func (w *cacheWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// complete marks the response as fully written, and so cacheable until
+// expires, the earliest time an entity it depends on expires, or 0 if none
+// do.
+func (w *cacheWriter) complete(expires int64) {
+	w.done, w.expires = true, expires
+}
+
+// invalidatingWriter invalidates cached lists before a write request's
+// response is sent, so a client never reads a list from before its own write.
+type invalidatingWriter struct {
+	http.ResponseWriter
+	invalidate func()
+	once       sync.Once
+}
+
+func (w *invalidatingWriter) WriteHeader(code int) {
+	w.once.Do(w.invalidate)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *invalidatingWriter) Write(b []byte) (int, error) {
+	w.once.Do(w.invalidate)
+	return w.ResponseWriter.Write(b)
+}
+
+// cachedList serves a list request from the cache if it can, and otherwise
+// calls list, caching the response. Only GETs are cached, and not those
+// expanding references, since writes to other kinds would change them.
+func (s *Server) cachedList(lt logTags, w http.ResponseWriter, r *http.Request, kind string, uq userQuery) int {
+	if s.cache == nil || r.Method != "GET" || len(uq.Expand) > 0 {
+		return s.list(lt, w, r, kind, uq)
+	}
+	key := cacheKey(kind, r)
+	if e, ok := s.cache.get(key); ok {
+		if etag := e.header.Get("ETag"); etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return http.StatusOK
+		}
+		for k, v := range e.header {
+			w.Header()[k] = v
+		}
+		w.Write(e.body)
+		return http.StatusOK
+	}
+	gen := s.cache.generation(kind)
+	cw := &cacheWriter{ResponseWriter: w, code: http.StatusOK}
+	code := s.list(lt, cw, r, kind, uq)
+	if code == http.StatusOK && cw.done && cw.code == http.StatusOK {
+		header := http.Header{}
+		for k, v := range w.Header() {
+			header[k] = append([]string(nil), v...)
+		}
+		s.cache.add(&cacheEntry{key, kind, gen, cw.expires, header, cw.body.Bytes()})
+	}
+	return code
+}
+
+// invalidateLists invalidates the cached lists a write request to a kind, or
+// entity id of it, in a namespace could change. Purges and imports can write
+// to any kind, and changing a kind's config can change how it's listed.
+func (s *Server) invalidateLists(ns, bare, id string) {
+	switch {
+	case bare == purgeKind || bare == importKind || bare == migrateKind:
+		s.cache.invalidateAll()
+	case bare == configKind:
+		s.cache.invalidate(ns + id)
+	default:
+		s.cache.invalidate(ns + bare)
+	}
+}
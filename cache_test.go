@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ids returns the IDs of the items of a list response.
+func ids(t *testing.T, s *Server, path string) string {
+	w := do(s, "GET", path, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: got %d", path, w.Code)
+	}
+	var got []string
+	for _, it := range decode(t, w)["items"].([]interface{}) {
+		got = append(got, it.(map[string]interface{})[idKey].(string))
+	}
+	return strings.Join(got, ",")
+}
+
+// sneak writes an entity directly to the database, without invalidating
+// cached lists, so a test can tell whether a list was served from the cache.
+func sneak(t *testing.T, s *Server, kind, id string) {
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(kind)).Put([]byte(id), []byte(`{"_id":"`+id+`"}`))
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListCache(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.cache = newListCache(10)
+
+	for _, id := range []string{"a", "b"} {
+		if w := do(s, "PUT", "/Data/"+id, `{"x":1}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	if got := ids(t, s, "/Data?where=x=1&limit=5"); got != "a,b" {
+		t.Fatalf("got %s, want a,b", got)
+	}
+
+	// A repeated query, even with its params in another order, is a hit.
+	sneak(t, s, "Data", "c")
+	if got := ids(t, s, "/Data?limit=5&where=x=1"); got != "a,b" {
+		t.Errorf("repeated: got %s, want a,b from the cache", got)
+	}
+	w := do(s, "GET", "/Data?where=x=1&limit=5", "")
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("cached: got headers %v", w.Header())
+	}
+	r, _ := http.NewRequest("GET", "/Data?where=x=1&limit=5", nil)
+	r.Header.Set("If-None-Match", etag)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: got %d, want %d", rec.Code, http.StatusNotModified)
+	}
+
+	// Writing to the kind invalidates it, even if the write fails.
+	if w := do(s, "POST", "/Data", `{"_bogus":1}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("POST: got %d", w.Code)
+	}
+	if got := ids(t, s, "/Data?limit=5&where=x=1"); got != "a,b" {
+		t.Errorf("after insert: got %s, want a,b", got)
+	}
+	if got := ids(t, s, "/Data?limit=5"); got != "a,b,c" {
+		t.Errorf("after insert: got %s, want a,b,c", got)
+	}
+
+	// Other kinds' writes don't.
+	if w := do(s, "PUT", "/Other/a", `{}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	sneak(t, s, "Data", "d")
+	if got := ids(t, s, "/Data?limit=5"); got != "a,b,c" {
+		t.Errorf("after other kind's write: got %s, want a,b,c from the cache", got)
+	}
+
+	// But changing the kind's config does.
+	if w := do(s, "PUT", "/_config/Data", `{"sort":"-_id"}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT config: got %d", w.Code)
+	}
+	if got := ids(t, s, "/Data?limit=5"); got != "d,c,b,a" {
+		t.Errorf("after config: got %s, want d,c,b,a", got)
+	}
+}
+
+func TestListCacheExpiry(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	defer func() { nowFunc = time.Now }()
+	now := time.Unix(1000, 0)
+	nowFunc = func() time.Time { return now }
+	s.cache = newListCache(10)
+
+	if w := do(s, "PUT", "/Data/a", `{}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if w := do(s, "PUT", "/Data/b", `{"_ttl":60}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if got := ids(t, s, "/Data"); got != "a,b" {
+		t.Fatalf("got %s, want a,b", got)
+	}
+	now = now.Add(time.Minute)
+	if got := ids(t, s, "/Data"); got != "a" {
+		t.Errorf("after expiry: got %s, want a", got)
+	}
+}
+
+func TestListCacheEviction(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.cache = newListCache(1)
+
+	if w := do(s, "PUT", "/Data/a", `{}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	ids(t, s, "/Data")
+	ids(t, s, "/Data?limit=5")
+	sneak(t, s, "Data", "b")
+	if got := ids(t, s, "/Data?limit=5"); got != "a" {
+		t.Errorf("still cached: got %s, want a", got)
+	}
+	if got := ids(t, s, "/Data"); got != "a,b" {
+		t.Errorf("evicted: got %s, want a,b", got)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// configKind is the kind under which per-kind configuration is stored. The
+// configuration for kind "Data" is the entity with ID "Data", and can be
+// written like any other entity, e.g. by a PUT to /_config/Data. Each user
+// has their own configuration.
+const configKind = "_config"
+
+// kindConfig is the per-kind configuration document.
+type kindConfig struct {
+	// Defaults are field values applied on insert when a field is omitted.
+	Defaults map[string]interface{} `json:"defaults"`
+
+	// Sort is the sort order, in the same form as the sort param, of lists
+	// that don't give one.
+	Sort string `json:"sort"`
+
+	// Immutable are fields that can't be changed once they're set, nor
+	// removed.
+	Immutable []string `json:"immutable"`
+
+	// Derived maps fields to expressions computing them from other fields,
+	// e.g. "fullName": `firstName + " " + lastName`; see derivation. Derived
+	// fields are recomputed whenever an entity is written.
+	Derived map[string]string `json:"derived"`
+
+	// derived holds the parsed Derived expressions.
+	derived map[string]derivation
+
+	// Hidden are fields, like password hashes, that are stored and can be
+	// filtered on, but are never returned to clients.
+	Hidden []string `json:"hidden"`
+
+	// Money are decimal fields, like prices, that are stored as an integer
+	// number of cents so they don't drift, and returned as decimals.
+	Money []string `json:"money"`
+
+	// Unique are fields that no two entities may have the same value for;
+	// see claimUnique.
+	Unique []string `json:"unique"`
+
+	// Encrypted are fields, like national ID numbers, whose values are
+	// stored encrypted, and so can't be queried; see encrypt.
+	Encrypted []string `json:"encrypted"`
+
+	// ReadOnly means the kind's entities can't be written through the API,
+	// e.g. because a backend job populates them with imports.
+	ReadOnly bool `json:"readOnly"`
+
+	// fieldCipher is the server's, to encrypt and decrypt the Encrypted
+	// fields; see Server.fieldCipher.
+	fieldCipher cipher.AEAD
+}
+
+// parseConfig parses a stored config document.
+func parseConfig(b []byte) (*kindConfig, error) {
+	var cfg kindConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	if _, err := parseSort(cfg.Sort); err != nil {
+		return nil, err
+	}
+	for _, f := range cfg.Immutable {
+		if !validPath(f) {
+			return nil, errors.New("invalid immutable field: " + f)
+		}
+	}
+	for _, f := range cfg.Hidden {
+		if !validPath(f) || strings.HasPrefix(f, "_") {
+			return nil, errors.New("invalid hidden field: " + f)
+		}
+	}
+	for _, f := range cfg.Money {
+		if !validPath(f) || strings.HasPrefix(f, "_") {
+			return nil, errors.New("invalid money field: " + f)
+		}
+	}
+	for _, f := range cfg.Unique {
+		if !validPath(f) || strings.HasPrefix(f, "_") {
+			return nil, errors.New("invalid unique field: " + f)
+		}
+	}
+	for _, f := range cfg.Encrypted {
+		if !validPath(f) || strings.HasPrefix(f, "_") {
+			return nil, errors.New("invalid encrypted field: " + f)
+		}
+	}
+	// Unique values are indexed as they are, which would give encrypted
+	// values away.
+	for _, f := range cfg.Unique {
+		if cfg.encrypts(f) {
+			return nil, errors.New("unique field can't be encrypted: " + f)
+		}
+	}
+	cfg.derived = map[string]derivation{}
+	for f, expr := range cfg.Derived {
+		if f == "" || strings.HasPrefix(f, "_") || strings.Contains(f, ".") {
+			return nil, errors.New("invalid derived field: " + f)
+		}
+		// Derived values are strings, which money fields can't hold.
+		if cfg.isMoney(f) {
+			return nil, errors.New("derived field can't be money: " + f)
+		}
+		d, err := parseDerivation(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid derived field %s: %v", f, err)
+		}
+		cfg.derived[f] = d
+	}
+	return &cfg, nil
+}
+
+// checkConfig checks a config document before it's stored. Beyond parsing
+// it, as is done whenever it's loaded, it checks that the server can do what
+// it asks.
+func (s *Server) checkConfig(b []byte) error {
+	cfg, err := parseConfig(b)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Encrypted) > 0 && s.fieldCipher == nil {
+		return errNoEncryptionKey
+	}
+	return nil
+}
+
+// isConfigKind reports whether a, possibly namespaced, kind holds config.
+func isConfigKind(kind string) bool {
+	_, bare := splitNamespace(kind)
+	return bare == configKind
+}
+
+// loadConfig loads the configuration for a kind. If no configuration has been
+// stored, it returns an empty config. The config for a namespaced kind is
+// stored in the _config kind of the same namespace.
+func (s *Server) loadConfig(tx *bolt.Tx, kind string) (*kindConfig, error) {
+	ns, bare := splitNamespace(kind)
+	cfg := &kindConfig{}
+	if b := tx.Bucket([]byte(ns + configKind)); b != nil {
+		if v := b.Get([]byte(bare)); v != nil {
+			var err error
+			if cfg, err = parseConfig(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	cfg.fieldCipher = s.fieldCipher
+	return cfg, nil
+}
+
+// applyDefaults sets any default fields that are missing from m.
+func (cfg *kindConfig) applyDefaults(m map[string]interface{}) {
+	for k, v := range cfg.Defaults {
+		if _, found := m[k]; !found {
+			m[k] = v
+		}
+	}
+}
+
+// changesImmutable returns the first immutable field that's set in old but
+// changed or removed in m, if any.
+func (cfg *kindConfig) changesImmutable(old, m map[string]interface{}) (string, bool) {
+	for _, f := range cfg.Immutable {
+		prev, found := lookup(old, f)
+		if !found {
+			continue
+		}
+		if v, found := lookup(m, f); !found || !reflect.DeepEqual(v, prev) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// applyDerived sets m's derived fields. Each is computed from m as it was
+// before any were set, so derived fields can't depend on each other.
+func (cfg *kindConfig) applyDerived(m map[string]interface{}) {
+	vals := map[string]string{}
+	for f, d := range cfg.derived {
+		vals[f] = d.eval(m)
+	}
+	for f, v := range vals {
+		m[f] = v
+	}
+}
+
+// present prepares a stored entity to be returned to a client: its encrypted
+// fields are decrypted, its money fields are converted back to decimals, and
+// its hidden fields are removed.
+func (cfg *kindConfig) present(m map[string]interface{}) {
+	cfg.decrypt(m)
+	cfg.fromCents(m)
+	for _, f := range cfg.Hidden {
+		deletePath(m, f)
+	}
+}
+
+// asStored reports whether entities are returned to clients as they're
+// stored, so present doesn't need to be called.
+func (cfg *kindConfig) asStored() bool {
+	return len(cfg.Hidden) == 0 && len(cfg.Money) == 0 && len(cfg.Encrypted) == 0
+}
+
+// reveals reports whether the values of a, possibly dotted, field would
+// reveal hidden fields: if it's hidden, inside a hidden field, or holds one.
+func (cfg *kindConfig) reveals(field string) bool {
+	for _, f := range cfg.Hidden {
+		if field == f || strings.HasPrefix(field, f+".") || strings.HasPrefix(f, field+".") {
+			return true
+		}
+	}
+	return false
+}
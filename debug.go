@@ -0,0 +1,137 @@
+package main
+
+import "sort"
+
+// debugProperty describes a stored property of an entity, for debugging.
+type debugProperty struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Multiple bool   `json:"multiple,omitempty"`
+}
+
+// jsonType names the JSON type of a decoded value.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// properties lists the properties of m by their dotted paths, in order.
+// Nested objects are flattened, except empty ones; arrays are listed as
+// single, multiple properties.
+func properties(m map[string]interface{}, prefix string) []debugProperty {
+	var ps []debugProperty
+	for k, v := range m {
+		name := prefix + k
+		if o, ok := v.(map[string]interface{}); ok && len(o) > 0 {
+			ps = append(ps, properties(o, name+".")...)
+			continue
+		}
+		_, multiple := v.([]interface{})
+		ps = append(ps, debugProperty{name, jsonType(v), multiple})
+	}
+	sort.Sort(byName(ps))
+	return ps
+}
+
+// byName sorts debugProperties by name.
+type byName []debugProperty
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// debugAllowed reports whether a request by a user, "" without auth, may use
+// the debugging views. They show entities as stored, hidden fields and all,
+// so with auth, only admins may, not just any user with access to the entity.
+func (s *Server) debugAllowed(userID string) bool {
+	return s.debug && (s.auth == nil || s.admins[userID])
+}
+
+// debugEntity returns the debugging view of an entity stored as b: the entity
+// itself, exactly the bytes stored, and a list of its properties.
+func debugEntity(b []byte) ([]byte, error) {
+	m, err := fromJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	return toJSON(map[string]interface{}{
+		"entity":     m,
+		"stored":     string(b),
+		"size":       len(b),
+		"properties": properties(m, ""),
+	})
+}
+
+// queryKey is the field of a list response, with debug=true, that echoes how
+// the list's params were interpreted.
+const queryKey = "_query"
+
+// debugQuery is how a list's params were interpreted, for debugging.
+type debugQuery struct {
+	Limit   int             `json:"limit"`
+	Offset  int             `json:"offset"`
+	Sort    []debugSort     `json:"sort"`
+	Filters []debugFilter   `json:"filters"`
+	Or      [][]debugFilter `json:"or"`
+	Cursor  bool            `json:"cursor"`
+}
+
+// debugSort is a field of a list's sort, for debugging.
+type debugSort struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc"`
+}
+
+// debugFilter is a filter of a list, for debugging. Its value is as it's
+// compared, e.g. a number rather than a string if it looks like one.
+type debugFilter struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+// newDebugQuery describes uq, sorted by orders, which may come from the
+// kind's config rather than uq, and starting at offset.
+func newDebugQuery(uq userQuery, orders []sortOrder, offset int) debugQuery {
+	filters := func(fs []filter) []debugFilter {
+		dfs := []debugFilter{}
+		for _, f := range fs {
+			df := debugFilter{f.Key, f.Op, f.Value}
+			if df.Op == "" {
+				df.Op = "="
+			}
+			// As in matchesFilters, IDs are always strings.
+			if f.Key != idKey && f.Op != "contains" {
+				df.Value = parseValue(f.Value)
+			}
+			dfs = append(dfs, df)
+		}
+		return dfs
+	}
+	dq := debugQuery{
+		Limit:   uq.Limit,
+		Offset:  offset,
+		Sort:    []debugSort{},
+		Filters: filters(uq.Filters),
+		Or:      [][]debugFilter{},
+		Cursor:  uq.StartCursor != "",
+	}
+	for _, o := range orders {
+		dq.Sort = append(dq.Sort, debugSort{o.Field, o.Desc})
+	}
+	for _, g := range uq.Or {
+		dq.Or = append(dq.Or, filters(g))
+	}
+	return dq
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A derivation computes the value of a derived field from an entity. It's
+// parsed from a tiny expression language: string literals in double quotes,
+// dotted field paths, calls to the functions in derivedFuncs, and + to
+// concatenate them, as in
+//
+//	firstName + " " + upper(lastName)
+//
+// Values are always strings. Missing and null fields are empty, numbers and
+// booleans are formatted as they are in JSON, and objects and arrays are
+// empty.
+type derivation interface {
+	eval(m map[string]interface{}) string
+}
+
+// derivedFuncs are the functions derivations may call.
+var derivedFuncs = map[string]func(string) string{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+}
+
+type literal string
+
+func (l literal) eval(map[string]interface{}) string { return string(l) }
+
+type fieldRef string
+
+func (f fieldRef) eval(m map[string]interface{}) string {
+	v, _ := lookup(m, string(f))
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+type concat []derivation
+
+func (c concat) eval(m map[string]interface{}) string {
+	var s string
+	for _, d := range c {
+		s += d.eval(m)
+	}
+	return s
+}
+
+type call struct {
+	fn  func(string) string
+	arg derivation
+}
+
+func (c call) eval(m map[string]interface{}) string { return c.fn(c.arg.eval(m)) }
+
+// parseDerivation parses a derivation expression.
+func parseDerivation(s string) (derivation, error) {
+	toks, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &derivationParser{toks: toks}
+	d, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if len(p.toks) > 0 {
+		return nil, fmt.Errorf("unexpected %q", p.toks[0])
+	}
+	return d, nil
+}
+
+// tokenize splits an expression into string literals, including their quotes,
+// names, and the punctuation +, ( and ).
+func tokenize(s string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '+' || c == '(' || c == ')':
+			toks = append(toks, s[i:i+1])
+			i++
+		case c == '"':
+			j := strings.IndexByte(s[i+1:], '"')
+			if j < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, s[i:i+j+2])
+			i += j + 2
+		case isNameChar(c):
+			j := i
+			for j < len(s) && isNameChar(rune(s[j])) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q", c)
+		}
+	}
+	return toks, nil
+}
+
+func isNameChar(c rune) bool {
+	return c == '_' || c == '.' || c == '-' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+type derivationParser struct {
+	toks []string
+}
+
+func (p *derivationParser) next() string {
+	if len(p.toks) == 0 {
+		return ""
+	}
+	t := p.toks[0]
+	p.toks = p.toks[1:]
+	return t
+}
+
+// expr parses terms separated by +.
+func (p *derivationParser) expr() (derivation, error) {
+	var c concat
+	for {
+		d, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		c = append(c, d)
+		if len(p.toks) == 0 || p.toks[0] != "+" {
+			break
+		}
+		p.next()
+	}
+	if len(c) == 1 {
+		return c[0], nil
+	}
+	return c, nil
+}
+
+// term parses a string literal, a field path or a function call.
+func (p *derivationParser) term() (derivation, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, errors.New("unexpected end of expression")
+	case strings.HasPrefix(t, `"`):
+		return literal(t[1 : len(t)-1]), nil
+	case len(p.toks) > 0 && p.toks[0] == "(":
+		fn, found := derivedFuncs[t]
+		if !found {
+			return nil, fmt.Errorf("unknown function %q", t)
+		}
+		p.next()
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("missing )")
+		}
+		return call{fn, arg}, nil
+	case validPath(t):
+		return fieldRef(t), nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t)
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestDerivation(t *testing.T) {
+	m := map[string]interface{}{
+		"first": "Ann",
+		"last":  "Bee",
+		"n":     1.5,
+		"ok":    true,
+		"none":  nil,
+		"addr":  map[string]interface{}{"city": " Seattle "},
+	}
+	for _, c := range []struct {
+		expr, want string
+	}{
+		{`first`, "Ann"},
+		{`first + " " + last`, "Ann Bee"},
+		{`upper(first)+lower(last)`, "ANNbee"},
+		{`"[" + trim(addr.city) + "]"`, "[Seattle]"},
+		{`upper(first + last)`, "ANNBEE"},
+		{`n + ok + none + missing + addr`, "1.5true"},
+		{`""`, ""},
+	} {
+		d, err := parseDerivation(c.expr)
+		if err != nil {
+			t.Errorf("parseDerivation(%s): %v", c.expr, err)
+			continue
+		}
+		if got := d.eval(m); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.expr, got, c.want)
+		}
+	}
+	for _, expr := range []string{
+		``,
+		`first +`,
+		`+ first`,
+		`first last`,
+		`"unterminated`,
+		`nope(first)`,
+		`upper(first`,
+		`upper()`,
+		`first * 2`,
+		`.first`,
+	} {
+		if _, err := parseDerivation(expr); err == nil {
+			t.Errorf("parseDerivation(%s): got no error", expr)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// encryptedPrefix starts the stored values of encrypted fields, which are the
+// base64 encoding of a nonce followed by the sealed JSON of the value.
+const encryptedPrefix = "enc:"
+
+var errNoEncryptionKey = errors.New("encrypted fields require the server to be started with -encryptionkey")
+
+// loadFieldCipher reads a file holding a base64-encoded 32-byte key, and
+// returns an AES-256-GCM cipher using it.
+func loadFieldCipher(path string) (cipher.AEAD, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s: key is %d bytes, not 32", path, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt replaces the values of m's encrypted fields with ciphertext, as
+// they're stored. Null values aren't encrypted, since they hold nothing.
+func (cfg *kindConfig) encrypt(m map[string]interface{}) error {
+	for _, f := range cfg.Encrypted {
+		v, found := lookup(m, f)
+		if !found || v == nil {
+			continue
+		}
+		if cfg.fieldCipher == nil {
+			return errNoEncryptionKey
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, cfg.fieldCipher.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return err
+		}
+		sealed := cfg.fieldCipher.Seal(nonce, nonce, b, nil)
+		setPath(m, f, encryptedPrefix+base64.StdEncoding.EncodeToString(sealed))
+	}
+	return nil
+}
+
+// decrypt replaces the ciphertext values of m's encrypted fields with the
+// values they encrypt. Values that aren't ciphertext, stored before the field
+// was encrypted, are left as they are until they're next written. A value
+// that can't be decrypted, e.g. with another key, is left as ciphertext, and
+// the failure is logged.
+func (cfg *kindConfig) decrypt(m map[string]interface{}) {
+	for _, f := range cfg.Encrypted {
+		v, _ := lookup(m, f)
+		s, ok := v.(string)
+		if !ok || !strings.HasPrefix(s, encryptedPrefix) {
+			continue
+		}
+		plain, err := cfg.decryptValue(s)
+		if err != nil {
+			log.Printf("decrypt %s: %v", f, err)
+			continue
+		}
+		setPath(m, f, plain)
+	}
+}
+
+// decryptValue returns the value that a stored ciphertext value encrypts.
+func (cfg *kindConfig) decryptValue(s string) (interface{}, error) {
+	if cfg.fieldCipher == nil {
+		return nil, errNoEncryptionKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, encryptedPrefix))
+	if err != nil {
+		return nil, err
+	}
+	n := cfg.fieldCipher.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("ciphertext too short")
+	}
+	b, err := cfg.fieldCipher.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err = json.Unmarshal(b, &v)
+	return v, err
+}
+
+// encrypts reports whether a, possibly dotted, field is encrypted, inside an
+// encrypted field, or holds one, so its stored values can't be compared.
+func (cfg *kindConfig) encrypts(field string) bool {
+	for _, f := range cfg.Encrypted {
+		if field == f || strings.HasPrefix(field, f+".") || strings.HasPrefix(f, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkQuery checks that uq doesn't filter or sort on encrypted fields, whose
+// stored values are ciphertext, so they'd never match or sort meaningfully.
+func (cfg *kindConfig) checkQuery(uq userQuery) error {
+	if len(cfg.Encrypted) == 0 {
+		return nil
+	}
+	fields := []string{}
+	for _, f := range uq.Filters {
+		fields = append(fields, f.Key)
+	}
+	for _, g := range uq.Or {
+		for _, f := range g {
+			fields = append(fields, f.Key)
+		}
+	}
+	orders, _ := parseSort(uq.Sort)
+	for _, o := range orders {
+		fields = append(fields, o.Field)
+	}
+	for _, f := range fields {
+		if cfg.encrypts(f) {
+			return fmt.Errorf("field %s is encrypted, and can't be queried", f)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import "strings"
+
+// etagMatches reports whether an If-None-Match header matches etag. Weak
+// comparison is used, so W/"x" matches "x", as RFC 7232 requires for
+// If-None-Match.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// eventsID is the ID, as in /<Kind>/_events, that streams changes to a kind.
+const eventsID = "_events"
+
+// eventsInterval is how often a kind is polled for changes to stream.
+var eventsInterval = time.Second
+
+// acceptsEvents reports whether a request accepts a text/event-stream
+// response.
+func acceptsEvents(r *http.Request) bool {
+	for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(a); err == nil && mt == "text/event-stream" {
+			return true
+		}
+	}
+	return false
+}
+
+// events streams entities of a kind to w as server-sent events as they're
+// created or changed, until the client disconnects. Each event's data is the
+// entity. The kind is polled every eventsInterval for entities whose _updated
+// time is at least that of the last poll; since _updated is in seconds, the
+// _version of each entity already sent is remembered, so it isn't sent twice
+// but later writes in the same second are.
+// Deletions aren't reported.
+func (s *Server) events(w http.ResponseWriter, r *http.Request, kind string) int {
+	if !acceptsEvents(r) {
+		return http.StatusNotAcceptable
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		log.Printf("events: %T can't flush", w)
+		return http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	since := nowFunc().Unix()
+	// sent holds the _updated time and _version of each entity sent since
+	// the last poll.
+	type sentVersion struct{ updated, version int64 }
+	sent := map[string]sentVersion{}
+	t := time.NewTicker(eventsInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return http.StatusOK
+		case <-t.C:
+		}
+
+		start := nowFunc().Unix()
+		var changed [][]byte
+		err := s.db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(kind))
+			if b == nil {
+				return nil
+			}
+			cfg, err := s.loadConfig(tx, kind)
+			if err != nil {
+				log.Printf("config: %v", err)
+				return err
+			}
+			return b.ForEach(func(k, v []byte) error {
+				m, err := fromJSON(v)
+				if err != nil {
+					log.Printf("json: %v", err)
+					return err
+				}
+				u, _ := m[updatedKey].(float64)
+				if int64(u) < since || expired(m) {
+					return nil
+				}
+				if prev, found := sent[string(k)]; found && prev.version == version(m) {
+					return nil
+				}
+				sent[string(k)] = sentVersion{int64(u), version(m)}
+				if cfg.asStored() {
+					changed = append(changed, append([]byte(nil), v...))
+					return nil
+				}
+				cfg.present(m)
+				out, err := json.Marshal(m)
+				if err != nil {
+					log.Printf("json: %v", err)
+					return err
+				}
+				changed = append(changed, out)
+				return nil
+			})
+		})
+		if err != nil {
+			log.Printf("events: %v", err)
+			return http.StatusOK
+		}
+		for _, v := range changed {
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", v); err != nil {
+				return http.StatusOK
+			}
+		}
+		f.Flush()
+
+		// Versions older than this poll can't be seen again.
+		since = start
+		for id, v := range sent {
+			if v.updated < since {
+				delete(sent, id)
+			}
+		}
+	}
+}
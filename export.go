@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// exportKind is the path, /_export, that exports all of a user's
+	// entities.
+	exportKind = "_export"
+
+	// importKind is the path, /_import, that imports entities in the format
+	// written by /_export.
+	importKind = "_import"
+
+	// importBatchSize is the number of entities written per transaction by
+	// an import.
+	importBatchSize = 500
+)
+
+// exportLine is a line of an export: an entity and its kind.
+type exportLine struct {
+	Kind   string                 `json:"kind"`
+	Entity map[string]interface{} `json:"entity"`
+}
+
+// export writes every entity of every kind in a namespace to w as
+// newline-delimited JSON, one exportLine per entity, in kind then ID order.
+// Only kinds clients may access are exported, and expired entities are left
+// out. If after is "<Kind>/<ID>", as from the last line of an interrupted
+// export, the export resumes with the entity following it.
+//
+// Like list, export writes its own response, and can only return an error
+// status before writing anything.
+func (s *Server) export(w http.ResponseWriter, ns, after string) int {
+	var afterKind, afterID string
+	if after != "" {
+		i := strings.Index(after, "/")
+		if i < 0 {
+			return http.StatusBadRequest
+		}
+		afterKind, afterID = after[:i], after[i+1:]
+	}
+	w.Header().Add("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			bucketNS, kind := splitNamespace(string(name))
+			// The unique index is only for the server's own use.
+			if bucketNS != ns || kind == uniqueKind || (s.kinds != nil && !s.kinds[kind]) || kind < afterKind {
+				return nil
+			}
+			c := b.Cursor()
+			k, v := c.First()
+			if kind == afterKind {
+				if k, v = c.Seek([]byte(afterID)); k != nil && string(k) == afterID {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil; k, v = c.Next() {
+				m, err := fromJSON(v)
+				if err != nil {
+					log.Printf("json: %v", err)
+					return err
+				}
+				if expired(m) {
+					continue
+				}
+				if err := enc.Encode(exportLine{kind, m}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		// The status has already been sent; the export just ends early.
+		log.Printf("export: %v", err)
+	}
+	return http.StatusOK
+}
+
+// ndjsonBody reports whether a request's body is newline-delimited JSON.
+func ndjsonBody(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "application/x-ndjson"
+}
+
+// importEntities writes the entities read from r, in the format written by
+// export, to their kinds in a namespace, and returns the number written.
+// Entities are stored as given, metadata included, so an export can be
+// restored exactly. If merge is true, the fields of each entity are merged
+// into an existing entity with the same ID instead of replacing it. Locks
+// are ignored, but IDs, configs and unique fields are checked as they are
+// for any other write.
+//
+// Entities are written in batches of importBatchSize, each in its own
+// transaction. If a line is invalid, or has the value of a unique field that
+// another entity has, the batch it's in isn't written, but earlier batches
+// have been, and the response says which line it was.
+func (s *Server) importEntities(ns string, r io.Reader, merge bool) ([]byte, int) {
+	n := 0
+	dec := json.NewDecoder(r)
+	for done := false; !done; {
+		var batch []exportLine
+		for len(batch) < importBatchSize {
+			var l exportLine
+			if err := dec.Decode(&l); err == io.EOF {
+				done = true
+				break
+			} else if err != nil {
+				return []byte(fmt.Sprintf("line %d: %v", n+len(batch)+1, err)), http.StatusBadRequest
+			}
+			if err := s.checkImport(l); err != nil {
+				return []byte(fmt.Sprintf("line %d: %v", n+len(batch)+1, err)), http.StatusBadRequest
+			}
+			batch = append(batch, l)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		var tooLarge error
+		conflict := ""
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			for i, l := range batch {
+				b, err := tx.CreateBucketIfNotExists([]byte(ns + l.Kind))
+				if err != nil {
+					log.Printf("create bucket: %v", err)
+					return err
+				}
+				id := l.Entity[idKey].(string)
+				m := l.Entity
+				var old map[string]interface{}
+				v := b.Get([]byte(id))
+				if v != nil {
+					if old, err = fromJSON(v); err != nil {
+						log.Printf("json: %v", err)
+						return err
+					}
+				}
+				// old is kept as stored, to unindex its unique values.
+				if v != nil && merge {
+					if m, err = fromJSON(v); err != nil {
+						log.Printf("json: %v", err)
+						return err
+					}
+					for k, v := range l.Entity {
+						m[k] = v
+					}
+				}
+				out, err := toJSON(m)
+				if err != nil {
+					log.Printf("json: %v", err)
+					return err
+				}
+				if err := s.checkSize(ns+l.Kind, out); err != nil {
+					tooLarge = err
+					return err
+				}
+				// Entities are stored as given, but their unique
+				// fields are indexed as any other write's are.
+				cfg, err := s.loadConfig(tx, ns+l.Kind)
+				if err != nil {
+					log.Printf("config: %v", err)
+					return err
+				}
+				if msg, err := claimUnique(tx, cfg, ns+l.Kind, id, old, m); err != nil {
+					return err
+				} else if msg != "" {
+					conflict = fmt.Sprintf("line %d: %s", n+i+1, msg)
+					return errRollback
+				}
+				if err := b.Put([]byte(id), out); err != nil {
+					log.Printf("put: %v", err)
+					return err
+				}
+			}
+			return nil
+		})
+		if tooLarge != nil {
+			return []byte(tooLarge.Error()), http.StatusRequestEntityTooLarge
+		}
+		if conflict != "" {
+			return []byte(conflict), http.StatusConflict
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError
+		}
+		n += len(batch)
+	}
+	out, err := toJSON(map[string]interface{}{"imported": n})
+	if err != nil {
+		log.Printf("json: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	return out, http.StatusOK
+}
+
+// checkImport checks that a line of an import can be written: its kind must
+// be one clients may write to, and its entity must be valid and have a valid
+// ID. Configs must be valid, as they'd be if they were written directly.
+func (s *Server) checkImport(l exportLine) error {
+	if l.Kind == "" || strings.Contains(l.Kind, "/") || !validKind(l.Kind) {
+		return fmt.Errorf("invalid kind %q", l.Kind)
+	}
+	if s.kinds != nil && !s.kinds[l.Kind] {
+		return fmt.Errorf("kind %q is not allowed", l.Kind)
+	}
+	if l.Entity == nil {
+		return fmt.Errorf("missing entity")
+	}
+	if id, _ := l.Entity[idKey].(string); id == "" {
+		return fmt.Errorf("missing %s", idKey)
+	} else if !validID(id) {
+		return fmt.Errorf("invalid %s %q", idKey, id)
+	}
+	if err := s.checkEntity(l.Entity); err != nil {
+		return err
+	}
+	if l.Kind == configKind {
+		b, err := json.Marshal(l.Entity)
+		if err == nil {
+			err = s.checkConfig(b)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid config: %v", err)
+		}
+	}
+	return applyTTL(l.Entity)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// exported returns the "<Kind>/<ID>" of each line of an export.
+func exported(t *testing.T, w *httptest.ResponseRecorder) []string {
+	if w.Code != http.StatusOK {
+		t.Fatalf("export: got %d", w.Code)
+	}
+	got := []string{}
+	dec := json.NewDecoder(w.Body)
+	for dec.More() {
+		var l exportLine
+		if err := dec.Decode(&l); err != nil {
+			t.Fatalf("export: %v", err)
+		}
+		got = append(got, l.Kind+"/"+l.Entity[idKey].(string))
+	}
+	return got
+}
+
+func TestExport(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, path := range []string{"/Posts/p1", "/Data/b", "/Data/a", "/Posts/p2"} {
+		if w := do(s, "PUT", path, `{"x":1}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", path, w.Code)
+		}
+	}
+	if w := do(s, "PUT", "/Data/c", `{"_ttl":0}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT expired: got %d", w.Code)
+	}
+
+	w := do(s, "GET", "/_export", "")
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	want := []string{"Data/a", "Data/b", "Posts/p1", "Posts/p2"}
+	if got := exported(t, w); !reflect.DeepEqual(got, want) {
+		t.Errorf("export: got %v, want %v", got, want)
+	}
+	for after, want := range map[string][]string{
+		"Data/a":   {"Data/b", "Posts/p1", "Posts/p2"},
+		"Data/b":   {"Posts/p1", "Posts/p2"},
+		"Data/aa":  {"Data/b", "Posts/p1", "Posts/p2"},
+		"Posts/p2": {},
+	} {
+		if got := exported(t, do(s, "GET", "/_export?after="+after, "")); !reflect.DeepEqual(got, want) {
+			t.Errorf("after=%s: got %v, want %v", after, got, want)
+		}
+	}
+	if w := do(s, "GET", "/_export?after=Data", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid after: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := do(s, "POST", "/_export", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestExportNamespace(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.auth = apiKeyAuth{"k1": "alice", "k2": "bob"}
+
+	for key, path := range map[string]string{"k1": "/Data/a", "k2": "/Data/b"} {
+		r, _ := http.NewRequest("PUT", path, strings.NewReader(`{"x":1}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(apiKeyHeader, key)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", path, w.Code)
+		}
+	}
+	r, _ := http.NewRequest("GET", "/_export", nil)
+	r.Header.Set(apiKeyHeader, "k1")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if got := exported(t, w); !reflect.DeepEqual(got, []string{"Data/a"}) {
+		t.Errorf("got %v, want only alice's entity", got)
+	}
+}
+
+func TestImport(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.auth = apiKeyAuth{"k1": "alice", "k2": "bob"}
+	as := func(key, method, path, contentType, body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, path, strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		r.Header.Set(apiKeyHeader, key)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	for path, body := range map[string]string{
+		"/Data/a":   `{"x":1,"_readonly":true}`,
+		"/Data/b":   `{"x":2,"y":{"z":[1,"two"]}}`,
+		"/Posts/p1": `{"title":"hi"}`,
+	} {
+		if w := as("k1", "PUT", path, "application/json", body); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", path, w.Code)
+		}
+	}
+	export := as("k1", "GET", "/_export", "", "").Body.String()
+
+	// Round-trip alice's export into bob's empty namespace.
+	w := as("k2", "POST", "/_import", "application/x-ndjson", export)
+	if w.Code != http.StatusOK {
+		t.Fatalf("import: got %d: %s", w.Code, w.Body)
+	}
+	if got := decode(t, w)["imported"]; got != 3.0 {
+		t.Errorf("import: got imported=%v, want 3", got)
+	}
+	if got := as("k2", "GET", "/_export", "", "").Body.String(); got != export {
+		t.Errorf("re-export:\n got %s\nwant %s", got, export)
+	}
+
+	// Importing again replaces objects, ignoring locks, unless merging.
+	line := `{"kind":"Data","entity":{"_id":"a","w":true}}`
+	if w := as("k2", "POST", "/_import?mode=merge", "application/x-ndjson", line); w.Code != http.StatusOK {
+		t.Fatalf("merge: got %d: %s", w.Code, w.Body)
+	}
+	if got := decode(t, as("k2", "GET", "/Data/a", "", "")); got["x"] != 1.0 || got["w"] != true {
+		t.Errorf("merge: got %v", got)
+	}
+	if w := as("k2", "POST", "/_import", "application/x-ndjson", line); w.Code != http.StatusOK {
+		t.Fatalf("replace: got %d: %s", w.Code, w.Body)
+	}
+	if got := decode(t, as("k2", "GET", "/Data/a", "", "")); got["x"] != nil || got["w"] != true {
+		t.Errorf("replace: got %v", got)
+	}
+
+	for _, c := range []struct {
+		path, contentType, body string
+		want                    int
+	}{
+		{"/_import?mode=upsert", "application/x-ndjson", line, http.StatusBadRequest},
+		{"/_import", "text/plain", line, http.StatusUnsupportedMediaType},
+		{"/_import", "application/json", line, http.StatusOK},
+		{"/_import", "application/x-ndjson", `{"kind":"Data","entity":{"x":1}}`, http.StatusBadRequest},
+		{"/_import", "application/x-ndjson", `{"kind":"a--b","entity":{"_id":"a"}}`, http.StatusBadRequest},
+		{"/_import", "application/x-ndjson", `{"kind":"Data","entity":{"_id":"a","_bogus":1}}`, http.StatusBadRequest},
+		{"/_import", "application/x-ndjson", line + "\nnot json", http.StatusBadRequest},
+		{"/_import", "application/x-ndjson", `{"kind":"Data","entity":{"_id":"a/b"}}`, http.StatusBadRequest},
+		{"/_import", "application/x-ndjson", `{"kind":"Data","entity":{"_id":"_a"}}`, http.StatusBadRequest},
+		{"/_import", "application/x-ndjson", `{"kind":"_config","entity":{"_id":"Data","encrypted":["ssn"]}}`, http.StatusBadRequest},
+	} {
+		if w := as("k2", "POST", c.path, c.contentType, c.body); w.Code != c.want {
+			t.Errorf("POST %s %q: got %d, want %d", c.path, c.body, w.Code, c.want)
+		}
+	}
+
+	// Unique fields are checked and indexed as for any other write.
+	if w := as("k2", "PUT", "/_config/Users", "application/json", `{"unique":["email"]}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT config: got %d", w.Code)
+	}
+	for _, c := range []struct {
+		body string
+		want int
+	}{
+		{`{"kind":"Users","entity":{"_id":"u1","email":"a@x"}}`, http.StatusOK},
+		{`{"kind":"Users","entity":{"_id":"u2","email":"a@x"}}`, http.StatusConflict},
+		{`{"kind":"Users","entity":{"_id":"u2","email":"b@x"}}` + "\n" + `{"kind":"Users","entity":{"_id":"u3","email":"b@x"}}`, http.StatusConflict},
+		{`{"kind":"Users","entity":{"_id":"u1","email":"c@x"}}`, http.StatusOK},
+	} {
+		if w := as("k2", "POST", "/_import", "application/x-ndjson", c.body); w.Code != c.want {
+			t.Errorf("import %s: got %d %s, want %d", c.body, w.Code, w.Body, c.want)
+		}
+	}
+	if w := as("k2", "GET", "/Users/u2", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET u2: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	// u1's old email was unindexed, and its new one indexed.
+	if w := as("k2", "PUT", "/Users/u4", "application/json", `{"email":"a@x"}`); w.Code != http.StatusOK {
+		t.Errorf("PUT with u1's old email: got %d", w.Code)
+	}
+	if w := as("k2", "PUT", "/Users/u5", "application/json", `{"email":"c@x"}`); w.Code != http.StatusConflict {
+		t.Errorf("PUT with u1's email: got %d, want %d", w.Code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// firstID and lastID are the IDs, as in /<Kind>/_first and
+	// /<Kind>/_last, that get the first or last matching entity of a kind.
+	firstID = "_first"
+	lastID  = "_last"
+)
+
+// first returns the first entity of a kind matching uq's filters, in the order
+// given by uq's sort, the kind's default sort, or ID. If last is true, it
+// returns the first in the reverse order instead: each sort field reversed,
+// or the highest ID. Only the best entity so far is held in memory. If no
+// entity matches, the status is 404.
+func (s *Server) first(kind string, uq userQuery, last bool) ([]byte, int) {
+	orders, err := parseSort(uq.Sort)
+	if err != nil {
+		return nil, http.StatusBadRequest
+	}
+	var best map[string]interface{}
+	code, msg := http.StatusOK, ""
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(kind))
+		if b == nil {
+			code = http.StatusNotFound
+			return nil
+		}
+		cfg, err := s.loadConfig(tx, kind)
+		if err != nil {
+			log.Printf("config: %v", err)
+			return err
+		}
+		if err := cfg.checkQuery(uq); err != nil {
+			code, msg = http.StatusBadRequest, err.Error()
+			return nil
+		}
+		if uq.Sort == "" {
+			orders, _ = parseSort(cfg.Sort)
+		}
+		uq := cfg.storedQuery(uq)
+		if last {
+			for i := range orders {
+				orders[i].Desc = !orders[i].Desc
+			}
+		}
+		c := b.Cursor()
+		k, v := c.First()
+		next := c.Next
+		// Without a sort, entities are in ID order, so scanning stops at the
+		// first match from the start, or the end.
+		if last && len(orders) == 0 {
+			k, v = c.Last()
+			next = c.Prev
+		}
+		for ; k != nil; k, v = next() {
+			m, err := fromJSON(v)
+			if err != nil {
+				log.Printf("json: %v", err)
+				return err
+			}
+			if expired(m) || !matchesFilters(m, uq.Filters) || !matchesOr(m, uq.Or) {
+				continue
+			}
+			if best == nil || (byOrders{[]map[string]interface{}{m, best}, orders}).Less(0, 1) {
+				best = m
+			}
+			if len(orders) == 0 {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+	if code != http.StatusOK {
+		return []byte(msg), code
+	}
+	if best == nil {
+		return nil, http.StatusNotFound
+	}
+	out, err := toJSON(best)
+	if err != nil {
+		log.Printf("json: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	return out, http.StatusOK
+}
@@ -0,0 +1,32 @@
+package main
+
+const (
+	// jsonAPIFormat is the value of the format param requesting responses
+	// in JSON:API's envelope, described at http://jsonapi.org/format/.
+	jsonAPIFormat = "jsonapi"
+
+	// jsonAPIContentType is the media type of JSON:API responses.
+	jsonAPIContentType = "application/vnd.api+json"
+)
+
+// jsonAPIResource returns entity m of a kind as a JSON:API resource object: its
+// ID and kind become the resource's id and type, and its other fields, metadata
+// included, become attributes. If keysOnly is true the resource is just an
+// identifier, without attributes.
+func jsonAPIResource(kind string, m map[string]interface{}, keysOnly bool) map[string]interface{} {
+	res := map[string]interface{}{
+		"type": kind,
+		"id":   m[idKey],
+	}
+	if keysOnly {
+		return res
+	}
+	attrs := map[string]interface{}{}
+	for k, v := range m {
+		if k != idKey {
+			attrs[k] = v
+		}
+	}
+	res["attributes"] = attrs
+	return res
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// keyKind is the path, /_key/<key>, that gets an entity by its encoded key.
+const keyKind = "_key"
+
+var invalidKey = errors.New("invalid key")
+
+// encodeKey encodes the namespaced kind and ID of an entity as an opaque,
+// URL-safe key, which clients can store to refer to the entity.
+func encodeKey(kind, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(kind + "/" + id))
+}
+
+// decodeKey decodes a key produced by encodeKey into a namespaced kind and
+// ID.
+func decodeKey(key string) (string, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return "", "", invalidKey
+	}
+	i := strings.Index(string(b), "/")
+	if i <= 0 || i == len(b)-1 {
+		return "", "", invalidKey
+	}
+	return string(b[:i]), string(b[i+1:]), nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// keyCases are the field name cases clients can ask for with a keyCase param.
+// With either, objects are stored with snake_case names: request bodies, and
+// fields named in list params, are converted to snake_case, and responses are
+// converted to the requested case. Metadata fields, starting with "_", are
+// never converted.
+var keyCases = map[string]func(string) string{
+	"snake": toSnake,
+	"camel": toCamel,
+}
+
+// toSnake converts a camelCase name to snake_case, e.g. "firstName" becomes
+// "first_name".
+func toSnake(s string) string {
+	var out []rune
+	var prev rune
+	for _, r := range s {
+		if unicode.IsUpper(r) && (unicode.IsLower(prev) || unicode.IsDigit(prev)) {
+			out = append(out, '_')
+		}
+		out = append(out, unicode.ToLower(r))
+		prev = r
+	}
+	return string(out)
+}
+
+// toCamel converts a snake_case name to camelCase, e.g. "first_name" becomes
+// "firstName".
+func toCamel(s string) string {
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// convertKeys returns v with the field names of every object in it, at any
+// depth, converted by f. Names starting with "_" or "$" are left alone, though
+// the objects they hold are converted.
+func convertKeys(v interface{}, f func(string) string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, c := range v {
+			if !strings.HasPrefix(k, "_") && !strings.HasPrefix(k, "$") {
+				k = f(k)
+			}
+			out[k] = convertKeys(c, f)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, c := range v {
+			out[i] = convertKeys(c, f)
+		}
+		return out
+	}
+	return v
+}
+
+// convertPath converts each part of a dotted path with f.
+func convertPath(p string, f func(string) string) string {
+	parts := strings.Split(p, ".")
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "_") {
+			parts[i] = f(part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// convertBody converts the field names in a request body to snake_case for
+// storage. Besides object keys, that includes the names listed in a PATCH's
+// $unset and the field named by an _inc.
+func convertBody(m map[string]interface{}, action string) map[string]interface{} {
+	m = convertKeys(m, toSnake).(map[string]interface{})
+	if names, ok := m["$unset"].([]interface{}); ok {
+		for i, n := range names {
+			if s, ok := n.(string); ok {
+				names[i] = convertPath(s, toSnake)
+			}
+		}
+	}
+	if f, ok := m["field"].(string); ok && action == "_inc" {
+		m["field"] = convertPath(f, toSnake)
+	}
+	return m
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeyCaseConversion(t *testing.T) {
+	for _, c := range []struct {
+		camel, snake string
+	}{
+		{"name", "name"},
+		{"firstName", "first_name"},
+		{"addressLine2", "address_line2"},
+		{"userId", "user_id"},
+		{"aBC", "a_bc"},
+	} {
+		if got := toSnake(c.camel); got != c.snake {
+			t.Errorf("toSnake(%q): got %q, want %q", c.camel, got, c.snake)
+		}
+	}
+	for _, c := range []struct {
+		snake, camel string
+	}{
+		{"name", "name"},
+		{"first_name", "firstName"},
+		{"address_line2", "addressLine2"},
+		{"trailing_", "trailing"},
+	} {
+		if got := toCamel(c.snake); got != c.camel {
+			t.Errorf("toCamel(%q): got %q, want %q", c.snake, got, c.camel)
+		}
+	}
+
+	in := map[string]interface{}{
+		"_id":       "a",
+		"firstName": "Ann",
+		"nested":    map[string]interface{}{"zipCode": 1.0},
+		"list":      []interface{}{map[string]interface{}{"itemId": 2.0}, "notAKey"},
+		"$set":      map[string]interface{}{"lastName": "B"},
+	}
+	want := map[string]interface{}{
+		"_id":        "a",
+		"first_name": "Ann",
+		"nested":     map[string]interface{}{"zip_code": 1.0},
+		"list":       []interface{}{map[string]interface{}{"item_id": 2.0}, "notAKey"},
+		"$set":       map[string]interface{}{"last_name": "B"},
+	}
+	if got := convertKeys(in, toSnake); !reflect.DeepEqual(got, want) {
+		t.Errorf("convertKeys:\n got %v\nwant %v", got, want)
+	}
+	if got := convertKeys(want, toCamel); !reflect.DeepEqual(got, in) {
+		t.Errorf("convertKeys back:\n got %v\nwant %v", got, in)
+	}
+}
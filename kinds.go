@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// kindsKind is the path, /_kinds, that lists a user's kinds.
+const kindsKind = "_kinds"
+
+// listKinds returns {"kinds":[...]} with the names of the kinds in a
+// namespace, in order. Like search, it leaves out kinds starting with "_",
+// like configuration, which describe other kinds rather than holding data,
+// and kinds clients may not access.
+func (s *Server) listKinds(ns string) ([]byte, int) {
+	kinds := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			bucketNS, kind := splitNamespace(string(name))
+			if bucketNS == ns && !strings.HasPrefix(kind, "_") && (s.kinds == nil || s.kinds[kind]) {
+				kinds = append(kinds, kind)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+	out, err := toJSON(map[string]interface{}{"kinds": kinds})
+	if err != nil {
+		log.Printf("json: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	return out, http.StatusOK
+}
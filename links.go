@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// linksKey is the field that ?links=true adds to entities, and to lists,
+// holding links to related resources for hypermedia clients.
+const linksKey = "_links"
+
+// entityLinks returns the links of an entity of a kind: a link to itself.
+func entityLinks(bare, id string) map[string]string {
+	return map[string]string{"self": "/" + url.PathEscape(bare) + "/" + url.PathEscape(id)}
+}
+
+// listLinks returns the links of a page of a list: a link to itself, and to
+// the page after it, which starts at next, if there is one.
+func listLinks(r *http.Request, next string) map[string]string {
+	links := map[string]string{"self": r.URL.RequestURI()}
+	if next != "" {
+		q := r.URL.Query()
+		q.Set("start", next)
+		links["next"] = (&url.URL{Path: r.URL.Path, RawQuery: q.Encode()}).RequestURI()
+	}
+	return links
+}
+
+// addLinks adds its links to m, an entity of a kind, if it has an ID.
+func addLinks(m map[string]interface{}, bare string) {
+	if id, ok := m[idKey].(string); ok {
+		m[linksKey] = entityLinks(bare, id)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// logHandler logs the method, path, status and latency of requests to h. Error
+// responses, with a status of 400 or more, are always logged; of the rest,
+// one in every sample is logged, or none if sample isn't positive. Only the
+// path is logged, not the query, which may hold an access token.
+type logHandler struct {
+	h      http.Handler
+	sample int
+
+	// logf logs a line; if nil, log.Printf is used.
+	logf func(format string, args ...interface{})
+
+	n uint64 // successful requests so far, accessed atomically
+}
+
+func (l *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+	l.h.ServeHTTP(sw, r)
+	if sw.code < 400 {
+		if l.sample <= 0 || atomic.AddUint64(&l.n, 1)%uint64(l.sample) != 0 {
+			return
+		}
+	}
+	logf := l.logf
+	if logf == nil {
+		logf = log.Printf
+	}
+	logf("%s%s %s %d %v", sw.tags.prefix(), r.Method, r.URL.Path, sw.code, time.Since(start))
+}
+
+// statusWriter records the status of the response written through it, and
+// the tags of the request, if the handler sets them with setLogTags.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+	tags logTags
+}
+
+// logTags say who and what a request is for. Log lines about the request are
+// prefixed with them, like "[user=alice kind=Data method=GET id=a] ", so
+// they can be filtered by user or kind.
+type logTags struct {
+	User, Kind, Method, ID string
+}
+
+// newLogTags returns the tags of a request for an entity, or a kind if id is
+// empty. The kind may be namespaced, in which case the user is tagged too.
+func newLogTags(method, kind, id string) logTags {
+	ns, bare := splitNamespace(kind)
+	return logTags{strings.TrimSuffix(ns, kindSep), bare, method, id}
+}
+
+// prefix returns the prefix of log lines with the tags, which is empty if
+// there are none. Tags that are empty are left out.
+func (t logTags) prefix() string {
+	var tags []string
+	for _, tag := range []struct{ name, value string }{
+		{"user", t.User}, {"kind", t.Kind}, {"method", t.Method}, {"id", t.ID},
+	} {
+		if tag.value != "" {
+			tags = append(tags, tag.name+"="+tag.value)
+		}
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(tags, " ") + "] "
+}
+
+// printf logs a line prefixed with the tags.
+func (t logTags) printf(format string, args ...interface{}) {
+	log.Print(t.prefix() + fmt.Sprintf(format, args...))
+}
+
+// setLogTags sets the tags of the request that w is the response to, for the
+// line logHandler logs about it, if w is from a logHandler.
+func setLogTags(w http.ResponseWriter, t logTags) {
+	if sw, ok := w.(*statusWriter); ok {
+		sw.tags = t
+	}
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush flushes the underlying ResponseWriter, if it can be, so that
+// streaming responses aren't held up by logging.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// secretPattern matches the credentials a log line might include, e.g. in
+// the URL of a failed request to Google: access_token params and bearer
+// tokens.
+var secretPattern = regexp.MustCompile(`(access_token=)[^&\s"]*|(Bearer\s+)[^\s"]*`)
+
+// redact replaces the credentials in s with "REDACTED".
+func redact(s string) string {
+	return secretPattern.ReplaceAllString(s, "${1}${2}REDACTED")
+}
+
+// redactWriter redacts credentials from everything written through it. The
+// server logs through one, so errors that quote a request can't leak tokens.
+type redactWriter struct {
+	w io.Writer
+}
+
+func (r redactWriter) Write(b []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(b))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestLogHandler(t *testing.T) {
+	var lines []string
+	l := &logHandler{
+		h: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/fail" {
+				http.Error(w, "", http.StatusInternalServerError)
+			}
+		}),
+		sample: 3,
+		logf: func(format string, args ...interface{}) {
+			lines = append(lines, fmt.Sprintf(format, args...))
+		},
+	}
+	for i := 0; i < 6; i++ {
+		l.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ok?access_token=secret", nil))
+	}
+	if len(lines) != 2 {
+		t.Errorf("successes: got %d lines, want 1 in 3 of 6: %q", len(lines), lines)
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "GET /ok 200 ") {
+			t.Errorf("got line %q", line)
+		}
+	}
+
+	lines = nil
+	for i := 0; i < 3; i++ {
+		l.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fail", nil))
+	}
+	if len(lines) != 3 {
+		t.Errorf("errors: got %d lines, want every one of 3: %q", len(lines), lines)
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "GET /fail 500 ") {
+			t.Errorf("got line %q", line)
+		}
+	}
+
+	lines = nil
+	l.sample = 0
+	l.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ok", nil))
+	l.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fail", nil))
+	if len(lines) != 1 {
+		t.Errorf("no sampling: got %q, want only the error", lines)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	var buf strings.Builder
+	l := log.New(redactWriter{&buf}, "", 0)
+	l.Printf("tokeninfo: %v", `Get https://www.googleapis.com/oauth2/v3/tokeninfo?access_token=ya29.secret&x=1: timeout`)
+	l.Printf("auth: %v", `header "Authorization: Bearer ya29.other" rejected`)
+	got := buf.String()
+	if strings.Contains(got, "secret") || strings.Contains(got, "other") {
+		t.Errorf("token leaked: %q", got)
+	}
+	for _, want := range []string{"access_token=REDACTED&x=1: timeout", `Bearer REDACTED" rejected`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %q, want it to contain %q", got, want)
+		}
+	}
+	if got := redact("nothing to hide"); got != "nothing to hide" {
+		t.Errorf("redact: got %q", got)
+	}
+}
+
+func TestLogTags(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.auth = apiKeyAuth{"key1": "alice"}
+
+	var buf strings.Builder
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	// An entity that can't be decoded makes the GET log an error.
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("alice--Data"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("a"), []byte("not json"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/Data/a", nil)
+	r.Header.Set(apiKeyHeader, "key1")
+	w := httptest.NewRecorder()
+	(&logHandler{h: s}).ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("GET: got %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %q, want the error and the request", lines)
+	}
+	tags := "[user=alice kind=Data method=GET id=a] "
+	if want := tags + "json: "; !strings.HasPrefix(lines[0], want) {
+		t.Errorf("got error line %q, want it to start with %q", lines[0], want)
+	}
+	if want := tags + "GET /Data/a 500 "; !strings.HasPrefix(lines[1], want) {
+		t.Errorf("got request line %q, want it to start with %q", lines[1], want)
+	}
+
+	if got := (logTags{Kind: "Data", Method: "GET"}).prefix(); got != "[kind=Data method=GET] " {
+		t.Errorf("without user or ID: got %q", got)
+	}
+	if got := (logTags{}).prefix(); got != "" {
+		t.Errorf("without tags: got %q", got)
+	}
+}
@@ -1,27 +1,95 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
 
 var (
-	port = flag.Int("port", 8080, "port to run on")
-	db   = flag.String("db", "bolt.db", "bolt db file")
+	port        = flag.Int("port", 8080, "port to run on")
+	db          = flag.String("db", "bolt.db", "bolt db file")
+	kinds       = flag.String("kinds", "", "comma-separated list of kinds clients may access; if empty, all kinds are allowed")
+	maxBody     = flag.Int64("maxbody", 1<<20, "maximum request body size in bytes; 0 means no limit")
+	maxEntity   = flag.Int("maxentity", 1<<20, "maximum size in bytes of a stored object; 0 means no limit")
+	maxDepth    = flag.Int("maxdepth", 20, "maximum nesting depth of objects and arrays; 0 means no limit")
+	maxFilters  = flag.Int("maxfilters", 10, "maximum number of where, or and contains conditions in a query; 0 means no limit")
+	google      = flag.Bool("google", false, "authenticate requests with Google OAuth2 access tokens")
+	clientID    = flag.String("clientid", "", "if set, Google access tokens must have been issued to this OAuth2 client ID")
+	authTimeout = flag.Duration("authtimeout", 5*time.Second, "how long to wait for Google to check an access token")
+	apiKeys     = flag.String("apikeys", "", "JSON file mapping API keys to user IDs, to authenticate requests with an X-API-Key header")
+	corsMaxAge  = flag.Duration("corsmaxage", time.Hour, "how long browsers may cache CORS preflight responses; 0 means they aren't told")
+	debug       = flag.Bool("debug", false, "let clients GET entities with ?debug=true to see how they're stored, hidden fields included, and lists to see how their params were interpreted; with auth, only -admins may")
+	admins      = flag.String("admins", "", "comma-separated list of user IDs who may use -debug views when requests are authenticated")
+	logSample   = flag.Int("logsample", 0, "log one in this many successful requests; errors are always logged, and 0 logs only errors")
+	listCacheN  = flag.Int("listcache", 0, "number of list responses to cache in memory; 0 disables caching")
+	encKey      = flag.String("encryptionkey", "", "file holding a base64-encoded 32-byte key to encrypt the fields kinds are configured to encrypt")
 )
 
 func main() {
 	flag.Parse()
+	log.SetOutput(redactWriter{os.Stderr})
 	db, err := bolt.Open(*db, 0600, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
-	s := &Server{db}
+	s := &Server{db: db, maxBody: *maxBody, maxEntity: *maxEntity, maxDepth: *maxDepth, maxFilters: *maxFilters, preflightMaxAge: *corsMaxAge, debug: *debug}
+	if *encKey != "" {
+		if s.fieldCipher, err = loadFieldCipher(*encKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *admins != "" {
+		s.admins = map[string]bool{}
+		for _, u := range strings.Split(*admins, ",") {
+			s.admins[u] = true
+		}
+	}
+	if *listCacheN > 0 {
+		s.cache = newListCache(*listCacheN)
+	}
+	if *kinds != "" {
+		s.kinds = map[string]bool{}
+		for _, k := range strings.Split(*kinds, ",") {
+			s.kinds[k] = true
+		}
+	}
+	if *google || *apiKeys != "" {
+		var a selectAuth
+		if *google {
+			a.google = googleAuth{&http.Client{Timeout: *authTimeout}, *clientID}
+		}
+		if *apiKeys != "" {
+			keys, err := loadAPIKeys(*apiKeys)
+			if err != nil {
+				log.Fatal(err)
+			}
+			a.apiKey = keys
+		}
+		s.auth = a
+	}
 	log.Println("server start")
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), s))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), &logHandler{h: s, sample: *logSample}))
+}
+
+// loadAPIKeys reads a JSON file mapping API keys to user IDs.
+func loadAPIKeys(path string) (apiKeyAuth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var keys apiKeyAuth
+	if err := json.NewDecoder(f).Decode(&keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
 }
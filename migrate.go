@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// migrateKind is the path, /_migrate, that moves another account's
+	// entities into the requesting user's.
+	migrateKind = "_migrate"
+
+	// migrateFromPrefix prefixes the headers carrying the credentials of the
+	// account to migrate from, e.g. X-Migrate-From-Authorization.
+	migrateFromPrefix = "X-Migrate-From-"
+)
+
+// migrate moves every entity of every kind from another user's namespace into
+// ns, e.g. when a user's Google account changes, and returns the number
+// moved. The other user is identified by their own credentials, in the usual
+// headers prefixed with migrateFromPrefix, so a migration needs valid
+// credentials for both accounts.
+//
+// Entities are moved in batches of importBatchSize, each in its own
+// transaction, and kinds are removed from the old namespace once they're
+// empty. If the new namespace already has an entity with the same kind and
+// ID, the migration stops with a 409 Conflict; since moved entities are no
+// longer in the old namespace, an interrupted or stopped migration can
+// simply be sent again.
+func (s *Server) migrate(r *http.Request, ns string) ([]byte, int) {
+	from, err := s.auth.UserID(migrateFrom(r))
+	if err == nil && !validUserID(from) {
+		err = errUnauthorized
+	}
+	switch err {
+	case nil:
+	case errUnauthorized:
+		return []byte("the account to migrate from is unauthorized"), http.StatusUnauthorized
+	case errUpstream:
+		return nil, http.StatusBadGateway
+	case errUpstreamTimeout:
+		return nil, http.StatusGatewayTimeout
+	default:
+		return nil, http.StatusInternalServerError
+	}
+	old := from + kindSep
+	if old == ns {
+		return []byte("an account can't be migrated to itself"), http.StatusBadRequest
+	}
+	type entry struct {
+		kind string
+		k, v []byte
+	}
+	n := 0
+	for {
+		var batch []entry
+		conflict := ""
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			var kinds []string
+			if err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				// Another user's namespace may start with this one,
+				// so only exactly this one is moved.
+				owner, kind := splitNamespace(string(name))
+				if owner != old {
+					return nil
+				}
+				kinds = append(kinds, kind)
+				c := b.Cursor()
+				for k, v := c.First(); k != nil && len(batch) < importBatchSize; k, v = c.Next() {
+					batch = append(batch, entry{kind, append([]byte(nil), k...), append([]byte(nil), v...)})
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, e := range batch {
+				b, err := tx.CreateBucketIfNotExists([]byte(ns + e.kind))
+				if err != nil {
+					log.Printf("create bucket: %v", err)
+					return err
+				}
+				if b.Get(e.k) != nil {
+					conflict = fmt.Sprintf("%s/%s exists in both accounts", e.kind, e.k)
+					return errRollback
+				}
+				if err := b.Put(e.k, e.v); err != nil {
+					log.Printf("put: %v", err)
+					return err
+				}
+				if err := tx.Bucket([]byte(old + e.kind)).Delete(e.k); err != nil {
+					log.Printf("delete: %v", err)
+					return err
+				}
+			}
+			for _, kind := range kinds {
+				if k, _ := tx.Bucket([]byte(old + kind)).Cursor().First(); k != nil {
+					continue
+				}
+				if err := tx.DeleteBucket([]byte(old + kind)); err != nil {
+					log.Printf("delete bucket: %v", err)
+					return err
+				}
+			}
+			return nil
+		})
+		if conflict != "" {
+			return []byte(conflict), http.StatusConflict
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError
+		}
+		if len(batch) == 0 {
+			break
+		}
+		n += len(batch)
+	}
+	out, err := toJSON(map[string]interface{}{"moved": n})
+	if err != nil {
+		log.Printf("json: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	return out, http.StatusOK
+}
+
+// migrateFrom returns a request bearing the credentials of the account to
+// migrate from, taken from r's headers prefixed with migrateFromPrefix.
+func migrateFrom(r *http.Request) *http.Request {
+	fr, _ := http.NewRequest("GET", "/", nil)
+	for name, vs := range r.Header {
+		if strings.HasPrefix(name, migrateFromPrefix) {
+			fr.Header[http.CanonicalHeaderKey(strings.TrimPrefix(name, migrateFromPrefix))] = vs
+		}
+	}
+	return fr
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// centsPerUnit is the scale at which money fields are stored.
+const centsPerUnit = 100
+
+// toCents converts m's money fields, given as decimals like 9.99, to the
+// integer number of cents they're stored as, like 999. Any fraction of a cent
+// is rounded away. It fails if a money field isn't a number.
+func (cfg *kindConfig) toCents(m map[string]interface{}) error {
+	for _, f := range cfg.Money {
+		v, found := lookup(m, f)
+		if !found || v == nil {
+			continue
+		}
+		x, ok := v.(float64)
+		if !ok {
+			return fmt.Errorf("money field %q must be a number", f)
+		}
+		setPath(m, f, math.Round(x*centsPerUnit))
+	}
+	return nil
+}
+
+// fromCents converts m's money fields from the cents they're stored as back
+// to decimals.
+func (cfg *kindConfig) fromCents(m map[string]interface{}) {
+	for _, f := range cfg.Money {
+		v, _ := lookup(m, f)
+		if x, ok := v.(float64); ok {
+			setPath(m, f, x/centsPerUnit)
+		}
+	}
+}
+
+// isMoney reports whether a field is a money field.
+func (cfg *kindConfig) isMoney(field string) bool {
+	for _, f := range cfg.Money {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// storedQuery returns uq with the values of filters on money fields converted
+// to cents, so they can be compared to entities as stored.
+func (cfg *kindConfig) storedQuery(uq userQuery) userQuery {
+	if len(cfg.Money) == 0 {
+		return uq
+	}
+	convert := func(fs []filter) []filter {
+		out := make([]filter, len(fs))
+		for i, f := range fs {
+			if x, ok := parseValue(f.Value).(float64); ok && cfg.isMoney(f.Key) {
+				f.Value = strconv.FormatFloat(math.Round(x*centsPerUnit), 'f', -1, 64)
+			}
+			out[i] = f
+		}
+		return out
+	}
+	or := make([][]filter, len(uq.Or))
+	for i, g := range uq.Or {
+		or[i] = convert(g)
+	}
+	uq.Filters, uq.Or = convert(uq.Filters), or
+	return uq
+}
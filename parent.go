@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// parentKey is the field holding the key of an entity's parent, as
+// "<Kind>/<id>". Entities are given parents by being created under them, with
+// a nested path like /People/123/Posts, or by giving the field themselves.
+// Like the rest of an entity's key, its parent is fixed once it's created.
+const parentKey = "_parent"
+
+// splitParent splits a parent key like "People/123" into its kind and ID,
+// and reports whether it's a valid key of an entity of an ordinary kind.
+func splitParent(key string) (kind, id string, ok bool) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	if strings.HasPrefix(parts[0], "_") || !validKind(parts[0]) {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// exists reports whether an entity of a kind exists and hasn't expired.
+func exists(tx *bolt.Tx, kind, id string) (bool, error) {
+	b := tx.Bucket([]byte(kind))
+	if b == nil {
+		return false, nil
+	}
+	v := b.Get([]byte(id))
+	if v == nil {
+		return false, nil
+	}
+	m, err := fromJSON(v)
+	if err != nil {
+		return false, err
+	}
+	return !expired(m), nil
+}
+
+// checkParent checks that the "_parent" of a new entity of a kind, if it has
+// one, is the key of an existing entity of the same user.
+func checkParent(tx *bolt.Tx, kind string, m map[string]interface{}) (string, error) {
+	v, found := m[parentKey]
+	if !found {
+		return "", nil
+	}
+	s, _ := v.(string)
+	parentKind, parentID, ok := splitParent(s)
+	if ok {
+		ns, _ := splitNamespace(kind)
+		var err error
+		if ok, err = exists(tx, ns+parentKind, parentID); err != nil {
+			return "", err
+		}
+	}
+	if !ok {
+		b, _ := json.Marshal(v)
+		return fmt.Sprintf("%s %s isn't the key of an existing object", parentKey, b), nil
+	}
+	return "", nil
+}
+
+// keepParent carries the parent of old, an entity as stored, over to m, the
+// entity it's being replaced with, which needn't give it. If m gives another
+// parent, that's an error, since an entity's parent can't change.
+func keepParent(old, m map[string]interface{}) error {
+	v, found := m[parentKey]
+	want, had := old[parentKey].(string)
+	if got, _ := v.(string); found && (!had || got != want) {
+		b, _ := json.Marshal(v)
+		return fmt.Errorf("%s can't be changed to %s once an object exists", parentKey, b)
+	}
+	if had {
+		m[parentKey] = want
+	}
+	return nil
+}
+
+// nest prepares a request for a path nested under parent, the key of an
+// entity of namespace ns, to be handled as a request for the child kind's own
+// path. Lists and queries are filtered to the parent's children; entities of
+// the kind that aren't its children are treated as missing; and the objects
+// of writes are given the parent. If the parent doesn't exist, or the request
+// doesn't make sense for a parent's children, it sends an error and returns
+// false.
+func (s *Server) nest(lt logTags, w http.ResponseWriter, r *http.Request, ns, parent, kind, id, action string) bool {
+	// These act on the whole kind, whatever their parents.
+	if id == eventsID || id == renameID || id == dropFieldID || (id == "" && r.Method == "DELETE") {
+		http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+		return false
+	}
+	parentKind, parentID, _ := splitParent(parent)
+	code := http.StatusOK
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ok, err := exists(tx, ns+parentKind, parentID)
+		if err != nil {
+			lt.printf("json: %v", err)
+			return err
+		}
+		if !ok {
+			code = http.StatusNotFound
+			return nil
+		}
+		if id == "" || strings.HasPrefix(id, "_") {
+			return nil
+		}
+		b := tx.Bucket([]byte(kind))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(id)); v != nil {
+			m, err := fromJSON(v)
+			if err != nil {
+				lt.printf("json: %v", err)
+				return err
+			}
+			if !expired(m) && m[parentKey] != parent {
+				code = http.StatusNotFound
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return false
+	}
+	if code != http.StatusOK {
+		http.Error(w, "Not Found", code)
+		return false
+	}
+
+	if r.Method == "GET" || r.Method == "HEAD" {
+		q := r.URL.Query()
+		q.Add("where", parentKey+"="+parent)
+		r.URL.RawQuery, r.Form = q.Encode(), nil
+		return true
+	}
+	if action != "" || (r.Method != "POST" && r.Method != "PUT") {
+		return true
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		lt.printf("readall: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return false
+	}
+	// Bodies that aren't objects, or batches of them, are left for the
+	// handler to reject.
+	var conflict error
+	setParent := func(m map[string]interface{}) {
+		if v, found := m[parentKey]; found && v != parent {
+			b, _ := json.Marshal(v)
+			conflict = fmt.Errorf("%s %s doesn't match the parent %q in the path", parentKey, b, parent)
+		}
+		m[parentKey] = parent
+	}
+	var items []interface{}
+	if m, merr := fromJSON(body); merr == nil && m != nil {
+		setParent(m)
+		body, err = toJSON(m)
+	} else if id == "" && json.Unmarshal(body, &items) == nil {
+		for _, item := range items {
+			if m, ok := item.(map[string]interface{}); ok {
+				setParent(m)
+			}
+		}
+		body, err = json.Marshal(items)
+	}
+	if err != nil {
+		lt.printf("json: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return false
+	}
+	if conflict != nil {
+		http.Error(w, conflict.Error(), http.StatusConflict)
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return true
+}
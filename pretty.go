@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// prettyWriter indents the JSON responses written through it, for
+// ?pretty=true. A JSON response is held until finish, since it can only be
+// indented whole; anything else, like an event stream, is passed straight
+// through.
+type prettyWriter struct {
+	http.ResponseWriter
+	decided, holding bool
+	code             int
+	buf              bytes.Buffer
+}
+
+// decide checks whether the response is JSON, once its headers are set.
+func (w *prettyWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	mt, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	w.holding = mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+func (w *prettyWriter) WriteHeader(code int) {
+	if w.decide(); w.holding {
+		w.code = code
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *prettyWriter) Write(b []byte) (int, error) {
+	if w.decide(); w.holding {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flushes a response that's passed straight through.
+func (w *prettyWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.holding {
+		f.Flush()
+	}
+}
+
+// finish writes a held response, indented with two spaces. A response that
+// doesn't parse, such as a truncated one, is written as it was. Since
+// indenting changes the length of the response, its Content-Length is
+// corrected, or removed if there was no body to indent, as for a HEAD.
+func (w *prettyWriter) finish() {
+	if !w.holding {
+		return
+	}
+	b := w.buf.Bytes()
+	var out bytes.Buffer
+	if err := json.Indent(&out, b, "", "  "); err == nil {
+		b = out.Bytes()
+	}
+	if w.Header().Get("Content-Length") != "" {
+		if len(b) > 0 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		} else {
+			w.Header().Del("Content-Length")
+		}
+	}
+	if w.code != 0 {
+		w.ResponseWriter.WriteHeader(w.code)
+	}
+	w.ResponseWriter.Write(b)
+}
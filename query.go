@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxCursorLength is the longest cursor token accepted. Tokens encode an
+// offset, so valid ones are much shorter, and always fit in a URL.
+const maxCursorLength = 64
+
+var (
+	invalidCursor  = errors.New("invalid cursor")
+	cursorTooLong  = fmt.Errorf("invalid cursor: longer than %d characters", maxCursorLength)
+	cursorMismatch = errors.New("invalid cursor: from a different query")
+)
+
+// sortOrder is a single field of a sort specification.
+type sortOrder struct {
+	Field string
+	Desc  bool
+}
+
+// parseSort parses a comma-separated sort specification like "-age,name".
+// Fields may be dotted paths into nested objects, like "address.zip", and
+// are sorted descending when prefixed with "-".
+func parseSort(s string) ([]sortOrder, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var orders []sortOrder
+	for _, f := range strings.Split(s, ",") {
+		o := sortOrder{Field: f}
+		if strings.HasPrefix(f, "-") {
+			o = sortOrder{Field: f[1:], Desc: true}
+		}
+		if !validPath(o.Field) {
+			return nil, errors.New("invalid sort: " + f)
+		}
+		orders = append(orders, o)
+	}
+	return orders, nil
+}
+
+// applyOrder applies an order param, "asc" or "desc", to a sort
+// specification, for clients that would rather not prefix fields with "-".
+// With "desc", every field of the sort sorts descending, except those already
+// prefixed with "-", which is taken to be what the client meant; with "asc",
+// or no order, the sort is unchanged.
+func applyOrder(sort, order string) (string, error) {
+	switch order {
+	case "", "asc":
+		return sort, nil
+	case "desc":
+	default:
+		return "", errors.New("order must be asc or desc")
+	}
+	if sort == "" {
+		return "", errors.New("order requires a sort")
+	}
+	fields := strings.Split(sort, ",")
+	for i, f := range fields {
+		if !strings.HasPrefix(f, "-") {
+			fields[i] = "-" + f
+		}
+	}
+	return strings.Join(fields, ","), nil
+}
+
+// validPath reports whether p is a valid, possibly dotted, property path.
+func validPath(p string) bool {
+	if p == "" {
+		return false
+	}
+	for _, part := range strings.Split(p, ".") {
+		if part == "" || strings.HasPrefix(part, "-") {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the value at a dotted property path in m, e.g.
+// "address.zip" returns m["address"]["zip"].
+func lookup(m map[string]interface{}, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+	for i, p := range parts {
+		v, found := m[p]
+		if !found {
+			return nil, false
+		}
+		if i == len(parts)-1 {
+			return v, true
+		}
+		if m, found = v.(map[string]interface{}); !found {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// setPath sets the value at a dotted property path in m, creating objects
+// along the path as needed, e.g. "address.city" sets m["address"]["city"]
+// and leaves the rest of m["address"] alone. It fails if the path runs
+// through a value that isn't an object.
+func setPath(m map[string]interface{}, path string, v interface{}) error {
+	parts := strings.Split(path, ".")
+	for i, p := range parts[:len(parts)-1] {
+		next, found := m[p]
+		if !found {
+			next = map[string]interface{}{}
+			m[p] = next
+		}
+		var ok bool
+		if m, ok = next.(map[string]interface{}); !ok {
+			return fmt.Errorf("can't set %s: %s is not an object", path, strings.Join(parts[:i+1], "."))
+		}
+	}
+	m[parts[len(parts)-1]] = v
+	return nil
+}
+
+// deletePath removes the value at a dotted property path in m, if there is
+// one.
+func deletePath(m map[string]interface{}, path string) {
+	parts := strings.Split(path, ".")
+	for _, p := range parts[:len(parts)-1] {
+		var ok bool
+		if m, ok = m[p].(map[string]interface{}); !ok {
+			return
+		}
+	}
+	delete(m, parts[len(parts)-1])
+}
+
+// parseValue parses a filter value from a query string. Values that are
+// valid JSON, like 1, true, null or "1", are parsed as such; anything else is
+// taken to be a string.
+func parseValue(s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	return v
+}
+
+// typeRank orders values of different types: null, then booleans, numbers,
+// strings, and finally arrays and objects.
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	}
+	return 4
+}
+
+// compareValues compares two decoded JSON values, returning -1, 0 or 1.
+// Arrays and objects compare equal to each other.
+func compareValues(a, b interface{}) int {
+	if ra, rb := typeRank(a), typeRank(b); ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+	switch a := a.(type) {
+	case bool:
+		b := b.(bool)
+		if a == b {
+			return 0
+		} else if !a {
+			return -1
+		}
+		return 1
+	case float64:
+		b := b.(float64)
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+	case string:
+		b := b.(string)
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+	}
+	return 0
+}
+
+// matches reports whether the value v satisfies an equality filter on want.
+// A filter on an array property matches if any element matches.
+func matches(v, want interface{}) bool {
+	if vs, ok := v.([]interface{}); ok {
+		for _, e := range vs {
+			if matches(e, want) {
+				return true
+			}
+		}
+		return false
+	}
+	return typeRank(v) < 4 && compareValues(v, want) == 0
+}
+
+// containsString reports whether the value v is a string containing sub. Like
+// other filters, a contains filter on an array property matches if any
+// element matches.
+func containsString(v interface{}, sub string) bool {
+	if vs, ok := v.([]interface{}); ok {
+		for _, e := range vs {
+			if containsString(e, sub) {
+				return true
+			}
+		}
+		return false
+	}
+	s, ok := v.(string)
+	return ok && strings.Contains(s, sub)
+}
+
+// compares reports whether the value v satisfies an inequality filter on
+// want. Like equality filters, inequality filters on an array property match
+// if any element matches, and values only compare to values of the same type.
+func compares(v interface{}, op string, want interface{}) bool {
+	if vs, ok := v.([]interface{}); ok {
+		for _, e := range vs {
+			if compares(e, op, want) {
+				return true
+			}
+		}
+		return false
+	}
+	if typeRank(v) != typeRank(want) {
+		return false
+	}
+	c := compareValues(v, want)
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// matchesFilters reports whether an entity satisfies all the filters.
+// Entities missing a filtered property never match.
+func matchesFilters(m map[string]interface{}, filters []filter) bool {
+	for _, f := range filters {
+		v, found := lookup(m, f.Key)
+		if !found {
+			return false
+		}
+		// IDs are always strings, even if they look like numbers.
+		var want interface{} = f.Value
+		if f.Key != idKey {
+			want = parseValue(f.Value)
+		}
+		switch f.Op {
+		case "":
+			if !matches(v, want) {
+				return false
+			}
+		case "!=":
+			// Unlike other filters, a != filter on an array property only
+			// matches if no element is equal.
+			if matches(v, want) {
+				return false
+			}
+		case "contains":
+			if !containsString(v, f.Value) {
+				return false
+			}
+		default:
+			if !compares(v, f.Op, want) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// idFilter returns the ID an entity must have to satisfy an equality filter on
+// _id, if there is one.
+func idFilter(filters []filter) (string, bool) {
+	for _, f := range filters {
+		if f.Key == idKey && f.Op == "" {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// idRange returns the lowest and highest IDs, if any, that inequality filters
+// on _id allow, so a list can seek to the first and stop after the last
+// instead of reading the whole kind. The filters themselves still have to be
+// checked, since the bounds may be exclusive.
+func idRange(filters []filter) (from, to string) {
+	for _, f := range filters {
+		if f.Key != idKey {
+			continue
+		}
+		switch f.Op {
+		case ">", ">=":
+			if f.Value > from {
+				from = f.Value
+			}
+		case "<", "<=":
+			if to == "" || f.Value < to {
+				to = f.Value
+			}
+		}
+	}
+	return from, to
+}
+
+// matchesOr reports whether an entity matches at least one filter of each
+// group. Since every list scans the whole kind anyway, each entity appears at
+// most once and results keep their usual order.
+func matchesOr(m map[string]interface{}, groups [][]filter) bool {
+	for _, g := range groups {
+		found := false
+		for _, f := range g {
+			if matchesFilters(m, []filter{f}) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// byOrders sorts entities by a list of sortOrders. Entities missing a sort
+// property sort before entities that have it.
+type byOrders struct {
+	items  []map[string]interface{}
+	orders []sortOrder
+}
+
+func (s byOrders) Len() int      { return len(s.items) }
+func (s byOrders) Swap(i, j int) { s.items[i], s.items[j] = s.items[j], s.items[i] }
+func (s byOrders) Less(i, j int) bool {
+	for _, o := range s.orders {
+		a, afound := lookup(s.items[i], o.Field)
+		b, bfound := lookup(s.items[j], o.Field)
+		c := 0
+		switch {
+		case !afound && bfound:
+			c = -1
+		case afound && !bfound:
+			c = 1
+		case afound && bfound:
+			c = compareValues(a, b)
+		}
+		if o.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
+// sortItems sorts entities in place. Entities that compare equal keep their
+// original, ID, order.
+func sortItems(items []map[string]interface{}, orders []sortOrder) {
+	if len(orders) > 0 {
+		sort.Stable(byOrders{items, orders})
+	}
+}
+
+// encodeCursor encodes an offset into the result set of the query with the
+// given signature as an opaque token.
+func encodeCursor(offset int, sig string) string {
+	return base64.URLEncoding.EncodeToString([]byte(strconv.Itoa(offset) + "." + sig))
+}
+
+// decodeCursor decodes a token produced by encodeCursor. The empty token
+// decodes to def. Offsets only make sense in the result set they came from,
+// so tokens from a query with another signature are rejected.
+func decodeCursor(s, sig string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	if len(s) > maxCursorLength {
+		return 0, cursorTooLong
+	}
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return 0, invalidCursor
+	}
+	parts := strings.SplitN(string(b), ".", 2)
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 0 || len(parts) != 2 {
+		return 0, invalidCursor
+	}
+	if parts[1] != sig {
+		return 0, cursorMismatch
+	}
+	return n, nil
+}
+
+// querySignature returns a short hash of what determines a query's result
+// set: its filters and sort. Filters are hashed in a canonical order, since
+// their order doesn't change the results.
+func querySignature(filters []filter, or [][]filter, order string) string {
+	key := func(fs []filter) string {
+		var ks []string
+		for _, f := range fs {
+			ks = append(ks, f.Key+"\x00"+f.Op+"\x00"+f.Value)
+		}
+		sort.Strings(ks)
+		return strings.Join(ks, "\x01")
+	}
+	var groups []string
+	for _, g := range or {
+		groups = append(groups, key(g))
+	}
+	sort.Strings(groups)
+	h := fnv.New32a()
+	io.WriteString(h, key(filters)+"\x02"+strings.Join(groups, "\x02")+"\x02"+order)
+	return strconv.FormatUint(uint64(h.Sum32()), 36)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSort(t *testing.T) {
+	cases := []struct {
+		s        string
+		want     []sortOrder
+		hasError bool
+	}{
+		{"", nil, false},
+		{"foo", []sortOrder{{Field: "foo"}}, false},
+		{"-foo", []sortOrder{{Field: "foo", Desc: true}}, false},
+		{"-address.zip,name", []sortOrder{{Field: "address.zip", Desc: true}, {Field: "name"}}, false},
+
+		{"-", nil, true},
+		{"--foo", nil, true},
+		{"a..b", nil, true},
+		{"a,", nil, true},
+		{"address.-zip", nil, true},
+	}
+	for _, c := range cases {
+		got, err := parseSort(c.s)
+		if c.hasError && err == nil {
+			t.Errorf("parseSort(%q); expected error", c.s)
+		} else if err != nil && !c.hasError {
+			t.Errorf("unexpected error %v", err)
+		} else if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseSort(%q); got %v want %v", c.s, got, c.want)
+		}
+	}
+}
+
+func TestApplyOrder(t *testing.T) {
+	cases := []struct {
+		sort, order, want string
+		hasError          bool
+	}{
+		{"age", "", "age", false},
+		{"age", "asc", "age", false},
+		{"age", "desc", "-age", false},
+		{"-age", "asc", "-age", false},
+		{"-age,name", "desc", "-age,-name", false},
+		{"", "", "", false},
+		{"", "asc", "", false},
+
+		{"", "desc", "", true},
+		{"age", "down", "", true},
+		{"age", "DESC", "", true},
+	}
+	for _, c := range cases {
+		got, err := applyOrder(c.sort, c.order)
+		if c.hasError && err == nil {
+			t.Errorf("applyOrder(%q, %q); expected error", c.sort, c.order)
+		} else if err != nil && !c.hasError {
+			t.Errorf("unexpected error %v", err)
+		} else if got != c.want {
+			t.Errorf("applyOrder(%q, %q); got %q want %q", c.sort, c.order, got, c.want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	m := map[string]interface{}{
+		"a": 1.0,
+		"b": map[string]interface{}{"c": map[string]interface{}{"d": "e"}},
+	}
+	cases := []struct {
+		path  string
+		v     interface{}
+		found bool
+	}{
+		{"a", 1.0, true},
+		{"b.c.d", "e", true},
+		{"b.c.x", nil, false},
+		{"a.b", nil, false},
+		{"x", nil, false},
+	}
+	for _, c := range cases {
+		v, found := lookup(m, c.path)
+		if found != c.found || !reflect.DeepEqual(v, c.v) {
+			t.Errorf("lookup(%q); got %v,%t want %v,%t", c.path, v, found, c.v, c.found)
+		}
+	}
+}
+
+func TestSetPath(t *testing.T) {
+	for _, c := range []struct {
+		path string
+		want map[string]interface{}
+		err  string
+	}{
+		{"a.b", map[string]interface{}{"a": map[string]interface{}{"b": 2.0, "c": 1.0}, "s": "x"}, ""},
+		{"new.b", map[string]interface{}{"a": map[string]interface{}{"c": 1.0}, "new": map[string]interface{}{"b": 2.0}, "s": "x"}, ""},
+		// A field that's a scalar in one place and an object in another is
+		// a conflict, reported rather than resolved by losing data.
+		{"s.b", nil, "can't set s.b: s is not an object"},
+		{"a.c.d", nil, "can't set a.c.d: a.c is not an object"},
+	} {
+		m := map[string]interface{}{"a": map[string]interface{}{"c": 1.0}, "s": "x"}
+		err := setPath(m, c.path, 2.0)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("setPath(%q): got error %v, want %q", c.path, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("setPath(%q): %v", c.path, err)
+		} else if !reflect.DeepEqual(m, c.want) {
+			t.Errorf("setPath(%q): got %v, want %v", c.path, m, c.want)
+		}
+	}
+}
+
+func TestQuerySignature(t *testing.T) {
+	a, b := filter{Key: "a", Value: "1"}, filter{Key: "b", Value: "2"}
+	sig := querySignature([]filter{a, b}, [][]filter{{a, b}, {b}}, "x")
+	if got := querySignature([]filter{b, a}, [][]filter{{b}, {b, a}}, "x"); got != sig {
+		t.Errorf("reordered: got %q, want %q", got, sig)
+	}
+	for _, other := range []string{
+		querySignature([]filter{a}, [][]filter{{a, b}, {b}}, "x"),
+		querySignature([]filter{a, b}, [][]filter{{a, b}}, "x"),
+		querySignature([]filter{a, b}, [][]filter{{a}, {b}}, "x"),
+		querySignature([]filter{a, {Key: "b", Op: "!=", Value: "2"}}, [][]filter{{a, b}, {b}}, "x"),
+		querySignature([]filter{a, b}, [][]filter{{a, b}, {b}}, "-x"),
+	} {
+		if other == sig {
+			t.Errorf("different query has the same signature %q", sig)
+		}
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	cases := []struct {
+		a, b interface{}
+		want int
+	}{
+		{1.0, 2.0, -1},
+		{2.0, 2.0, 0},
+		{"b", "a", 1},
+		{false, true, -1},
+		{nil, false, -1},
+		{true, 0.0, -1},
+		{"1", 1.0, 1},
+	}
+	for _, c := range cases {
+		if got := compareValues(c.a, c.b); got != c.want {
+			t.Errorf("compareValues(%v, %v); got %d want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestMatchesFilters(t *testing.T) {
+	m := map[string]interface{}{
+		"n":    5.0,
+		"s":    "foo",
+		"list": []interface{}{1.0, 10.0},
+		"_id":  "123",
+	}
+	cases := []struct {
+		f    filter
+		want bool
+	}{
+		{filter{Key: "n", Value: "5"}, true},
+		{filter{Key: "n", Value: "6"}, false},
+		{filter{Key: "n", Op: ">", Value: "4"}, true},
+		{filter{Key: "n", Op: ">", Value: "5"}, false},
+		{filter{Key: "n", Op: ">=", Value: "5"}, true},
+		{filter{Key: "n", Op: "<", Value: "5"}, false},
+		{filter{Key: "n", Op: "<=", Value: "5"}, true},
+		{filter{Key: "n", Op: "<", Value: "x"}, false},
+		{filter{Key: "s", Op: ">", Value: "bar"}, true},
+		{filter{Key: "list", Op: ">", Value: "5"}, true},
+		{filter{Key: "list", Op: ">", Value: "10"}, false},
+		{filter{Key: "missing", Op: ">", Value: "0"}, false},
+		{filter{Key: "_id", Value: "123"}, true},
+		{filter{Key: "s", Op: "!=", Value: "foo"}, false},
+		{filter{Key: "s", Op: "!=", Value: "bar"}, true},
+		{filter{Key: "n", Op: "!=", Value: "foo"}, true},
+		{filter{Key: "list", Op: "!=", Value: "10"}, false},
+		{filter{Key: "list", Op: "!=", Value: "5"}, true},
+		{filter{Key: "missing", Op: "!=", Value: "0"}, false},
+		{filter{Key: "_id", Op: ">", Value: "12"}, true},
+	}
+	for _, c := range cases {
+		if got := matchesFilters(m, []filter{c.f}); got != c.want {
+			t.Errorf("matchesFilters(%v); got %t want %t", c.f, got, c.want)
+		}
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want int
+		err  error
+	}{
+		{"", -1, nil},
+		{encodeCursor(0, "sig"), 0, nil},
+		{encodeCursor(123456, "sig"), 123456, nil},
+		{"bogus", 0, invalidCursor},
+		{encodeCursor(-1, "sig"), 0, invalidCursor},
+		{base64.URLEncoding.EncodeToString([]byte("12")), 0, invalidCursor},
+		{encodeCursor(1, "other"), 0, cursorMismatch},
+		{strings.Repeat("A", maxCursorLength+1), 0, cursorTooLong},
+	} {
+		got, err := decodeCursor(c.s, "sig", -1)
+		if got != c.want || err != c.err {
+			t.Errorf("decodeCursor(%q): got %d, %v; want %d, %v", c.s, got, err, c.want, c.err)
+		}
+	}
+}
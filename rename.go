@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// renameID is the path, /<Kind>/_rename, that renames a field of every
+	// entity of a kind.
+	renameID = "_rename"
+
+	// dropFieldID is the path, /<Kind>/_dropField, that removes a field from
+	// every entity of a kind.
+	dropFieldID = "_dropField"
+
+	// rewriteBatchSize is the number of entities read per transaction by a
+	// rename or dropField.
+	rewriteBatchSize = 500
+)
+
+// rename renames a field, which may be a dotted path, of every entity of a
+// kind that has it, and returns the number of entities renamed. The request
+// body is {"from":"oldName","to":"newName"}. An entity that already has both
+// fields gets a 409 Conflict, and is left for the client to fix.
+func (s *Server) rename(kind string, r io.Reader) ([]byte, int) {
+	var req struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return nil, http.StatusBadRequest
+	}
+	if err := checkRename(req.From, req.To); err != nil {
+		return []byte(err.Error()), http.StatusBadRequest
+	}
+	return s.rewrite(kind, "renamed", func(id string, m map[string]interface{}) (bool, error) {
+		v, found := lookup(m, req.From)
+		if !found {
+			return false, nil
+		}
+		if _, found := lookup(m, req.To); found {
+			return false, fmt.Errorf("%s %q already has field %q", idKey, id, req.To)
+		}
+		deletePath(m, req.From)
+		if err := setPath(m, req.To, v); err != nil {
+			return false, fmt.Errorf("%s %q: %v", idKey, id, err)
+		}
+		return true, nil
+	})
+}
+
+// checkRename checks that a field can be renamed from one path to another.
+// Metadata fields can't be renamed, and neither path may contain the other.
+func checkRename(from, to string) error {
+	for _, p := range []string{from, to} {
+		if !validPath(p) || strings.HasPrefix(p, "_") {
+			return fmt.Errorf("invalid field: %q", p)
+		}
+	}
+	if from == to || strings.HasPrefix(to, from+".") || strings.HasPrefix(from, to+".") {
+		return fmt.Errorf("can't rename %s to %s", from, to)
+	}
+	return nil
+}
+
+// dropField removes a field, which may be a dotted path, from every entity of
+// a kind that has it, and returns the number of entities changed. The request
+// body is {"field":"obsolete"}.
+func (s *Server) dropField(kind string, r io.Reader) ([]byte, int) {
+	var req struct {
+		Field string `json:"field"`
+	}
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return nil, http.StatusBadRequest
+	}
+	if !validPath(req.Field) || strings.HasPrefix(req.Field, "_") {
+		return []byte(fmt.Sprintf("invalid field: %q", req.Field)), http.StatusBadRequest
+	}
+	return s.rewrite(kind, "dropped", func(id string, m map[string]interface{}) (bool, error) {
+		if _, found := lookup(m, req.Field); !found {
+			return false, nil
+		}
+		deletePath(m, req.Field)
+		return true, nil
+	})
+}
+
+// rewrite calls fn on every unexpired entity of a kind, and writes back the
+// entities it changes, with a new "_version" and "_updated". The response is
+// the number of entities changed, under the given name. If fn returns an
+// error, or an entity it changes can't be stored, such as when a money field
+// would hold a string, the rewrite stops with a 409 Conflict saying why.
+//
+// Entities are read in batches of rewriteBatchSize, each rewritten in its own
+// transaction, so a large kind doesn't hold the database for long. Since fn
+// leaves alone the entities it's already rewritten, a rewrite that was
+// interrupted, or stopped by a conflict, can simply be sent again, and picks
+// up where it left off. Like imports, rewrites ignore locks.
+func (s *Server) rewrite(kind, name string, fn func(id string, m map[string]interface{}) (bool, error)) ([]byte, int) {
+	n := 0
+	var after []byte
+	for done := false; !done; {
+		code, msg := http.StatusOK, ""
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(kind))
+			if b == nil {
+				code = http.StatusNotFound
+				return nil
+			}
+			cfg, err := s.loadConfig(tx, kind)
+			if err != nil {
+				log.Printf("config: %v", err)
+				return err
+			}
+			var keys, vals [][]byte
+			var olds, ms []map[string]interface{}
+			c := b.Cursor()
+			k, v := c.First()
+			if after != nil {
+				if k, v = c.Seek(after); k != nil && string(k) == string(after) {
+					k, v = c.Next()
+				}
+			}
+			for i := 0; k != nil && i < rewriteBatchSize; k, v = c.Next() {
+				i++
+				after = append(after[:0], k...)
+				m, err := fromJSON(v)
+				if err != nil {
+					log.Printf("json: %v", err)
+					return err
+				}
+				if expired(m) {
+					continue
+				}
+				old, err := fromJSON(v)
+				if err != nil {
+					log.Printf("json: %v", err)
+					return err
+				}
+				// Encrypted and money fields are rewritten as clients see
+				// them, so a field renamed to or from one is encrypted or
+				// not, and in cents or not.
+				cfg.decrypt(m)
+				cfg.decrypt(old)
+				cfg.fromCents(m)
+				cfg.fromCents(old)
+				if changed, err := fn(string(k), m); err != nil {
+					code, msg = http.StatusConflict, err.Error()
+					return nil
+				} else if !changed {
+					continue
+				}
+				if f, changed := cfg.changesImmutable(old, m); changed {
+					code, msg = http.StatusConflict, immutableError(f)
+					return nil
+				}
+				cfg.applyDerived(m)
+				if err := cfg.toCents(m); err != nil {
+					code, msg = http.StatusConflict, fmt.Sprintf("%s %q: %v", idKey, k, err)
+					return nil
+				}
+				m[updatedKey] = nowFunc().Unix()
+				m[versionKey] = version(old) + 1
+				if err := cfg.encrypt(m); err != nil {
+					log.Printf("encrypt: %v", err)
+					return err
+				}
+				out, err := toJSON(m)
+				if err != nil {
+					log.Printf("json: %v", err)
+					return err
+				}
+				if err := s.checkSize(kind, out); err != nil {
+					code, msg = http.StatusRequestEntityTooLarge, err.Error()
+					return nil
+				}
+				// Unique values are claimed as they're stored, with money
+				// fields in cents.
+				if old, err = fromJSON(v); err != nil {
+					log.Printf("json: %v", err)
+					return err
+				}
+				keys, vals = append(keys, append([]byte(nil), k...)), append(vals, out)
+				olds, ms = append(olds, old), append(ms, m)
+			}
+			done = k == nil
+			// Writing while the cursor is open could move it, so the changed
+			// entities are only written once the batch has been read. Each
+			// claims its unique values just before it's written, so entities
+			// of the same batch can't claim the same value.
+			for i, k := range keys {
+				if msg, err = claimUnique(tx, cfg, kind, string(k), olds[i], ms[i]); err != nil {
+					return err
+				} else if msg != "" {
+					code = http.StatusConflict
+					return errRollback
+				}
+				if err := b.Put(k, vals[i]); err != nil {
+					log.Printf("put: %v", err)
+					return err
+				}
+			}
+			n += len(keys)
+			return nil
+		})
+		if err != nil && err != errRollback {
+			return nil, http.StatusInternalServerError
+		}
+		if code != http.StatusOK {
+			return []byte(msg), code
+		}
+	}
+	out, err := toJSON(map[string]interface{}{name: n})
+	if err != nil {
+		log.Printf("json: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	return out, http.StatusOK
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// searchKind is the path, /_search, that queries all of a user's kinds.
+	searchKind = "_search"
+
+	// kindKey is the field search adds to each result, naming its kind. It
+	// is never stored.
+	kindKey = "_kind"
+
+	// maxSearchKinds is the most kinds a search reads, and maxSearchResults
+	// the most results it returns, so a search's cost is bounded however many
+	// kinds and entities a user has.
+	maxSearchKinds   = 100
+	maxSearchResults = 100
+)
+
+// errSearchDone stops a search once it has found enough results.
+var errSearchDone = errors.New("search done")
+
+// search returns {"items":[...]} with the entities of every kind in a
+// namespace that match uq's filters, each with its kind in "_kind", in kind
+// then ID order. Kinds starting with "_", like configuration, and kinds
+// clients may not access are skipped. At most uq.Limit results, and no more
+// than maxSearchResults, are returned, from the first maxSearchKinds kinds.
+func (s *Server) search(ns string, uq userQuery) ([]byte, int) {
+	limit := uq.Limit
+	if limit > maxSearchResults {
+		limit = maxSearchResults
+	}
+	items := []interface{}{}
+	kinds := 0
+	var invalid error
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			bucketNS, kind := splitNamespace(string(name))
+			if bucketNS != ns || strings.HasPrefix(kind, "_") || (s.kinds != nil && !s.kinds[kind]) {
+				return nil
+			}
+			if kinds == maxSearchKinds {
+				return errSearchDone
+			}
+			kinds++
+			cfg, err := s.loadConfig(tx, string(name))
+			if err != nil {
+				log.Printf("config: %v", err)
+				return err
+			}
+			if invalid = cfg.checkQuery(uq); invalid != nil {
+				return errSearchDone
+			}
+			uq := cfg.storedQuery(uq)
+			return b.ForEach(func(k, v []byte) error {
+				if len(items) == limit {
+					return errSearchDone
+				}
+				m, err := fromJSON(v)
+				if err != nil {
+					log.Printf("json: %v", err)
+					return err
+				}
+				if expired(m) || !matchesFilters(m, uq.Filters) || !matchesOr(m, uq.Or) {
+					return nil
+				}
+				cfg.present(m)
+				if uq.ISOTimes {
+					formatTimes(m)
+				}
+				m[kindKey] = kind
+				items = append(items, m)
+				return nil
+			})
+		})
+	})
+	if err != nil && err != errSearchDone {
+		return nil, http.StatusInternalServerError
+	}
+	if invalid != nil {
+		return []byte(invalid.Error()), http.StatusBadRequest
+	}
+	out, err := toJSON(map[string]interface{}{"items": items})
+	if err != nil {
+		log.Printf("json: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	return out, http.StatusOK
+}
@@ -1,7 +1,5 @@
 package main
 
-// TODO: Handle partial update (PATCH)
-// TODO: Add end-to-end tests with net/http/httptest
 // TODO: User POSTs a JSON schema, future requests are validated against that schema.
 //	- user also defines which indices they want on each type
 //	- create/delete indices after data is populated?
@@ -12,12 +10,18 @@ package main
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -30,46 +34,532 @@ const (
 	idKey        = "_id"
 	createdKey   = "_created"
 	updatedKey   = "_updated"
+	ttlKey       = "_ttl"
+	expiresKey   = "_expires"
+	readOnlyKey  = "_readonly"
+	versionKey   = "_version"
 	defaultLimit = 10
+
+	// deleteBatchSize is the number of entities deleted per transaction when
+	// deleting a whole kind.
+	deleteBatchSize = 500
+
+	// kindSep separates a user ID from a kind in the name of the bucket
+	// holding that user's entities of that kind, e.g. "user--Data".
+	kindSep = "--"
+
+	// purgeKind is the path, /_purge, that deletes expired entities.
+	purgeKind = "_purge"
+
+	// recentID is the ID, as in /<Kind>/_recent, that lists the most
+	// recently updated entities of a kind.
+	recentID = "_recent"
 )
 
 var (
+	// metadataKeys are the "_"-prefixed fields the server understands.
+	// Clients may not use any other field names starting with "_".
+	metadataKeys = map[string]bool{
+		idKey:       true,
+		createdKey:  true,
+		updatedKey:  true,
+		ttlKey:      true,
+		expiresKey:  true,
+		readOnlyKey: true,
+		versionKey:  true,
+		parentKey:   true,
+	}
+
 	invalidPath = errors.New("invalid path")
+	invalidTTL  = errors.New("invalid _ttl")
 	nowFunc     = time.Now
 )
 
 type Server struct {
 	db *bolt.DB
+
+	// kinds, if non-nil, is the set of kinds clients may access.
+	kinds map[string]bool
+
+	// maxBody, if positive, is the maximum size in bytes of a request body.
+	maxBody int64
+
+	// maxDepth, if positive, is how deeply objects and arrays may be nested
+	// in an entity.
+	maxDepth int
+
+	// auth, if non-nil, authenticates requests. Each user's kinds are
+	// stored separately, so users only see their own data.
+	auth Authenticator
+
+	// maxEntity, if positive, is the maximum size in bytes of a stored
+	// entity.
+	maxEntity int
+
+	// preflightMaxAge, if positive, is how long browsers may cache the
+	// response to a CORS preflight request.
+	preflightMaxAge time.Duration
+
+	// cache, if non-nil, caches list responses.
+	cache *listCache
+
+	// maxFilters, if positive, is the most where and or conditions a query
+	// may have.
+	maxFilters int
+
+	// debug allows GETs of entities to ask for debugging information about
+	// how they're stored, and lists about how their queries were parsed.
+	// With auth, only admins may ask; see debugAllowed.
+	debug bool
+
+	// admins are the IDs of the users who may use the debugging views when
+	// requests are authenticated.
+	admins map[string]bool
+
+	// fieldCipher, if non-nil, encrypts and decrypts the values of the
+	// fields kinds are configured to encrypt. If it's nil, kinds can't be
+	// configured with encrypted fields.
+	fieldCipher cipher.AEAD
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Access-Control-Allow-Origin", "*")
+	if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+		s.preflight(w, r)
+		return
+	}
 
-	// TODO: user ID namespacing / auth
-
-	kind, id, err := getKindAndID(r.URL.Path)
+	path, action := splitAction(r.URL.Path)
+	parent, kind, id, err := getKindAndID(path)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	// A list of recent entities is just a list sorted by when they were
+	// updated, most recent first, so it's handled as one, and its next page
+	// links and cached responses are those a list would have.
+	if id == recentID && action == "" && (r.Method == "GET" || r.Method == "HEAD") {
+		q := r.URL.Query()
+		if sort := q.Get("sort"); sort != "" && sort != "-"+updatedKey {
+			http.Error(w, "_recent is sorted by -"+updatedKey, http.StatusBadRequest)
+			return
+		}
+		q.Set("sort", "-"+updatedKey)
+		r.URL.RawQuery, r.Form = q.Encode(), nil
+		id = ""
+	}
+	if s.kinds != nil && !s.kinds[kind] {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !validKind(kind) {
+		http.Error(w, invalidPath.Error(), http.StatusBadRequest)
+		return
+	}
+	// Only entities of ordinary kinds have children, and only ordinary
+	// kinds can be children.
+	if parent != "" {
+		parentKind, _, ok := splitParent(parent)
+		if !ok || strings.HasPrefix(kind, "_") {
+			http.Error(w, invalidPath.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.kinds != nil && !s.kinds[parentKind] {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	ns, userID := "", ""
+	if s.auth != nil {
+		userID, err = s.auth.UserID(r)
+		if err == nil && !validUserID(userID) {
+			err = errUnauthorized
+		}
+		switch err {
+		case nil:
+		case errUnauthorized:
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		case errUpstream:
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		case errUpstreamTimeout:
+			http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+			return
+		default:
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		ns = userID + kindSep
+	}
+	bare, kind := kind, ns+kind
+	lt := newLogTags(r.Method, kind, id)
+	setLogTags(w, lt)
+
+	// Read the whole body up front so an oversized one is rejected before
+	// any of it is decoded.
+	if s.maxBody > 0 {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.maxBody))
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	// Besides imports, objects can be created from newline-delimited JSON,
+	// which is taken as a batch.
+	if ndjsonBody(r) && r.Method == "POST" && id == "" && action == "" && !strings.HasPrefix(bare, "_") {
+		body, err := ndjsonArray(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	} else if !jsonBody(r) && !(bare == importKind && ndjsonBody(r)) {
+		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Writes to entities locked with "_readonly" must be forced. Params of
+	// write requests are read from the URL, never the body.
+	force := r.URL.Query().Get("force") == "true"
+
+	// Clients can ask for field names in another case; see keyCases.
+	var keyCase func(string) string
+	if kc := r.URL.Query().Get("keyCase"); kc != "" {
+		var ok bool
+		if keyCase, ok = keyCases[kc]; !ok {
+			http.Error(w, "keyCase must be snake or camel", http.StatusBadRequest)
+			return
+		}
+		if (r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH") && bare != importKind {
+			body, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				lt.printf("readall: %v", err)
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+			// Bodies that aren't objects, or batches of them, are left for
+			// the handler to reject.
+			if m, err := fromJSON(body); err == nil {
+				if body, err = toJSON(convertBody(m, action)); err != nil {
+					lt.printf("json: %v", err)
+					http.Error(w, "", http.StatusInternalServerError)
+					return
+				}
+			} else {
+				var items []interface{}
+				if err := json.Unmarshal(body, &items); err == nil {
+					if body, err = json.Marshal(convertKeys(items, toSnake)); err != nil {
+						lt.printf("json: %v", err)
+						http.Error(w, "", http.StatusInternalServerError)
+						return
+					}
+				}
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+	}
+
+	// Filters are counted before nest adds the parent's, which isn't the
+	// client's to count.
+	if n := countFilters(r); s.maxFilters > 0 && n > s.maxFilters {
+		http.Error(w, fmt.Sprintf("too many filters: got %d, but at most %d are allowed", n, s.maxFilters), http.StatusBadRequest)
+		return
+	}
+
+	// A nested path is the path of the child kind, limited to the parent's
+	// children.
+	if parent != "" && !s.nest(lt, w, r, ns, parent, kind, id, action) {
+		return
+	}
+
+	if r.URL.Query().Get("pretty") == "true" {
+		pw := &prettyWriter{ResponseWriter: w}
+		defer pw.finish()
+		w = pw
+	}
+
+	// Kinds configured as read-only can still be read, and imported into,
+	// but not written to any other way.
+	if r.Method != "GET" && r.Method != "HEAD" && !strings.HasPrefix(bare, "_") {
+		cfg, err := s.config(kind)
+		if err != nil {
+			lt.printf("config: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if cfg.ReadOnly {
+			http.Error(w, bare+" is read-only", http.StatusForbidden)
+			return
+		}
+	}
+
+	// Any write may change lists, so they're invalidated before the
+	// response is sent, whether or not it succeeded.
+	if s.cache != nil && r.Method != "GET" && r.Method != "HEAD" {
+		iw := &invalidatingWriter{ResponseWriter: w, invalidate: func() { s.invalidateLists(ns, bare, id) }}
+		defer iw.once.Do(iw.invalidate)
+		w = iw
+	}
 
 	var b []byte
 	errCode := http.StatusOK
-	if id == "" {
+	contentType := "application/json"
+	// single is set for responses holding a single entity, which clients can
+	// ask to have wrapped like lists are.
+	single := false
+	if action != "" {
+		switch {
+		case action == "_inc" && r.Method == "POST":
+			b, errCode = s.increment(lt, kind, id, r.Body, force)
+			r.Body.Close()
+		case action == "_unlock" && r.Method == "POST":
+			b, errCode = s.unlock(lt, kind, id)
+			if !s.presentResponse(w, kind, &b, errCode, oneEntity) {
+				return
+			}
+		case action == "_inc", action == "_unlock":
+			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+			return
+		default:
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+	} else if bare == purgeKind && id == "" {
+		if r.Method != "POST" {
+			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+			return
+		}
+		b, errCode = s.purge(ns)
+	} else if bare == exportKind && id == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+			return
+		}
+		if code := s.export(w, ns, r.FormValue("after")); code != http.StatusOK {
+			http.Error(w, "", code)
+		}
+		return
+	} else if bare == importKind && id == "" {
+		if r.Method != "POST" {
+			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+			return
+		}
+		mode := r.URL.Query().Get("mode")
+		if mode != "" && mode != "merge" && mode != "replace" {
+			http.Error(w, "mode must be merge or replace", http.StatusBadRequest)
+			return
+		}
+		b, errCode = s.importEntities(ns, r.Body, mode == "merge")
+		r.Body.Close()
+	} else if bare == migrateKind && id == "" {
+		if r.Method != "POST" {
+			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+			return
+		}
+		// Without authentication, there are no accounts to migrate
+		// between.
+		if s.auth == nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		b, errCode = s.migrate(r, ns)
+	} else if bare == uniqueKind {
+		// The unique index is only for the server's own use.
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	} else if bare == kindsKind && id == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+			return
+		}
+		b, errCode = s.listKinds(ns)
+	} else if bare == searchKind && id == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+			return
+		}
+		uq, err := newUserQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, errCode = s.search(ns, *uq)
+	} else if bare == keyKind && id != "" {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+			return
+		}
+		refKind, refID, err := decodeKey(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Keys of other users' entities, or kinds clients may not access,
+		// are forbidden, whether or not the entity exists.
+		refNS, refBare := splitNamespace(refKind)
+		if refNS != ns || (s.kinds != nil && !s.kinds[refBare]) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		// As at /_unique, the unique index's entries aren't there to be read.
+		if refBare == uniqueKind {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		b, errCode = s.get(newLogTags(r.Method, refKind, refID), refKind, refID)
+		if !s.presentResponse(w, refKind, &b, errCode, oneEntity) {
+			return
+		}
+		if !s.formatGet(w, r, &b, errCode, oneEntity) || !s.linkGet(w, r, refBare, &b, errCode, oneEntity) {
+			return
+		}
+		single = true
+	} else if id == eventsID {
+		if r.Method != "GET" {
+			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+			return
+		}
+		// events writes its own response, until the client goes away.
+		if code := s.events(w, r, kind); code != http.StatusOK {
+			http.Error(w, "", code)
+		}
+		return
+	} else if id == statsID {
+		if r.Method != "GET" {
+			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+			return
+		}
+		uq, err := newUserQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var fields []string
+		if f := r.FormValue("fields"); f != "" {
+			fields = strings.Split(f, ",")
+		}
+		b, errCode = s.stats(kind, *uq, fields)
+	} else if id == firstID || id == lastID {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+			return
+		}
+		uq, err := newUserQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, errCode = s.first(kind, *uq, id == lastID)
+		if !s.presentResponse(w, kind, &b, errCode, oneEntity) {
+			return
+		}
+		if !s.formatGet(w, r, &b, errCode, oneEntity) || !s.linkGet(w, r, bare, &b, errCode, oneEntity) {
+			return
+		}
+		single = true
+	} else if id == recentID {
+		http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+		return
+	} else if id == renameID {
+		if r.Method != "POST" {
+			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+			return
+		}
+		b, errCode = s.rename(kind, r.Body)
+		r.Body.Close()
+	} else if id == dropFieldID {
+		if r.Method != "POST" {
+			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+			return
+		}
+		b, errCode = s.dropField(kind, r.Body)
+		r.Body.Close()
+	} else if id == distinctID {
+		if r.Method != "GET" {
+			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
+			return
+		}
+		uq, err := newUserQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, errCode = s.distinct(kind, *uq, r.FormValue("field"))
+	} else if id == "" {
 		switch r.Method {
 		case "POST":
-			b, errCode = s.insert(kind, "", r.Body)
+			body, err := ioutil.ReadAll(r.Body)
 			r.Body.Close()
-		case "GET", "HEAD":
-			uq, err := newUserQuery(r)
 			if err != nil {
-				http.Error(w, "Bad Request", http.StatusBadRequest)
+				lt.printf("readall: %v", err)
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+			if !isBatch(body) {
+				b, errCode = s.insert(lt, kind, "", bytes.NewReader(body), false)
+				if !s.presentResponse(w, kind, &b, errCode, oneEntity) {
+					return
+				}
+				single = true
+				break
+			}
+			b, errCode = s.insertBatch(lt, kind, body, r.URL.Query().Get("atomic") == "true")
+			if errCode == http.StatusMultiStatus {
+				w.Header().Add("Content-Type", contentType)
+				w.WriteHeader(errCode)
+				w.Write(b)
+				return
+			}
+		case "GET", "HEAD":
+			if ids := r.FormValue("ids"); ids != "" {
+				b, errCode = s.getMulti(lt, kind, parent, strings.Split(ids, ","), r.FormValue("omitMissing") == "true")
+				if !s.metaGet(w, r, bare, &b, errCode, entityList) || !s.presentResponse(w, kind, &b, errCode, entityList) {
+					return
+				}
+				if !s.formatGet(w, r, &b, errCode, entityList) || !s.linkGet(w, r, bare, &b, errCode, entityList) {
+					return
+				}
+			} else {
+				uq, err := newUserQuery(r)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if uq.Debug && !s.debugAllowed(userID) {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+				// Expanded kinds are subject to the same rules as the
+				// requested kind, and belong to the same user.
+				for i, e := range uq.Expand {
+					if s.kinds != nil && !s.kinds[e.Kind] {
+						http.Error(w, "Forbidden", http.StatusForbidden)
+						return
+					}
+					if !validKind(e.Kind) {
+						http.Error(w, invalidPath.Error(), http.StatusBadRequest)
+						return
+					}
+					uq.Expand[i].Kind = ns + e.Kind
+				}
+				// list writes its own response as it goes.
+				if code := s.cachedList(lt, w, r, kind, *uq); code != http.StatusOK {
+					http.Error(w, "", code)
+				}
 				return
 			}
-			b, errCode = s.list(kind, *uq)
-			if r.Method == "HEAD" {
-				b = nil
+		case "DELETE":
+			if r.FormValue("confirm") != "true" {
+				http.Error(w, "Deleting a kind requires ?confirm=true", http.StatusBadRequest)
+				return
 			}
+			b, errCode = s.deleteKind(lt, kind)
 		default:
 			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
 			return
@@ -77,82 +567,548 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else {
 		switch r.Method {
 		case "GET", "HEAD":
-			b, errCode = s.get(kind, id)
-			if r.Method == "HEAD" {
-				b = nil
+			b, errCode = s.get(lt, kind, id)
+			if errCode == http.StatusOK && (r.FormValue("where") != "" || r.FormValue("or") != "") {
+				uq, err := newUserQuery(r)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				// Entities that don't match are treated as missing, so
+				// clients can poll for a condition.
+				m, err := fromJSON(b)
+				if err != nil {
+					lt.printf("json: %v", err)
+					http.Error(w, "", http.StatusInternalServerError)
+					return
+				}
+				cfg, err := s.config(kind)
+				if err != nil {
+					lt.printf("config: %v", err)
+					http.Error(w, "", http.StatusInternalServerError)
+					return
+				}
+				if err := cfg.checkQuery(*uq); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if q := cfg.storedQuery(*uq); !matchesFilters(m, q.Filters) || !matchesOr(m, q.Or) {
+					b, errCode = nil, http.StatusNotFound
+				}
+			}
+			// The debugging view shows the entity as stored, so it isn't
+			// formatted like other responses.
+			if r.FormValue("debug") == "true" {
+				if !s.debugAllowed(userID) {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+				if errCode == http.StatusOK {
+					var err error
+					if b, err = debugEntity(b); err != nil {
+						lt.printf("json: %v", err)
+						http.Error(w, "", http.StatusInternalServerError)
+						return
+					}
+				}
+				break
+			}
+			if !s.metaGet(w, r, bare, &b, errCode, oneEntity) || !s.presentResponse(w, kind, &b, errCode, oneEntity) {
+				return
+			}
+			if !s.formatGet(w, r, &b, errCode, oneEntity) || !s.linkGet(w, r, bare, &b, errCode, oneEntity) {
+				return
+			}
+			if errCode == http.StatusOK {
+				w.Header().Set("X-Key", encodeKey(kind, id))
+			}
+			single = true
+			if errCode == http.StatusOK && r.FormValue("format") == jsonAPIFormat {
+				m, err := fromJSON(b)
+				if err == nil {
+					b, err = toJSON(map[string]interface{}{"data": jsonAPIResource(bare, m, false)})
+				}
+				if err != nil {
+					lt.printf("json: %v", err)
+					http.Error(w, "", http.StatusInternalServerError)
+					return
+				}
+				contentType = jsonAPIContentType
+				single = false
 			}
 		case "DELETE":
-			errCode = s.delete2(kind, id)
+			errCode = s.delete2(lt, kind, id, force)
 		case "POST":
-			b, errCode = s.replace(kind, id, r.Body)
+			b, errCode = s.replace(lt, kind, id, r.Body, force)
 			r.Body.Close()
+			if !s.presentResponse(w, kind, &b, errCode, oneEntity) {
+				return
+			}
+			single = true
 		case "PUT":
-			b, errCode = s.insert(kind, id, r.Body)
+			b, errCode = s.insert(lt, kind, id, r.Body, force)
+			r.Body.Close()
+			if !s.presentResponse(w, kind, &b, errCode, oneEntity) {
+				return
+			}
+			single = true
+		case "PATCH":
+			diff := prefers(r, "return=diff")
+			b, errCode = s.patch(lt, kind, id, r.Body, diff, force)
 			r.Body.Close()
+			single = !diff
+			sh := oneEntity
+			if diff {
+				sh = entityDiff
+			}
+			if !s.presentResponse(w, kind, &b, errCode, sh) {
+				return
+			}
 		default:
 			http.Error(w, "Unsupported Method", http.StatusMethodNotAllowed)
 			return
 		}
 	}
+	// On error, b holds an optional message for the client.
 	if errCode != http.StatusOK {
-		http.Error(w, "", errCode)
+		http.Error(w, string(b), errCode)
+		return
+	}
+	if single && len(b) > 0 && r.URL.Query().Get("envelope") == "true" {
+		m, err := fromJSON(b)
+		if err == nil {
+			b, err = toJSON(map[string]interface{}{"item": m})
+		}
+		if err != nil {
+			lt.printf("json: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+	if keyCase != nil && len(b) > 0 {
+		m, err := fromJSON(b)
+		if err == nil {
+			b, err = toJSON(convertKeys(m, keyCase).(map[string]interface{}))
+		}
+		if err != nil {
+			lt.printf("json: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+	// A success with nothing to return, like a DELETE, is 204 No Content,
+	// so it can't be mistaken for an empty object, which is written as {}.
+	if len(b) == 0 {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	w.Header().Add("Content-Type", "application/json")
-	w.Write(b)
+	// Responses written whole give their length, so clients can size them.
+	// HEAD responses give the length of the body they leave out.
+	w.Header().Add("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	if r.Method != "HEAD" {
+		w.Write(b)
+	}
 }
 
-// getKindAndID parses the kind and ID from a request path.
-func getKindAndID(path string) (string, string, error) {
-	if !strings.HasPrefix(path, "/") || path == "/" {
-		return "", "", invalidPath
+// formatGet applies a GET request's timeFormat to the entities in a
+// successful response b. If the request is invalid or formatting fails, it
+// sends an error and returns false.
+func (s *Server) formatGet(w http.ResponseWriter, r *http.Request, b *[]byte, code int, sh shape) bool {
+	iso, err := isoTimes(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
 	}
-	parts := strings.Split(path[1:], "/")
-	if len(parts) > 2 {
-		return "", "", invalidPath
-	} else if len(parts) == 1 {
-		return parts[0], "", nil
-	} else if len(parts) == 2 {
-		return parts[0], parts[1], nil
+	if !iso || code != http.StatusOK {
+		return true
 	}
-	return "", "", invalidPath
+	if *b, err = eachEntity(*b, sh, formatTimes); err != nil {
+		log.Printf("json: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return false
+	}
+	return true
 }
 
-type filter struct {
-	Key, Value string
-}
-type userQuery struct {
-	Limit                        int
-	StartCursor, EndCursor, Sort string
-	Filters                      []filter
+// metaGet applies a GET request's metaOnly param to the entities in a
+// successful response b. If that fails, it sends an error and returns false.
+func (s *Server) metaGet(w http.ResponseWriter, r *http.Request, bare string, b *[]byte, code int, sh shape) bool {
+	if r.FormValue("metaOnly") != "true" || code != http.StatusOK {
+		return true
+	}
+	var err error
+	if *b, err = eachEntity(*b, sh, func(m map[string]interface{}) { keepMeta(m, bare) }); err != nil {
+		log.Printf("json: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return false
+	}
+	return true
 }
 
-func newUserQuery(r *http.Request) (*userQuery, error) {
-	uq := userQuery{
-		StartCursor: r.FormValue("start"),
-		EndCursor:   r.FormValue("end"),
-		Sort:        r.FormValue("sort"),
-		Limit:       defaultLimit,
+// linkGet adds links to the entities in a successful response b, if a GET
+// request asks for them with links=true. If that fails, it sends an error and
+// returns false.
+func (s *Server) linkGet(w http.ResponseWriter, r *http.Request, bare string, b *[]byte, code int, sh shape) bool {
+	if r.FormValue("links") != "true" || code != http.StatusOK {
+		return true
 	}
-	if r.FormValue("limit") != "" {
-		lim, err := strconv.Atoi(r.FormValue("limit"))
-		if err != nil {
-			return nil, err
+	var err error
+	if *b, err = eachEntity(*b, sh, func(m map[string]interface{}) { addLinks(m, bare) }); err != nil {
+		log.Printf("json: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// keepMeta removes all but the metadata a client needs to tell whether an
+// entity has changed from m, an entity of the given kind, and adds its kind.
+func keepMeta(m map[string]interface{}, bare string) {
+	for k := range m {
+		if k != idKey && k != createdKey && k != updatedKey {
+			delete(m, k)
 		}
-		uq.Limit = lim
 	}
+	m[kindKey] = bare
+}
 
-	for _, f := range map[string][]string(r.Form)["where"] {
+// config loads the configuration for a kind in its own transaction.
+func (s *Server) config(kind string) (*kindConfig, error) {
+	var cfg *kindConfig
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		cfg, err = s.loadConfig(tx, kind)
+		return err
+	})
+	return cfg, err
+}
+
+// presentResponse prepares the entities in a successful response b, of the
+// given shape, to be returned, as present does. If that fails, it sends an
+// error and returns false.
+func (s *Server) presentResponse(w http.ResponseWriter, kind string, b *[]byte, code int, sh shape) bool {
+	if code != http.StatusOK || len(*b) == 0 {
+		return true
+	}
+	cfg, err := s.config(kind)
+	if err == nil && !cfg.asStored() {
+		*b, err = eachEntity(*b, sh, cfg.present)
+	}
+	if err != nil {
+		log.Printf("present: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// preflight responds to a CORS preflight request, allowing browsers to send
+// requests with any method and the headers they asked for. Preflights are
+// answered before authentication, since browsers send them without
+// credentials.
+func (s *Server) preflight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE")
+	if h := r.Header.Get("Access-Control-Request-Headers"); h != "" {
+		w.Header().Set("Access-Control-Allow-Headers", h)
+	}
+	if s.preflightMaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(s.preflightMaxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// countFilters returns the number of conditions in a request's where, or and
+// contains params. Each costs a comparison per entity read, so their number is
+// limited.
+func countFilters(r *http.Request) int {
+	q := r.URL.Query()
+	n := len(q["where"]) + len(q["contains"])
+	for _, o := range q["or"] {
+		n += len(strings.Split(o, ";"))
+	}
+	return n
+}
+
+// getKindAndID parses the kind and ID from a request path. The path may be
+// nested under a parent entity, as /<ParentKind>/<parentID>/<Kind>[/<id>], in
+// which case the parent's key, "<ParentKind>/<parentID>", is returned too.
+func getKindAndID(path string) (parent, kind, id string, err error) {
+	if !strings.HasPrefix(path, "/") || path == "/" {
+		return "", "", "", invalidPath
+	}
+	parts := strings.Split(path[1:], "/")
+	if len(parts) > 2 {
+		if len(parts) > 4 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return "", "", "", invalidPath
+		}
+		parent, parts = parts[0]+"/"+parts[1], parts[2:]
+		// Parents are found with a where filter, whose values can't hold
+		// an "=".
+		if strings.Contains(parent, "=") {
+			return "", "", "", invalidPath
+		}
+	}
+	if len(parts) == 1 {
+		return parent, parts[0], "", nil
+	}
+	return parent, parts[0], parts[1], nil
+}
+
+// jsonBody reports whether a request's body, if any, can be decoded as JSON.
+// Write requests must have a JSON Content-Type, unless the client overrides
+// it with a "format" param.
+func jsonBody(r *http.Request) bool {
+	if r.ContentLength == 0 || r.URL.Query().Get("format") != "" {
+		return true
+	}
+	if r.Method != "POST" && r.Method != "PUT" && r.Method != "PATCH" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mt == "application/json" || (strings.HasPrefix(mt, "application/") && strings.HasSuffix(mt, "+json"))
+}
+
+// validUserID reports whether an authenticated user ID can be used to
+// namespace kinds: it must be non-empty, not contain the separator, and not
+// end with "-", so that namespaced kind names are unambiguous. Otherwise user
+// "a-" with kind "Data" and user "a" with kind "-Data" would share a bucket.
+func validUserID(userID string) bool {
+	return userID != "" && !strings.Contains(userID, kindSep) && !strings.HasSuffix(userID, "-")
+}
+
+// validKind reports whether a kind can be namespaced unambiguously: it must
+// not contain the separator, or start with "-". Together with validUserID,
+// this means the first separator in a bucket's name always ends its user ID.
+func validKind(kind string) bool {
+	return !strings.Contains(kind, kindSep) && !strings.HasPrefix(kind, "-")
+}
+
+// splitNamespace splits a namespaced kind like "user--Data" into its
+// namespace, "user--", and bare kind, "Data". Kinds of unauthenticated
+// servers have no namespace. Since kinds can't start with "-", any more "-"s
+// after the separator belong to the namespace: "a---Data" is user "a-"'s
+// kind "Data", which is the only way such a name could be written now.
+func splitNamespace(kind string) (string, string) {
+	i := strings.Index(kind, kindSep)
+	if i < 0 {
+		return "", kind
+	}
+	i += len(kindSep)
+	for i < len(kind) && kind[i] == '-' {
+		i++
+	}
+	return kind[:i], kind[i:]
+}
+
+// splitAction splits a trailing action segment from a request path, e.g.
+// "/Kind/id/_inc" becomes "/Kind/id" and "_inc", as does a path nested under
+// a parent, like "/People/123/Kind/id/_inc". Paths without an action are
+// returned unchanged.
+func splitAction(path string) (string, string) {
+	i := strings.LastIndex(path, "/")
+	if n := strings.Count(path, "/"); (n != 3 && n != 5) || !strings.HasPrefix(path[i+1:], "_") {
+		return path, ""
+	}
+	return path[:i], path[i+1:]
+}
+
+type filter struct {
+	Key, Value string
+
+	// Op is the comparison, one of "", meaning equality, "!=", "<", "<=",
+	// ">", ">=" or "contains", meaning the value is a substring.
+	Op string
+}
+type userQuery struct {
+	Limit                        int
+	StartCursor, EndCursor, Sort string
+	Filters                      []filter
+
+	// Or holds groups of filters from "or" params; an entity must match at
+	// least one filter of each group.
+	Or [][]filter
+
+	// KeysOnly means only the IDs of matching entities are returned.
+	KeysOnly bool
+
+	// Expand lists references to inline in each returned entity.
+	Expand []expansion
+
+	// JSONAPI means results are returned in JSON:API's envelope.
+	JSONAPI bool
+
+	// KeyCase, if non-nil, converts the field names of results, from a
+	// keyCase param.
+	KeyCase func(string) string
+
+	// ISOTimes means timestamps are returned as ISO 8601 strings.
+	ISOTimes bool
+
+	// MetaOnly means only the metadata of matching entities is returned;
+	// see keepMeta.
+	MetaOnly bool
+
+	// Links means entities, and the list, are returned with links to
+	// themselves; see linksKey.
+	Links bool
+
+	// Debug means the list is returned with how its params were
+	// interpreted; see queryKey.
+	Debug bool
+}
+
+// expansion is a reference from one entity to another, given in an expand
+// param as "<Field>:<Kind>". Field holds the ID of an entity of Kind, which is
+// inlined as Field without its "Id" suffix, e.g. authorId:authors is inlined
+// as author.
+type expansion struct {
+	Field, Kind string
+}
+
+// name returns the field a referenced entity is inlined as.
+func (e expansion) name() string {
+	return strings.TrimSuffix(e.Field, "Id")
+}
+
+func newUserQuery(r *http.Request) (*userQuery, error) {
+	uq := userQuery{
+		StartCursor: r.FormValue("start"),
+		EndCursor:   r.FormValue("end"),
+		Sort:        r.FormValue("sort"),
+		Limit:       defaultLimit,
+		// Bolt reads the whole entity to find its key and check filters, so
+		// there's nothing to save by hydrating keys in a separate batch: with
+		// hydrate, a keys-only list is just a list.
+		KeysOnly: r.FormValue("keysOnly") == "true" && r.FormValue("hydrate") != "true",
+		JSONAPI:  r.FormValue("format") == jsonAPIFormat,
+		MetaOnly: r.FormValue("metaOnly") == "true",
+		Links:    r.FormValue("links") == "true",
+		Debug:    r.FormValue("debug") == "true",
+	}
+	sort, err := applyOrder(uq.Sort, r.FormValue("order"))
+	if err != nil {
+		return nil, err
+	}
+	uq.Sort = sort
+	// The default limit only applies if limit isn't given at all; limit=0
+	// asks for no results.
+	if r.FormValue("limit") != "" {
+		lim, err := strconv.Atoi(r.FormValue("limit"))
+		if err != nil {
+			return nil, err
+		}
+		if lim < 0 {
+			return nil, errors.New("invalid limit: " + r.FormValue("limit"))
+		}
+		uq.Limit = lim
+	}
+
+	for _, f := range map[string][]string(r.Form)["where"] {
 		parts := strings.Split(f, "=")
 		if len(parts) != 2 {
 			return nil, errors.New("invalid where: " + f)
 		}
-		uq.Filters = append(uq.Filters, filter{Key: parts[0], Value: parts[1]})
+		fl := filter{Key: parts[0], Value: parts[1]}
+		if strings.HasSuffix(fl.Key, "!") {
+			fl.Key, fl.Op = strings.TrimSuffix(fl.Key, "!"), "!="
+		}
+		uq.Filters = append(uq.Filters, fl)
+	}
+	for _, o := range map[string][]string(r.Form)["or"] {
+		var group []filter
+		for _, f := range strings.Split(o, ";") {
+			parts := strings.Split(f, "=")
+			if len(parts) != 2 {
+				return nil, errors.New("invalid or: " + o)
+			}
+			group = append(group, filter{Key: parts[0], Value: parts[1]})
+		}
+		uq.Or = append(uq.Or, group)
+	}
+	for _, c := range map[string][]string(r.Form)["contains"] {
+		i := strings.Index(c, ":")
+		if i < 0 || !validPath(c[:i]) || i == len(c)-1 {
+			return nil, errors.New("invalid contains: " + c)
+		}
+		uq.Filters = append(uq.Filters, filter{Key: c[:i], Op: "contains", Value: c[i+1:]})
+	}
+	if since := r.FormValue("updatedSince"); since != "" {
+		if _, err := strconv.ParseInt(since, 10, 64); err != nil {
+			return nil, errors.New("invalid updatedSince: " + since)
+		}
+		uq.Filters = append(uq.Filters, filter{Key: updatedKey, Op: ">", Value: since})
+	}
+	for _, p := range []struct{ name, op string }{{"createdAfter", ">"}, {"createdBefore", "<"}} {
+		if v := r.FormValue(p.name); v != "" {
+			t, err := parseTime(v)
+			if err != nil {
+				return nil, errors.New("invalid " + p.name + ": " + v)
+			}
+			uq.Filters = append(uq.Filters, filter{Key: createdKey, Op: p.op, Value: strconv.FormatInt(t, 10)})
+		}
+	}
+	if v := r.FormValue("idFrom"); v != "" {
+		uq.Filters = append(uq.Filters, filter{Key: idKey, Op: ">=", Value: v})
+	}
+	if v := r.FormValue("idTo"); v != "" {
+		uq.Filters = append(uq.Filters, filter{Key: idKey, Op: "<", Value: v})
+	}
+	if expand := r.FormValue("expand"); expand != "" {
+		for _, e := range strings.Split(expand, ",") {
+			parts := strings.Split(e, ":")
+			if len(parts) != 2 || !strings.HasSuffix(parts[0], "Id") || parts[0] == "Id" || parts[1] == "" {
+				return nil, errors.New("invalid expand: " + e)
+			}
+			uq.Expand = append(uq.Expand, expansion{Field: parts[0], Kind: parts[1]})
+		}
+	}
+	if _, err := parseSort(uq.Sort); err != nil {
+		return nil, err
+	}
+	if len(uq.StartCursor) > maxCursorLength || len(uq.EndCursor) > maxCursorLength {
+		return nil, cursorTooLong
+	}
+	iso, err := isoTimes(r)
+	if err != nil {
+		return nil, err
+	}
+	uq.ISOTimes = iso
+	// With a keyCase, fields are named as clients see them, and converted
+	// to the snake_case they're stored with.
+	if kc := r.FormValue("keyCase"); kc != "" {
+		var ok bool
+		if uq.KeyCase, ok = keyCases[kc]; !ok {
+			return nil, errors.New("invalid keyCase: " + kc)
+		}
+		for i, f := range uq.Filters {
+			uq.Filters[i].Key = convertPath(f.Key, toSnake)
+		}
+		for _, g := range uq.Or {
+			for i, f := range g {
+				g[i].Key = convertPath(f.Key, toSnake)
+			}
+		}
+		if uq.Sort != "" {
+			orders, _ := parseSort(uq.Sort)
+			var fields []string
+			for _, o := range orders {
+				f := convertPath(o.Field, toSnake)
+				if o.Desc {
+					f = "-" + f
+				}
+				fields = append(fields, f)
+			}
+			uq.Sort = strings.Join(fields, ",")
+		}
 	}
 	return &uq, nil
 }
 
-func (s *Server) delete2(kind, id string) int {
+func (s *Server) delete2(lt logTags, kind, id string, force bool) int {
 	code := http.StatusOK
 	err := s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(kind))
@@ -160,9 +1116,609 @@ func (s *Server) delete2(kind, id string) int {
 			code = http.StatusNotFound
 			return nil
 		}
-		if err := b.Delete([]byte(id)); err != nil {
-			log.Printf("delete: %v", err)
-			return err
+		if v := b.Get([]byte(id)); v != nil && !force {
+			m, err := fromJSON(v)
+			if err != nil {
+				lt.printf("json: %v", err)
+				return err
+			}
+			if readOnly(m) {
+				code = http.StatusConflict
+				return nil
+			}
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			lt.printf("delete: %v", err)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	return code
+}
+
+// deleteKind deletes every entity of a kind, then the kind itself, and
+// returns the number of entities deleted. Entities are deleted in batches of
+// deleteBatchSize, each in its own transaction, so other requests aren't
+// blocked for the duration.
+func (s *Server) deleteKind(lt logTags, kind string) ([]byte, int) {
+	n := 0
+	for {
+		found, more := true, false
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(kind))
+			if b == nil {
+				found = false
+				return nil
+			}
+			var keys [][]byte
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil && len(keys) < deleteBatchSize; k, _ = c.Next() {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			if len(keys) == 0 {
+				return tx.DeleteBucket([]byte(kind))
+			}
+			for _, k := range keys {
+				if err := b.Delete(k); err != nil {
+					lt.printf("delete: %v", err)
+					return err
+				}
+			}
+			n += len(keys)
+			more = true
+			return nil
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError
+		}
+		if !found {
+			if n == 0 {
+				return nil, http.StatusNotFound
+			}
+			break
+		}
+		if !more {
+			break
+		}
+	}
+	out, err := toJSON(map[string]interface{}{"deleted": n})
+	if err != nil {
+		lt.printf("json: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	return out, http.StatusOK
+}
+
+func (s *Server) get(lt logTags, kind, id string) (out []byte, code int) {
+	code = http.StatusOK
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(kind))
+		if b == nil {
+			code = http.StatusNotFound
+			return nil
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			code = http.StatusNotFound
+			return nil
+		}
+		m, err := fromJSON(v)
+		if err != nil {
+			lt.printf("json: %v", err)
+			return err
+		}
+		if expired(m) {
+			code = http.StatusNotFound
+			return nil
+		}
+		// Values returned by bolt are only valid for the life of the transaction.
+		out = append([]byte(nil), v...)
+		return nil
+	})
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+	return
+}
+
+// getMulti gets several entities by ID in a single transaction, returning
+// them as {"items":[...]} in the order requested. Missing entities are null,
+// or left out if omitMissing is true. If parent is given, as for a nested path,
+// entities that aren't its children count as missing.
+func (s *Server) getMulti(lt logTags, kind, parent string, ids []string, omitMissing bool) ([]byte, int) {
+	items := []interface{}{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(kind))
+		for _, id := range ids {
+			var v []byte
+			if b != nil {
+				v = b.Get([]byte(id))
+			}
+			var m map[string]interface{}
+			if v != nil {
+				var err error
+				if m, err = fromJSON(v); err != nil {
+					lt.printf("json: %v", err)
+					return err
+				}
+				if expired(m) || (parent != "" && m[parentKey] != parent) {
+					m = nil
+				}
+			}
+			if m == nil && omitMissing {
+				continue
+			}
+			items = append(items, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+	out, err := toJSON(map[string]interface{}{"items": items})
+	if err != nil {
+		lt.printf("json: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	return out, http.StatusOK
+}
+
+func (s *Server) insert(lt logTags, kind, id string, r io.Reader, force bool) (out []byte, code int) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		lt.printf("readall: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		out, code, err = s.insertTx(lt, tx, kind, id, body, force)
+		return err
+	})
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+	return
+}
+
+// givenID returns the "_id" given in the body of a new entity, or "" if there
+// isn't one. IDs are strings, but whole numbers are accepted too, and used as
+// their decimal string, however large. IDs must be valid; see validID.
+func givenID(body []byte) (string, error) {
+	var req struct {
+		ID interface{} `json:"_id"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil || req.ID == nil {
+		// An invalid body is rejected with the rest of the entity.
+		return "", nil
+	}
+	var id string
+	switch v := req.ID.(type) {
+	case string:
+		id = v
+	case json.Number:
+		if strings.Trim(v.String(), "0123456789") == "" {
+			id = v.String()
+		}
+	}
+	if !validID(id) {
+		return "", fmt.Errorf("invalid %s: %v", idKey, req.ID)
+	}
+	return id, nil
+}
+
+// validID reports whether an entity can be stored with an ID, and addressed
+// by its path: it must be non-empty, not contain "/", and not start with "_".
+func validID(id string) bool {
+	return id != "" && !strings.Contains(id, "/") && !strings.HasPrefix(id, "_")
+}
+
+// insertTx stores the entity encoded in body in tx with the given ID, or a new
+// one if id is empty. Like the other helpers, it returns the stored entity or
+// an error message and status for the client; a non-nil error means the
+// transaction must be abandoned. Nothing is written unless the status is OK.
+func (s *Server) insertTx(lt logTags, tx *bolt.Tx, kind, id string, body []byte, force bool) ([]byte, int, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte(kind))
+	if err != nil {
+		lt.printf("create bucket: %v", err)
+		return nil, 0, err
+	}
+	// A new entity can be given its ID by the client, e.g. so an offline
+	// client can retry a create safely, but it can't overwrite another.
+	if id == "" {
+		cid, err := givenID(body)
+		if err != nil {
+			return []byte(err.Error()), http.StatusBadRequest, nil
+		}
+		if v := b.Get([]byte(cid)); cid != "" && v != nil {
+			m, err := fromJSON(v)
+			if err != nil {
+				lt.printf("json: %v", err)
+				return nil, 0, err
+			}
+			if !expired(m) {
+				return []byte(fmt.Sprintf("object %q already exists", cid)), http.StatusConflict, nil
+			}
+		}
+		id = cid
+	}
+	// An entity that doesn't exist yet is at version 0.
+	var old map[string]interface{}
+	var current int64
+	if v := b.Get([]byte(id)); id != "" && v != nil {
+		old, err = fromJSON(v)
+		if err != nil {
+			lt.printf("json: %v", err)
+			return nil, 0, err
+		}
+		if readOnly(old) && !force {
+			return nil, http.StatusConflict, nil
+		}
+		current = version(old)
+	}
+	if id == "" {
+		for {
+			u, err := uuid.NewV4()
+			if err != nil {
+				lt.printf("uuid: %v", err)
+				return nil, 0, err
+			}
+			k := u.String()
+			if conflict := b.Get([]byte(k)); conflict == nil {
+				id = k
+				break
+			}
+		}
+	}
+	if isConfigKind(kind) {
+		if err := s.checkConfig(body); err != nil {
+			return []byte(err.Error()), http.StatusBadRequest, nil
+		}
+	}
+	m, err := fromJSON(body)
+	if err != nil || m == nil {
+		return []byte(notObject(err)), http.StatusBadRequest, nil
+	}
+	if err := checkKind(m, kind); err != nil {
+		return []byte(err.Error()), http.StatusConflict, nil
+	}
+	if old != nil && !expired(old) {
+		if err := keepParent(old, m); err != nil {
+			return []byte(err.Error()), http.StatusConflict, nil
+		}
+	} else if msg, err := checkParent(tx, kind, m); err != nil {
+		lt.printf("json: %v", err)
+		return nil, 0, err
+	} else if msg != "" {
+		return []byte(msg), http.StatusBadRequest, nil
+	}
+	if err := s.checkEntity(m); err != nil {
+		return []byte(err.Error()), http.StatusBadRequest, nil
+	}
+	if !checkVersion(m, current) {
+		return nil, http.StatusConflict, nil
+	}
+	cfg, err := s.loadConfig(tx, kind)
+	if err != nil {
+		lt.printf("config: %v", err)
+		return nil, 0, err
+	}
+	cfg.applyDefaults(m)
+	// Derived fields are computed from money fields as decimals.
+	cfg.applyDerived(m)
+	if err := cfg.toCents(m); err != nil {
+		return []byte(err.Error()), http.StatusBadRequest, nil
+	}
+	cfg.decrypt(old)
+	if f, changed := cfg.changesImmutable(old, m); changed && old != nil {
+		return []byte(immutableError(f)), http.StatusConflict, nil
+	}
+	if err := applyTTL(m); err != nil {
+		return nil, http.StatusBadRequest, nil
+	}
+	m[idKey] = id
+	now := nowFunc().Unix()
+	m[createdKey] = now
+	m[updatedKey] = now
+	m[versionKey] = current + 1
+	if err := cfg.encrypt(m); err != nil {
+		lt.printf("encrypt: %v", err)
+		return nil, 0, err
+	}
+	out, err := toJSON(m)
+	if err != nil {
+		lt.printf("json: %v", err)
+		return nil, 0, err
+	}
+	if err := s.checkSize(kind, out); err != nil {
+		return []byte(err.Error()), http.StatusRequestEntityTooLarge, nil
+	}
+	if msg, err := claimUnique(tx, cfg, kind, id, old, m); err != nil {
+		return nil, 0, err
+	} else if msg != "" {
+		return []byte(msg), http.StatusConflict, nil
+	}
+	if err := b.Put([]byte(id), out); err != nil {
+		lt.printf("put: %v", err)
+		return nil, 0, err
+	}
+	return out, http.StatusOK, nil
+}
+
+// list queries entities of a kind and writes them to w as
+// {"items":[...],"nextStartToken":...}. Each entity is encoded and written as
+// it's read, so memory use doesn't grow with the number of results -- unless
+// they must be sorted, in which case every match is loaded first.
+//
+// If list fails before writing anything it returns an error status for the
+// caller to send. Once results are being written the status has been sent, so
+// failures after that point are only logged, and the response is truncated.
+func (s *Server) list(lt logTags, w http.ResponseWriter, r *http.Request, kind string, uq userQuery) int {
+	orders, err := parseSort(uq.Sort)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	sig := querySignature(uq.Filters, uq.Or, uq.Sort)
+	start, err := decodeCursor(uq.StartCursor, sig, 0)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	end, err := decodeCursor(uq.EndCursor, sig, -1)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	// Results are written up to the index stop.
+	stop := start + uq.Limit
+	if end >= 0 && end < stop {
+		stop = end
+	}
+	var body io.Writer = w
+	if r.Method == "HEAD" {
+		body = ioutil.Discard
+	}
+
+	code := http.StatusOK
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(kind))
+		if b == nil {
+			code = http.StatusNotFound
+			return nil
+		}
+		cfg, err := s.loadConfig(tx, kind)
+		if err != nil {
+			lt.printf("config: %v", err)
+			return err
+		}
+		if err := cfg.checkQuery(uq); err != nil {
+			code = http.StatusBadRequest
+			return nil
+		}
+		if uq.Sort == "" {
+			orders, _ = parseSort(cfg.Sort)
+		}
+		// The query is echoed as the client gave it, not as it's stored.
+		dq := newDebugQuery(uq, orders, start)
+		uq := cfg.storedQuery(uq)
+
+		// each calls fn with each matching entity, in order, until fn
+		// returns false. It notes when the soonest to expire of them does,
+		// since the response is only valid until then.
+		var soonest int64
+		each := func(fn func(m map[string]interface{}) bool) error {
+			c := b.Cursor()
+			k, v := c.First()
+			next := c.Next
+			// Entities are keyed by ID, in order, so a range of IDs can be
+			// read without reading the rest of the kind.
+			from, to := idRange(uq.Filters)
+			if from != "" {
+				k, v = c.Seek([]byte(from))
+			}
+			// With an _id filter only one entity can match, and it can be
+			// looked up directly.
+			if id, ok := idFilter(uq.Filters); ok {
+				k, v = c.Seek([]byte(id))
+				if k != nil && string(k) != id {
+					k = nil
+				}
+				next = func() ([]byte, []byte) { return nil, nil }
+			}
+			for ; k != nil && (to == "" || string(k) <= to); k, v = next() {
+				m, err := fromJSON(v)
+				if err != nil {
+					lt.printf("json: %v", err)
+					return err
+				}
+				if expired(m) || !matchesFilters(m, uq.Filters) || !matchesOr(m, uq.Or) {
+					continue
+				}
+				if exp, ok := m[expiresKey].(float64); ok && (soonest == 0 || int64(exp) < soonest) {
+					soonest = int64(exp)
+				}
+				if !fn(m) {
+					return nil
+				}
+			}
+			return nil
+		}
+		// A HEAD response has no items, so there's no need to sort them.
+		if len(orders) > 0 && r.Method != "HEAD" {
+			items := []map[string]interface{}{}
+			if err := each(func(m map[string]interface{}) bool {
+				items = append(items, m)
+				return true
+			}); err != nil {
+				return err
+			}
+			sortItems(items, orders)
+			each = func(fn func(m map[string]interface{}) bool) error {
+				for _, m := range items {
+					if !fn(m) {
+						return nil
+					}
+				}
+				return nil
+			}
+		}
+
+		// HEAD requests get the total number of matches, regardless of
+		// paging, so clients can size a result set without fetching it.
+		if r.Method == "HEAD" {
+			n := 0
+			if err := each(func(m map[string]interface{}) bool {
+				n++
+				return true
+			}); err != nil {
+				return err
+			}
+			w.Header().Set("X-Total-Count", strconv.Itoa(n))
+		}
+
+		// There's a next page if there's a match at index stop, before end.
+		// An empty page, as with limit=0, has none, since it would start
+		// where this one does, and a client following it would never stop.
+		// The ETag of a page is a hash of the query and the version of
+		// each entity on it, so it changes whenever the page would.
+		next := ""
+		h := fnv.New64a()
+		io.WriteString(h, r.URL.RawQuery)
+		i := 0
+		if err := each(func(m map[string]interface{}) bool {
+			if i == stop {
+				if stop > start && (end < 0 || stop < end) {
+					next = encodeCursor(stop, sig)
+				}
+				return false
+			}
+			if i >= start {
+				fmt.Fprintf(h, "\x00%v\x00%v\x00%v", m[idKey], m[versionKey], m[updatedKey])
+			}
+			i++
+			return true
+		}); err != nil {
+			return err
+		}
+		io.WriteString(h, next)
+		if r.Method == "GET" {
+			etag := fmt.Sprintf(`W/"%x"`, h.Sum64())
+			w.Header().Set("ETag", etag)
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return nil
+			}
+		}
+
+		_, bare := splitNamespace(kind)
+		if uq.JSONAPI {
+			w.Header().Add("Content-Type", jsonAPIContentType)
+			io.WriteString(body, `{"data":[`)
+		} else {
+			w.Header().Add("Content-Type", "application/json")
+			io.WriteString(body, `{"items":[`)
+		}
+		if next != "" {
+			w.Header().Add("Link", "<"+nextURL(r, next)+`>; rel="next"`)
+		}
+		i, n := 0, 0
+		var werr error
+		if err := each(func(m map[string]interface{}) bool {
+			if i >= stop {
+				return false
+			}
+			if i++; i <= start {
+				return true
+			}
+			if uq.MetaOnly {
+				keepMeta(m, bare)
+			} else if !uq.KeysOnly {
+				if werr = s.expandRefs(tx, m, uq.Expand); werr != nil {
+					return false
+				}
+			}
+			cfg.present(m)
+			if uq.ISOTimes {
+				formatTimes(m)
+			}
+			if uq.KeyCase != nil {
+				m = convertKeys(m, uq.KeyCase).(map[string]interface{})
+			}
+			// JSON:API resources have links of their own.
+			if uq.Links && !uq.JSONAPI {
+				addLinks(m, bare)
+			}
+			var v interface{} = m
+			switch {
+			case uq.JSONAPI:
+				v = jsonAPIResource(bare, m, uq.KeysOnly)
+			case uq.KeysOnly:
+				v = m[idKey]
+			}
+			out, err := json.Marshal(v)
+			if err != nil {
+				werr = err
+				return false
+			}
+			if n > 0 {
+				io.WriteString(body, ",")
+			}
+			if _, werr = body.Write(out); werr != nil {
+				return false
+			}
+			n++
+			return true
+		}); err != nil {
+			werr = err
+		}
+		if werr != nil {
+			lt.printf("list: %v", werr)
+			return nil
+		}
+		io.WriteString(body, "]")
+		switch {
+		case uq.JSONAPI && (next != "" || uq.Debug):
+			// JSON:API documents keep anything else in their meta.
+			meta := map[string]interface{}{}
+			if next != "" {
+				meta["nextStartToken"] = next
+			}
+			if uq.Debug {
+				meta[queryKey] = dq
+			}
+			out, err := json.Marshal(meta)
+			if err != nil {
+				lt.printf("json: %v", err)
+				return nil
+			}
+			io.WriteString(body, `,"meta":`)
+			body.Write(out)
+		case next != "":
+			io.WriteString(body, `,"nextStartToken":"`+next+`"`)
+		}
+		if uq.Links && !uq.JSONAPI {
+			out, err := json.Marshal(listLinks(r, next))
+			if err != nil {
+				lt.printf("json: %v", err)
+				return nil
+			}
+			io.WriteString(body, `,"`+linksKey+`":`)
+			body.Write(out)
+		}
+		if uq.Debug && !uq.JSONAPI {
+			out, err := json.Marshal(dq)
+			if err != nil {
+				lt.printf("json: %v", err)
+				return nil
+			}
+			io.WriteString(body, `,"`+queryKey+`":`)
+			body.Write(out)
+		}
+		io.WriteString(body, "}\n")
+		if cw, ok := w.(*cacheWriter); ok {
+			cw.complete(soonest)
 		}
 		return nil
 	})
@@ -172,66 +1728,163 @@ func (s *Server) delete2(kind, id string) int {
 	return code
 }
 
-func (s *Server) get(kind, id string) (out []byte, code int) {
-	err := s.db.View(func(tx *bolt.Tx) error {
+// expandRefs inlines the entities m refers to, as described by es, without
+// their hidden fields. References to missing or expired entities, or that
+// aren't strings, are inlined as null.
+func (s *Server) expandRefs(tx *bolt.Tx, m map[string]interface{}, es []expansion) error {
+	for _, e := range es {
+		var ref map[string]interface{}
+		id, _ := m[e.Field].(string)
+		if b := tx.Bucket([]byte(e.Kind)); b != nil && id != "" {
+			if v := b.Get([]byte(id)); v != nil {
+				var err error
+				if ref, err = fromJSON(v); err != nil {
+					log.Printf("json: %v", err)
+					return err
+				}
+				if expired(ref) {
+					ref = nil
+				} else {
+					cfg, err := s.loadConfig(tx, e.Kind)
+					if err != nil {
+						log.Printf("config: %v", err)
+						return err
+					}
+					cfg.present(ref)
+				}
+			}
+		}
+		m[e.name()] = ref
+	}
+	return nil
+}
+
+// nextURL returns the URL of the next page of a list request, with the same
+// params except for the start cursor.
+func nextURL(r *http.Request, cursor string) string {
+	u := url.URL{
+		Scheme: "http",
+		Host:   r.Host,
+		Path:   r.URL.Path,
+	}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	q := r.URL.Query()
+	q.Set("start", cursor)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (s *Server) replace(lt logTags, kind, id string, r io.Reader, force bool) (out []byte, code int) {
+	code = http.StatusOK
+	err := s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(kind))
 		if b == nil {
 			code = http.StatusNotFound
 			return nil
 		}
-		out = b.Get([]byte(id))
-		if out == nil {
+		k := []byte(id)
+		v := b.Get(k)
+		if v == nil {
 			code = http.StatusNotFound
 			return nil
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, http.StatusInternalServerError
-	}
-	return
-}
-
-func (s *Server) insert(kind, id string, r io.Reader) (out []byte, code int) {
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists([]byte(kind))
+		old, err := fromJSON(v)
 		if err != nil {
-			log.Printf("create bucket: %v", err)
+			lt.printf("json: %v", err)
 			return err
 		}
-		if id == "" {
-			for {
-				u, err := uuid.NewV5(uuid.NamespaceURL, []byte("imjasonh.com"))
-				if err != nil {
-					log.Printf("uuid: %v", err)
-					return err
-				}
-				k := u[:]
-				if conflict := b.Get(k); conflict == nil {
-					id = string(k)
-					break
-				}
-			}
+		if expired(old) {
+			code = http.StatusNotFound
+			return nil
+		}
+		if readOnly(old) && !force {
+			code = http.StatusConflict
+			return nil
 		}
+		created, current := old[createdKey], version(old)
+
 		out, err = ioutil.ReadAll(r)
 		if err != nil {
-			log.Printf("readall: %v", err)
+			lt.printf("readall: %v", err)
 			return err
 		}
+		if isConfigKind(kind) {
+			if err := s.checkConfig(out); err != nil {
+				code, out = http.StatusBadRequest, []byte(err.Error())
+				return nil
+			}
+		}
 		m, err := fromJSON(out)
+		if err != nil || m == nil {
+			code, out = http.StatusBadRequest, []byte(notObject(err))
+			return nil
+		}
+		if err := checkKind(m, kind); err != nil {
+			code, out = http.StatusConflict, []byte(err.Error())
+			return nil
+		}
+		if err := keepParent(old, m); err != nil {
+			code, out = http.StatusConflict, []byte(err.Error())
+			return nil
+		}
+		if err := s.checkEntity(m); err != nil {
+			code, out = http.StatusBadRequest, []byte(err.Error())
+			return nil
+		}
+		if !checkVersion(m, version(old)) {
+			code = http.StatusConflict
+			return nil
+		}
+		cfg, err := s.loadConfig(tx, kind)
 		if err != nil {
-			log.Printf("json: %v", err)
+			lt.printf("config: %v", err)
 			return err
 		}
+		cfg.applyDerived(m)
+		if err := cfg.toCents(m); err != nil {
+			code, out = http.StatusBadRequest, []byte(err.Error())
+			return nil
+		}
+		cfg.decrypt(old)
+		if f, changed := cfg.changesImmutable(old, m); changed {
+			code, out = http.StatusConflict, []byte(immutableError(f))
+			return nil
+		}
+		if exp, found := old[expiresKey]; found {
+			m[expiresKey] = exp
+		}
+		if err := applyTTL(m); err != nil {
+			code = http.StatusBadRequest
+			return nil
+		}
+		// Make sure metadata is carried over intact
 		m[idKey] = id
-		m[createdKey] = nowFunc().Unix()
+		m[createdKey] = created
+		m[updatedKey] = nowFunc().Unix()
+		m[versionKey] = current + 1
+		if err := cfg.encrypt(m); err != nil {
+			lt.printf("encrypt: %v", err)
+			return err
+		}
 		out, err = toJSON(m)
 		if err != nil {
-			log.Printf("json: %v", err)
+			lt.printf("json: %v", err)
+			return err
+		}
+		if err := s.checkSize(kind, out); err != nil {
+			code, out = http.StatusRequestEntityTooLarge, []byte(err.Error())
+			return nil
+		}
+		if msg, err := claimUnique(tx, cfg, kind, id, old, m); err != nil {
 			return err
+		} else if msg != "" {
+			code, out = http.StatusConflict, []byte(msg)
+			return nil
 		}
-		if err := b.Put([]byte(id), out); err != nil {
-			log.Printf("put: %v", err)
+		if err := b.Put(k, out); err != nil {
+			lt.printf("put: %v", err)
 			return err
 		}
 		return nil
@@ -242,25 +1895,201 @@ func (s *Server) insert(kind, id string, r io.Reader) (out []byte, code int) {
 	return
 }
 
-func (s *Server) list(kind string, uq userQuery) (out []byte, code int) {
-	code = http.StatusOK
-	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(kind))
-		if b == nil {
-			code = http.StatusNotFound
-			return nil
+// patch partially updates an existing entity. The request body is either a
+// plain object whose top-level fields are merged into the entity, or an
+// operations document using "$set", "$unset" and "$inc", which is applied
+// against the stored entity within a single transaction.
+//
+// If diff is true, only the fields that changed are returned, as
+// {"_id":..., "changed":{...}}.
+func (s *Server) patch(lt logTags, kind, id string, r io.Reader, diff, force bool) ([]byte, int) {
+	in, err := ioutil.ReadAll(r)
+	if err != nil {
+		lt.printf("readall: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	p, err := fromJSON(in)
+	if err != nil || p == nil {
+		return []byte(notObject(err)), http.StatusBadRequest
+	}
+	before := map[string]interface{}{}
+	var invalid error
+	out, code := s.update(lt, kind, id, force, func(m map[string]interface{}) int {
+		// Nested objects of m may be changed in place once it's patched,
+		// e.g. as their money fields are converted to cents, so they're
+		// copied too.
+		b, err := json.Marshal(m)
+		if err == nil {
+			err = json.Unmarshal(b, &before)
 		}
-		_ = b.Cursor()
-		// TODO: implement
-		return nil
+		if err != nil {
+			lt.printf("json: %v", err)
+			return http.StatusInternalServerError
+		}
+		if isOpDoc(p) {
+			if err := applyOps(m, p); err != nil {
+				return http.StatusBadRequest
+			}
+		} else {
+			// Dotted keys set nested fields, after the top-level fields
+			// they might be inside of.
+			for k, v := range p {
+				if !strings.Contains(k, ".") {
+					m[k] = v
+				}
+			}
+			for k, v := range p {
+				if !strings.Contains(k, ".") {
+					continue
+				}
+				if !validPath(k) {
+					invalid = errors.New("invalid field path " + k)
+				} else {
+					invalid = setPath(m, k, v)
+				}
+				if invalid != nil {
+					return http.StatusBadRequest
+				}
+			}
+		}
+		if invalid = checkKind(m, kind); invalid != nil {
+			return http.StatusConflict
+		}
+		if invalid = keepParent(before, m); invalid != nil {
+			return http.StatusConflict
+		}
+		if invalid = s.checkEntity(m); invalid != nil {
+			return http.StatusBadRequest
+		}
+		return http.StatusOK
+	})
+	if invalid != nil {
+		return []byte(invalid.Error()), code
+	}
+	if code != http.StatusOK || !diff {
+		return out, code
+	}
+	after, err := fromJSON(out)
+	if err != nil {
+		lt.printf("json: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	// The entity was patched with its money fields as decimals, but after is
+	// as stored, in cents, and with its encrypted fields encrypted.
+	cfg, err := s.config(kind)
+	if err == nil {
+		cfg.decrypt(after)
+		err = cfg.toCents(before)
+	}
+	if err != nil {
+		lt.printf("config: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	out, err = toJSON(map[string]interface{}{
+		idKey:     id,
+		"changed": changedFields(before, after),
 	})
 	if err != nil {
-		return nil, http.StatusNotFound
+		lt.printf("json: %v", err)
+		return nil, http.StatusInternalServerError
 	}
-	return
+	return out, http.StatusOK
+}
+
+// changedFields returns the top-level fields whose values differ between
+// before and after. Fields that were removed are included with a null value.
+func changedFields(before, after map[string]interface{}) map[string]interface{} {
+	changed := map[string]interface{}{}
+	for k, v := range after {
+		if old, found := before[k]; !found || !reflect.DeepEqual(old, v) {
+			changed[k] = v
+		}
+	}
+	for k := range before {
+		if _, found := after[k]; !found {
+			changed[k] = nil
+		}
+	}
+	return changed
+}
+
+// prefers reports whether the request's Prefer header includes the given
+// preference, e.g. "return=diff".
+func prefers(r *http.Request, pref string) bool {
+	for _, h := range r.Header["Prefer"] {
+		for _, p := range strings.FieldsFunc(h, func(c rune) bool { return c == ',' || c == ';' }) {
+			if strings.TrimSpace(p) == pref {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// increment transactionally adds to a numeric field of an existing entity and
+// returns the field's new value. The request body names the field and the
+// amount, e.g. {"field":"views","by":1}; "by" defaults to 1, and a missing
+// field is treated as zero.
+func (s *Server) increment(lt logTags, kind, id string, r io.Reader, force bool) ([]byte, int) {
+	var req struct {
+		Field string   `json:"field"`
+		By    *float64 `json:"by"`
+	}
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return nil, http.StatusBadRequest
+	}
+	if req.Field == "" || strings.HasPrefix(req.Field, "_") {
+		return nil, http.StatusBadRequest
+	}
+	// The response holds the field's value, so hidden fields can't be
+	// incremented, or they'd be revealed.
+	cfg, err := s.config(kind)
+	if err != nil {
+		lt.printf("config: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	if cfg.reveals(req.Field) {
+		return []byte("field " + req.Field + " is hidden"), http.StatusBadRequest
+	}
+	by := 1.0
+	if req.By != nil {
+		by = *req.By
+	}
+	var val interface{}
+	_, code := s.update(lt, kind, id, force, func(m map[string]interface{}) int {
+		ops := map[string]interface{}{"$inc": map[string]interface{}{req.Field: by}}
+		if err := applyOps(m, ops); err != nil {
+			return http.StatusBadRequest
+		}
+		val = m[req.Field]
+		return http.StatusOK
+	})
+	if code != http.StatusOK {
+		return nil, code
+	}
+	out, err := toJSON(map[string]interface{}{req.Field: val})
+	if err != nil {
+		lt.printf("json: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	return out, http.StatusOK
+}
+
+// unlock clears the "_readonly" lock of an entity.
+func (s *Server) unlock(lt logTags, kind, id string) ([]byte, int) {
+	return s.update(lt, kind, id, true, func(m map[string]interface{}) int {
+		delete(m, readOnlyKey)
+		return http.StatusOK
+	})
 }
 
-func (s *Server) replace(kind, id string, r io.Reader) (out []byte, code int) {
+// update loads an existing entity, passes it to fn to be modified in place,
+// and stores the result, all within a single transaction. If fn returns a
+// status other than http.StatusOK, nothing is stored and that status is
+// returned. Entities locked with "_readonly" aren't updated unless force is
+// true.
+func (s *Server) update(lt logTags, kind, id string, force bool, fn func(m map[string]interface{}) int) (out []byte, code int) {
+	code = http.StatusOK
 	err := s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(kind))
 		if b == nil {
@@ -273,34 +2102,81 @@ func (s *Server) replace(kind, id string, r io.Reader) (out []byte, code int) {
 			code = http.StatusNotFound
 			return nil
 		}
-		old, err := fromJSON(v)
+		m, err := fromJSON(v)
 		if err != nil {
-			log.Printf("json: %v", err)
+			lt.printf("json: %v", err)
 			return err
 		}
-		created := old[createdKey]
-
-		out, err = ioutil.ReadAll(r)
+		if expired(m) {
+			code = http.StatusNotFound
+			return nil
+		}
+		if readOnly(m) && !force {
+			code = http.StatusConflict
+			return nil
+		}
+		created, current := m[createdKey], version(m)
+		old, err := fromJSON(v)
 		if err != nil {
-			log.Printf("readall: %v", err)
+			lt.printf("json: %v", err)
 			return err
 		}
-		m, err := fromJSON(out)
+		cfg, err := s.loadConfig(tx, kind)
 		if err != nil {
-			log.Printf("json: %v", err)
+			lt.printf("config: %v", err)
 			return err
 		}
+		// fn works with encrypted and money fields as clients see them.
+		cfg.decrypt(m)
+		cfg.decrypt(old)
+		cfg.fromCents(m)
+		if code = fn(m); code != http.StatusOK {
+			return nil
+		}
+		cfg.applyDerived(m)
+		if err := cfg.toCents(m); err != nil {
+			code, out = http.StatusBadRequest, []byte(err.Error())
+			return nil
+		}
+		if f, changed := cfg.changesImmutable(old, m); changed {
+			code, out = http.StatusConflict, []byte(immutableError(f))
+			return nil
+		}
+		// A patch can give the version it expects to change.
+		if !checkVersion(m, current) {
+			code = http.StatusConflict
+			return nil
+		}
+		if err := applyTTL(m); err != nil {
+			code = http.StatusBadRequest
+			return nil
+		}
 		// Make sure metadata is carried over intact
 		m[idKey] = id
 		m[createdKey] = created
 		m[updatedKey] = nowFunc().Unix()
+		m[versionKey] = current + 1
+		if err := cfg.encrypt(m); err != nil {
+			lt.printf("encrypt: %v", err)
+			return err
+		}
 		out, err = toJSON(m)
 		if err != nil {
-			log.Printf("json: %v", err)
+			lt.printf("json: %v", err)
 			return err
 		}
+		if err := s.checkSize(kind, out); err != nil {
+			code, out = http.StatusRequestEntityTooLarge, []byte(err.Error())
+			return nil
+		}
+		if msg, err := claimUnique(tx, cfg, kind, id, old, m); err != nil {
+			return err
+		} else if msg != "" {
+			code, out = http.StatusConflict, []byte(msg)
+			return nil
+		}
 		if err := b.Put(k, out); err != nil {
-			log.Printf("put: %v", err)
+			lt.printf("put: %v", err)
 			return err
 		}
 		return nil
@@ -311,10 +2187,286 @@ func (s *Server) replace(kind, id string, r io.Reader) (out []byte, code int) {
 	return
 }
 
+// isOpDoc reports whether a PATCH body is an operations document, i.e. any of
+// its keys is a "$"-prefixed operator. applyOps rejects documents that mix
+// operators and plain fields.
+func isOpDoc(p map[string]interface{}) bool {
+	for k := range p {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// applyOps applies an operations document to m. Operators are applied in a
+// fixed order -- $set, then $unset, then $inc -- regardless of their order in
+// the document.
+func applyOps(m, ops map[string]interface{}) error {
+	for op := range ops {
+		if op != "$set" && op != "$unset" && op != "$inc" {
+			return errors.New("unknown operator " + op)
+		}
+	}
+	for _, op := range []string{"$set", "$unset", "$inc"} {
+		arg, found := ops[op]
+		if !found {
+			continue
+		}
+		switch op {
+		case "$set":
+			fields, ok := arg.(map[string]interface{})
+			if !ok {
+				return errors.New("$set: expected object")
+			}
+			for k, v := range fields {
+				m[k] = v
+			}
+		case "$unset":
+			fields, ok := arg.([]interface{})
+			if !ok {
+				return errors.New("$unset: expected array")
+			}
+			for _, f := range fields {
+				k, ok := f.(string)
+				if !ok {
+					return errors.New("$unset: expected field name")
+				}
+				delete(m, k)
+			}
+		case "$inc":
+			fields, ok := arg.(map[string]interface{})
+			if !ok {
+				return errors.New("$inc: expected object")
+			}
+			for k, v := range fields {
+				by, ok := v.(float64)
+				if !ok {
+					return errors.New("$inc: non-numeric amount for " + k)
+				}
+				cur := 0.0
+				if old, found := m[k]; found {
+					if cur, ok = old.(float64); !ok {
+						return errors.New("$inc: non-numeric field " + k)
+					}
+				}
+				m[k] = cur + by
+			}
+		}
+	}
+	return nil
+}
+
+// checkEntity checks that an entity about to be written is valid, returning
+// an error describing the problem if not.
+func (s *Server) checkEntity(m map[string]interface{}) error {
+	if s.maxDepth > 0 && nestedDeeper(m, s.maxDepth) {
+		return fmt.Errorf("objects and arrays may only be nested %d levels deep", s.maxDepth)
+	}
+	for k := range m {
+		if strings.HasPrefix(k, "_") && !metadataKeys[k] {
+			return fmt.Errorf("invalid field name %q: names starting with _ are reserved", k)
+		}
+	}
+	return checkNames(m)
+}
+
+// checkKind checks that an entity written to a kind doesn't say, with a
+// "_kind" field, that it's of another kind, which would be a client bug. If it
+// says it's of the same kind, the field is removed, since the kind goes
+// without saying; that way objects from searches and metaOnly lists, which
+// are given a "_kind", can be written back as they are.
+func checkKind(m map[string]interface{}, kind string) error {
+	v, found := m[kindKey]
+	if !found {
+		return nil
+	}
+	if _, bare := splitNamespace(kind); v != bare {
+		b, _ := json.Marshal(v)
+		return fmt.Errorf("%s %s doesn't match the kind %q in the path", kindKey, b, bare)
+	}
+	delete(m, kindKey)
+	return nil
+}
+
+// notObject is the message for a body that failed to decode as an object
+// with the given error, or was null.
+func notObject(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "not an object"
+}
+
+// checkSize checks that an encoded entity of a kind isn't too large to store.
+func (s *Server) checkSize(kind string, b []byte) error {
+	if s.maxEntity > 0 && len(b) > s.maxEntity {
+		_, bare := splitNamespace(kind)
+		return fmt.Errorf("%s object is %d bytes, but objects may be at most %d", bare, len(b), s.maxEntity)
+	}
+	return nil
+}
+
+// checkNames checks that no field name in v, at any depth, contains a ".",
+// since that would be ambiguous with dotted paths when filtering and sorting.
+func checkNames(v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, c := range v {
+			if strings.Contains(k, ".") {
+				return fmt.Errorf("invalid field name %q: names may not contain .", k)
+			}
+			if err := checkNames(c); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, c := range v {
+			if err := checkNames(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nestedDeeper reports whether v nests objects and arrays more than max
+// levels deep. An object containing only scalars is one level deep.
+func nestedDeeper(v interface{}, max int) bool {
+	var children []interface{}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, c := range v {
+			children = append(children, c)
+		}
+	case []interface{}:
+		children = v
+	default:
+		return false
+	}
+	if max == 0 {
+		return true
+	}
+	for _, c := range children {
+		if nestedDeeper(c, max-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTTL replaces a "_ttl" field, a number of seconds, with an "_expires"
+// field holding the Unix time at which the entity expires.
+func applyTTL(m map[string]interface{}) error {
+	v, found := m[ttlKey]
+	if !found {
+		return nil
+	}
+	delete(m, ttlKey)
+	ttl, ok := v.(float64)
+	if !ok || ttl < 0 {
+		return invalidTTL
+	}
+	m[expiresKey] = nowFunc().Unix() + int64(ttl)
+	return nil
+}
+
+// expired reports whether an entity's "_expires" time has passed.
+func expired(m map[string]interface{}) bool {
+	exp, ok := m[expiresKey].(float64)
+	return ok && int64(exp) <= nowFunc().Unix()
+}
+
+// immutableError is the message for a write changing an immutable field.
+func immutableError(field string) string {
+	return fmt.Sprintf("field %q can't be changed", field)
+}
+
+// version returns an entity's "_version", which counts the writes to it.
+// Entities written before versions were tracked are at version 0.
+func version(m map[string]interface{}) int64 {
+	v, _ := m[versionKey].(float64)
+	return int64(v)
+}
+
+// checkVersion reports whether the "_version" sent by a client, if any,
+// matches the current version of the entity it's writing, so that a client
+// can't overwrite changes it hasn't seen.
+func checkVersion(m map[string]interface{}, current int64) bool {
+	v, found := m[versionKey]
+	if !found {
+		return true
+	}
+	f, ok := v.(float64)
+	return ok && int64(f) == current
+}
+
+// readOnly reports whether an entity is locked with "_readonly".
+func readOnly(m map[string]interface{}) bool {
+	return m[readOnlyKey] == true
+}
+
+// purge deletes expired entities of every kind in a namespace, and returns
+// the number deleted.
+func (s *Server) purge(ns string) ([]byte, int) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			// Another user's namespace may start with this one, e.g. a
+			// bucket "a---Data" from before such user IDs were rejected.
+			if owner, _ := splitNamespace(string(name)); owner != ns {
+				return nil
+			}
+			var keys [][]byte
+			if err := b.ForEach(func(k, v []byte) error {
+				m, err := fromJSON(v)
+				if err != nil {
+					log.Printf("json: %v", err)
+					return err
+				}
+				if expired(m) {
+					keys = append(keys, append([]byte(nil), k...))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, k := range keys {
+				if err := b.Delete(k); err != nil {
+					log.Printf("delete: %v", err)
+					return err
+				}
+			}
+			n += len(keys)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+	out, err := toJSON(map[string]interface{}{"deleted": n})
+	if err != nil {
+		log.Printf("json: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	return out, http.StatusOK
+}
+
+// errTrailingData means a JSON body had more after its value.
+var errTrailingData = errors.New("invalid JSON: unexpected data after the value")
+
+// fromJSON decodes a JSON object. Anything but whitespace after the object is
+// an error, so a body holding more than one value isn't silently cut short.
 func fromJSON(b []byte) (map[string]interface{}, error) {
 	var m map[string]interface{}
-	err := json.NewDecoder(bytes.NewReader(b)).Decode(&m)
-	return m, err
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errTrailingData
+	}
+	return m, nil
 }
 
 func toJSON(m map[string]interface{}) ([]byte, error) {
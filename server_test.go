@@ -1,11 +1,64 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
 )
 
+// newTestServer returns a Server backed by a temporary bolt database, and a
+// func to clean it up.
+func newTestServer(t *testing.T) (*Server, func()) {
+	f, err := ioutil.TempFile("", "simply-put")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	db, err := bolt.Open(f.Name(), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{db: db}, func() {
+		db.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// do sends a request to the server and returns the recorded response. Any
+// body is sent as JSON.
+func do(s *Server, method, path, body string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// decode decodes a JSON response body into a map.
+func decode(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	var m map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	return m
+}
+
 func TestUserQuery(t *testing.T) {
 	cases := []struct {
 		r        http.Request
@@ -16,6 +69,15 @@ func TestUserQuery(t *testing.T) {
 		http.Request{},
 		&userQuery{Limit: defaultLimit},
 		false,
+	}, {
+		// An explicit limit of 0 isn't replaced by the default
+		http.Request{Form: map[string][]string{"limit": []string{"0"}}},
+		&userQuery{Limit: 0},
+		false,
+	}, {
+		http.Request{Form: map[string][]string{"limit": []string{"-1"}}},
+		nil,
+		true,
 	}, {
 		// User requests all the params
 		http.Request{
@@ -25,14 +87,23 @@ func TestUserQuery(t *testing.T) {
 				"end":   []string{"e"},
 				"sort":  []string{"-foo"},
 				"where": []string{"foo=bar", "baz=qux", "quux=duck"},
+				"or":    []string{"a=1;b=2", "c=3"},
 			},
 		},
 		&userQuery{Limit: 1, StartCursor: "s", EndCursor: "e", Sort: "-foo", Filters: []filter{
 			{Key: "foo", Value: "bar"},
 			{Key: "baz", Value: "qux"},
 			{Key: "quux", Value: "duck"},
+		}, Or: [][]filter{
+			{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}},
+			{{Key: "c", Value: "3"}},
 		}},
 		false,
+	}, {
+		// A "where" key ending in "!" is a not-equal filter
+		http.Request{Form: map[string][]string{"where": []string{"status!=archived"}}},
+		&userQuery{Limit: defaultLimit, Filters: []filter{{Key: "status", Op: "!=", Value: "archived"}}},
+		false,
 	}, {
 		// User passes non-numerical "limit" param
 		http.Request{
@@ -42,6 +113,42 @@ func TestUserQuery(t *testing.T) {
 		},
 		nil,
 		true,
+	}, {
+		// User passes malformed "sort" param
+		http.Request{
+			Form: map[string][]string{
+				"sort": []string{"-address..zip"},
+			},
+		},
+		nil,
+		true,
+	}, {
+		// User passes malformed "or" param
+		http.Request{
+			Form: map[string][]string{
+				"or": []string{"a=1;bad"},
+			},
+		},
+		nil,
+		true,
+	}, {
+		// User asks for recently updated entities
+		http.Request{
+			Form: map[string][]string{
+				"updatedSince": []string{"1234"},
+			},
+		},
+		&userQuery{Limit: defaultLimit, Filters: []filter{{Key: updatedKey, Op: ">", Value: "1234"}}},
+		false,
+	}, {
+		// User passes malformed "updatedSince" param
+		http.Request{
+			Form: map[string][]string{
+				"updatedSince": []string{"yesterday"},
+			},
+		},
+		nil,
+		true,
 	}, {
 		// User passes malformed "where" param
 		http.Request{
@@ -66,25 +173,3688 @@ func TestUserQuery(t *testing.T) {
 
 func TestGetKindAndID(t *testing.T) {
 	cases := []struct {
-		path     string
-		kind, id string
-		hasError bool
+		path             string
+		parent, kind, id string
+		hasError         bool
 	}{
-		{"/MyKindOfData", "MyKindOfData", "", false},
-		{"/MyKindOfData/foo", "MyKindOfData", "foo", false},
+		{"/MyKindOfData", "", "MyKindOfData", "", false},
+		{"/MyKindOfData/foo", "", "MyKindOfData", "foo", false},
+		{"/People/123/Posts", "People/123", "Posts", "", false},
+		{"/People/123/Posts/foo", "People/123", "Posts", "foo", false},
 
-		{"/bad/path/too/long", "", "", true},
-		{"bad/path", "", "", true},
-		{"/", "", "", true},
+		{"/bad/path/much/too/long", "", "", "", true},
+		{"/People//Posts", "", "", "", true},
+		{"/People/a=b/Posts", "", "", "", true},
+		{"bad/path", "", "", "", true},
+		{"/", "", "", "", true},
 	}
 	for _, c := range cases {
-		kind, id, err := getKindAndID(c.path)
+		parent, kind, id, err := getKindAndID(c.path)
 		if c.hasError && err == nil {
-			t.Errorf("getKindAndID(%s); expected error, got %s,%s", c.path, kind, id)
+			t.Errorf("getKindAndID(%s); expected error, got %s,%s,%s", c.path, parent, kind, id)
 		} else if err != nil && !c.hasError {
 			t.Errorf("unexpected error %v", err)
-		} else if c.kind != kind || c.id != id {
-			t.Errorf("getKindAndID(%s); got %s,%s want %s,%s", c.path, kind, id, c.kind, c.id)
+		} else if c.parent != parent || c.kind != kind || c.id != id {
+			t.Errorf("getKindAndID(%s); got %s,%s,%s want %s,%s,%s", c.path, parent, kind, id, c.parent, c.kind, c.id)
+		}
+	}
+}
+
+func TestPatchOperations(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/Data/a", `{"a":0,"b":"foo","count":10}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	cases := []struct {
+		body string
+		want map[string]interface{}
+	}{{
+		// $set
+		`{"$set":{"a":1,"c":true}}`,
+		map[string]interface{}{"a": 1.0, "b": "foo", "c": true, "count": 10.0},
+	}, {
+		// $unset
+		`{"$unset":["b","c"]}`,
+		map[string]interface{}{"a": 1.0, "count": 10.0},
+	}, {
+		// $inc an existing field
+		`{"$inc":{"count":5}}`,
+		map[string]interface{}{"a": 1.0, "count": 15.0},
+	}, {
+		// $inc a missing field starts from zero
+		`{"$inc":{"views":2}}`,
+		map[string]interface{}{"a": 1.0, "count": 15.0, "views": 2.0},
+	}, {
+		// plain merge
+		`{"a":2}`,
+		map[string]interface{}{"a": 2.0, "count": 15.0, "views": 2.0},
+	}}
+	for _, c := range cases {
+		if w := do(s, "PATCH", "/Data/a", c.body); w.Code != http.StatusOK {
+			t.Fatalf("PATCH %s: got %d", c.body, w.Code)
+		}
+		got := decode(t, do(s, "GET", "/Data/a", ""))
+		for _, k := range []string{idKey, createdKey, updatedKey, versionKey} {
+			if _, found := got[k]; !found {
+				t.Errorf("PATCH %s: missing %s", c.body, k)
+			}
+			delete(got, k)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("PATCH %s;\n got %v\nwant %v", c.body, got, c.want)
+		}
+	}
+
+	for _, body := range []string{
+		`{"$inc":{"b":"x"}}`,
+		`{"$unset":"a"}`,
+		`{"$bogus":{}}`,
+		`{"$inc":{"a":1},"a":3}`,
+	} {
+		if w := do(s, "PATCH", "/Data/a", body); w.Code != http.StatusBadRequest {
+			t.Errorf("PATCH %s: got %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	if w := do(s, "PATCH", "/Data/missing", `{"$set":{"a":1}}`); w.Code != http.StatusNotFound {
+		t.Errorf("PATCH missing: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestPatchNestedFields(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/Data/a", `{"name":"Ann","address":{"city":"Portland","zip":"97201"}}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if w := do(s, "PATCH", "/Data/a", `{"address.city":"Seattle","geo.lat.deg":47}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH: got %d: %s", w.Code, w.Body.String())
+	}
+	got := decode(t, do(s, "GET", "/Data/a", ""))
+	want := map[string]interface{}{"city": "Seattle", "zip": "97201"}
+	if !reflect.DeepEqual(got["address"], want) {
+		t.Errorf("got address %v, want %v", got["address"], want)
+	}
+	if got["name"] != "Ann" {
+		t.Errorf("got name %v, want Ann", got["name"])
+	}
+	if deg, _ := lookup(got, "geo.lat.deg"); deg != 47.0 {
+		t.Errorf("got geo.lat.deg %v, want 47", deg)
+	}
+
+	// Dotted keys apply after top-level ones, whatever their order.
+	if w := do(s, "PATCH", "/Data/a", `{"address.zip":"98101","address":{"city":"Tacoma"}}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH: got %d", w.Code)
+	}
+	want = map[string]interface{}{"city": "Tacoma", "zip": "98101"}
+	if got := decode(t, do(s, "GET", "/Data/a", ""))["address"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got address %v, want %v", got, want)
+	}
+
+	for _, body := range []string{
+		`{"name.first":"Ann"}`,
+		`{"address..city":"x"}`,
+		`{"_meta.x":1}`,
+	} {
+		if w := do(s, "PATCH", "/Data/a", body); w.Code != http.StatusBadRequest {
+			t.Errorf("PATCH %s: got %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestSplitAction(t *testing.T) {
+	cases := []struct {
+		path, rest, action string
+	}{
+		{"/MyKindOfData/foo/_inc", "/MyKindOfData/foo", "_inc"},
+		{"/MyKindOfData/foo", "/MyKindOfData/foo", ""},
+		{"/MyKindOfData", "/MyKindOfData", ""},
+		{"/MyKindOfData/foo/bar", "/MyKindOfData/foo/bar", ""},
+		{"/bad/path/too/_long", "/bad/path/too/_long", ""},
+		{"/People/123/Posts/foo/_inc", "/People/123/Posts/foo", "_inc"},
+		{"/People/123/Posts/_stats", "/People/123/Posts/_stats", ""},
+	}
+	for _, c := range cases {
+		rest, action := splitAction(c.path)
+		if rest != c.rest || action != c.action {
+			t.Errorf("splitAction(%s); got %s,%s want %s,%s", c.path, rest, action, c.rest, c.action)
+		}
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/Data/a", `{"a":1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+
+	// First increment of a missing field starts from zero.
+	w := do(s, "POST", "/Data/a/_inc", `{"field":"views","by":1}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("first increment: got %d", w.Code)
+	}
+	if got := decode(t, w); !reflect.DeepEqual(got, map[string]interface{}{"views": 1.0}) {
+		t.Errorf("first increment: got %v", got)
+	}
+
+	// Subsequent increments, concurrently, are not lost.
+	const n = 10
+	errc := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			errc <- do(s, "POST", "/Data/a/_inc", `{"field":"views","by":2}`).Code
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if code := <-errc; code != http.StatusOK {
+			t.Errorf("increment: got %d", code)
+		}
+	}
+	got := decode(t, do(s, "GET", "/Data/a", ""))
+	if got["views"] != 1.0+2*n {
+		t.Errorf("after increments: got views=%v, want %v", got["views"], 1+2*n)
+	}
+	if got["a"] != 1.0 {
+		t.Errorf("after increments: got a=%v, want 1", got["a"])
+	}
+
+	for _, c := range []struct {
+		path, body string
+		code       int
+	}{
+		{"/Data/a/_inc", `{"field":"a","by":"x"}`, http.StatusBadRequest},
+		{"/Data/a/_inc", `{"by":1}`, http.StatusBadRequest},
+		{"/Data/a/_inc", `{"field":"_created"}`, http.StatusBadRequest},
+		{"/Data/missing/_inc", `{"field":"views"}`, http.StatusNotFound},
+	} {
+		if w := do(s, "POST", c.path, c.body); w.Code != c.code {
+			t.Errorf("POST %s %s: got %d, want %d", c.path, c.body, w.Code, c.code)
+		}
+	}
+	if w := do(s, "GET", "/Data/a/_inc", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET _inc: got %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAllowedKinds(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.kinds = map[string]bool{"Data": true}
+
+	if w := do(s, "PUT", "/Data/a", `{"a":1}`); w.Code != http.StatusOK {
+		t.Errorf("PUT allowed kind: got %d", w.Code)
+	}
+	if w := do(s, "GET", "/Data/a", ""); w.Code != http.StatusOK {
+		t.Errorf("GET allowed kind: got %d", w.Code)
+	}
+	for _, m := range []string{"GET", "PUT", "POST", "DELETE"} {
+		if w := do(s, m, "/Other/a", `{"a":1}`); w.Code != http.StatusForbidden {
+			t.Errorf("%s disallowed kind: got %d, want %d", m, w.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/_config/Data", `{"defaults":{"status":"new"}}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT config: got %d", w.Code)
+	}
+
+	// Field omitted, default is applied.
+	w := do(s, "POST", "/Data", `{"a":1}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST: got %d", w.Code)
+	}
+	if got := decode(t, w)["status"]; got != "new" {
+		t.Errorf("POST without status: got status=%v, want new", got)
+	}
+
+	// Field provided, default doesn't override it.
+	w = do(s, "POST", "/Data", `{"a":1,"status":"old"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST: got %d", w.Code)
+	}
+	m := decode(t, w)
+	if got := m["status"]; got != "old" {
+		t.Errorf("POST with status: got status=%v, want old", got)
+	}
+	if got := decode(t, do(s, "GET", "/Data/"+m[idKey].(string), ""))["status"]; got != "old" {
+		t.Errorf("GET: got status=%v, want old", got)
+	}
+
+	// Other kinds are unaffected.
+	w = do(s, "POST", "/Other", `{"a":1}`)
+	if _, found := decode(t, w)["status"]; found {
+		t.Errorf("POST to other kind: got status, want none")
+	}
+
+	if w := do(s, "PUT", "/_config/Data", `{"defaults":"bad"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT bad config: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// listIDs returns the IDs of the items in a list response.
+func listIDs(t *testing.T, w *httptest.ResponseRecorder) []string {
+	items, ok := decode(t, w)["items"].([]interface{})
+	if !ok {
+		t.Fatalf("no items in %s", w.Body.String())
+	}
+	ids := []string{}
+	for _, i := range items {
+		ids = append(ids, i.(map[string]interface{})[idKey].(string))
+	}
+	return ids
+}
+
+func TestListSortOrder(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for id, body := range map[string]string{
+		"a": `{"age":30}`,
+		"b": `{"age":10}`,
+		"c": `{"age":20}`,
+	} {
+		if w := do(s, "PUT", "/Data/"+id, body); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	want := listIDs(t, do(s, "GET", "/Data?sort=-age", ""))
+	if !reflect.DeepEqual(want, []string{"a", "c", "b"}) {
+		t.Fatalf("sort=-age: got %v", want)
+	}
+	for _, q := range []string{"sort=age&order=desc", "sort=-age&order=asc", "sort=-age&order=desc"} {
+		if got := listIDs(t, do(s, "GET", "/Data?"+q, "")); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", q, got, want)
+		}
+	}
+	if got := listIDs(t, do(s, "GET", "/Data?sort=age&order=asc", "")); !reflect.DeepEqual(got, []string{"b", "c", "a"}) {
+		t.Errorf("order=asc: got %v", got)
+	}
+	for _, q := range []string{"sort=age&order=up", "order=desc"} {
+		if w := do(s, "GET", "/Data?"+q, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", q, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestListSortNested(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for id, body := range map[string]string{
+		"a": `{"address":{"zip":30000}}`,
+		"b": `{"address":{"zip":10000}}`,
+		"c": `{"address":{"zip":20000}}`,
+	} {
+		if w := do(s, "PUT", "/Data/"+id, body); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	for _, c := range []struct {
+		sort string
+		want []string
+	}{
+		{"address.zip", []string{"b", "c", "a"}},
+		{"-address.zip", []string{"a", "c", "b"}},
+	} {
+		w := do(s, "GET", "/Data?sort="+c.sort, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET sort=%s: got %d", c.sort, w.Code)
+		}
+		if got := listIDs(t, w); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("GET sort=%s: got %v, want %v", c.sort, got, c.want)
+		}
+	}
+	for _, sort := range []string{"-", "address.", ".zip", "address.-zip"} {
+		if w := do(s, "GET", "/Data?sort="+sort, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("GET sort=%s: got %d, want %d", sort, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestListPaging(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, id := range []string{"a", "b", "c"} {
+		if w := do(s, "PUT", "/Data/"+id, `{"x":1}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	w := do(s, "GET", "/Data?limit=0", "")
+	if got := listIDs(t, w); len(got) != 0 {
+		t.Errorf("limit=0: got %v, want none", got)
+	}
+	if tok, found := decode(t, w)["nextStartToken"]; found || w.Header().Get("Link") != "" {
+		t.Errorf("limit=0: got nextStartToken %v, Link %q, want none", tok, w.Header().Get("Link"))
+	}
+	if w := do(s, "GET", "/Data?limit=-1", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("limit=-1: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	w = do(s, "GET", "/Data?limit=2", "")
+	if got := listIDs(t, w); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("first page: got %v", got)
+	}
+	tok, _ := decode(t, w)["nextStartToken"].(string)
+	if tok == "" {
+		t.Fatalf("first page: no nextStartToken")
+	}
+	w = do(s, "GET", "/Data?limit=2&start="+tok, "")
+	if got := listIDs(t, w); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("second page: got %v", got)
+	}
+	if _, found := decode(t, w)["nextStartToken"]; found {
+		t.Errorf("second page: got nextStartToken, want none")
+	}
+	if w := do(s, "GET", "/Data?start=bogus", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("bogus cursor: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// Cursors only work with the query they came from, give or take the
+	// limit and the order of filters.
+	w = do(s, "GET", "/Data?limit=1&where=x=1&sort=-_id", "")
+	tok, _ = decode(t, w)["nextStartToken"].(string)
+	for _, c := range []struct {
+		query string
+		want  int
+	}{
+		{"limit=1&where=x=1&sort=-_id", http.StatusOK},
+		{"limit=5&sort=-_id&where=x=1", http.StatusOK},
+		{"limit=1&where=x=1", http.StatusBadRequest},
+		{"limit=1&where=x=2&sort=-_id", http.StatusBadRequest},
+		{"limit=1&where=x=1&where=y=1&sort=-_id", http.StatusBadRequest},
+		{"limit=1&or=x=1&sort=-_id", http.StatusBadRequest},
+	} {
+		if w := do(s, "GET", "/Data?"+c.query+"&start="+tok, ""); w.Code != c.want {
+			t.Errorf("cursor from another query, ?%s: got %d, want %d", c.query, w.Code, c.want)
+		}
+	}
+	w = do(s, "GET", "/Data?limit=1&where=x=1&sort=-_id&start="+tok, "")
+	if got := listIDs(t, w); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("resumed page: got %v, want [b]", got)
+	}
+	w = do(s, "GET", "/Data?start="+strings.Repeat(tok, 100), "")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "longer than") {
+		t.Errorf("long cursor: got %d %q, want %d", w.Code, w.Body, http.StatusBadRequest)
+	}
+	w = do(s, "GET", "/Data?where=x=1", "")
+	if got := listIDs(t, w); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("where x=1: got %v", got)
+	}
+	w = do(s, "GET", "/Data?where=x=2", "")
+	if got := listIDs(t, w); len(got) != 0 {
+		t.Errorf("where x=2: got %v", got)
+	}
+	if w := do(s, "PATCH", "/Data/b", `{"x":2}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH: got %d", w.Code)
+	}
+	w = do(s, "GET", "/Data?where=x!=2", "")
+	if got := listIDs(t, w); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("where x!=2: got %v", got)
+	}
+}
+
+func TestListStreaming(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	const n = 1000
+	want := make([]string, n)
+	for i := range want {
+		want[i] = fmt.Sprintf("%04d", i)
+		if w := do(s, "PUT", "/Data/"+want[i], `{"x":`+strconv.Itoa(i)+`}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	for _, path := range []string{"/Data?limit=1000", "/Data?limit=1000&sort=x"} {
+		if got := listIDs(t, do(s, "GET", path, "")); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %d items, want %d", path, len(got), n)
+		}
+	}
+	sig := querySignature(nil, nil, "-x")
+	w := do(s, "GET", "/Data?sort=-x&limit=2&start="+encodeCursor(n-3, sig), "")
+	if got := listIDs(t, w); !reflect.DeepEqual(got, []string{"0002", "0001"}) {
+		t.Errorf("sorted page: got %v", got)
+	}
+	if tok, _ := decode(t, w)["nextStartToken"].(string); tok != encodeCursor(n-1, sig) {
+		t.Errorf("sorted page: got nextStartToken %q, want %q", tok, encodeCursor(n-1, sig))
+	}
+	w = do(s, "HEAD", "/Data", "")
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("HEAD: got %d with %d bytes, want %d with none", w.Code, w.Body.Len(), http.StatusOK)
+	}
+	if w := do(s, "GET", "/Missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("missing kind: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestListKeysOnly(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for i, id := range []string{"a", "b", "c", "d"} {
+		if w := do(s, "PUT", "/Data/"+id, `{"x":`+strconv.Itoa(i%2)+`}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	const q = "/Data?where=x=1&sort=-_id"
+	w := do(s, "GET", q+"&keysOnly=true", "")
+	var keys struct {
+		Items []string `json:"items"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &keys); err != nil {
+		t.Fatalf("keysOnly: %v", err)
+	}
+	if want := []string{"d", "b"}; !reflect.DeepEqual(keys.Items, want) {
+		t.Errorf("keysOnly: got %v, want %v", keys.Items, want)
+	}
+	full, hydrated := do(s, "GET", q, ""), do(s, "GET", q+"&keysOnly=true&hydrate=true", "")
+	if !reflect.DeepEqual(decode(t, hydrated), decode(t, full)) {
+		t.Errorf("hydrate: got %s, want %s", hydrated.Body, full.Body)
+	}
+}
+
+func TestListExpand(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for path, body := range map[string]string{
+		"/authors/ann": `{"name":"Ann"}`,
+		"/Posts/p1":    `{"authorId":"ann"}`,
+		"/Posts/p2":    `{"authorId":"bob"}`,
+		"/Posts/p3":    `{"authorId":1}`,
+	} {
+		if w := do(s, "PUT", path, body); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", path, w.Code)
+		}
+	}
+	w := do(s, "GET", "/Posts?expand=authorId:authors", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: got %d", w.Code)
+	}
+	items, _ := decode(t, w)["items"].([]interface{})
+	if len(items) != 3 {
+		t.Fatalf("got %d items, want 3", len(items))
+	}
+	author, _ := items[0].(map[string]interface{})["author"].(map[string]interface{})
+	if author["name"] != "Ann" || author["_id"] != "ann" {
+		t.Errorf("p1: got author %v", author)
+	}
+	for _, it := range items[1:] {
+		if a, found := it.(map[string]interface{})["author"]; !found || a != nil {
+			t.Errorf("%v: got author %v, want null", it.(map[string]interface{})["_id"], a)
+		}
+	}
+
+	for _, c := range []struct {
+		expand string
+		want   int
+	}{
+		{"author:authors", http.StatusBadRequest},
+		{"authorId", http.StatusBadRequest},
+		{"authorId:a--b", http.StatusBadRequest},
+	} {
+		if w := do(s, "GET", "/Posts?expand="+c.expand, ""); w.Code != c.want {
+			t.Errorf("expand=%s: got %d, want %d", c.expand, w.Code, c.want)
+		}
+	}
+	s.kinds = map[string]bool{"Posts": true}
+	if w := do(s, "GET", "/Posts?expand=authorId:authors", ""); w.Code != http.StatusForbidden {
+		t.Errorf("disallowed kind: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestJSONAPI(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, id := range []string{"a", "b"} {
+		if w := do(s, "PUT", "/Data/"+id, `{"x":1}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	w := do(s, "GET", "/Data/a?format=jsonapi", "")
+	if ct := w.Header().Get("Content-Type"); ct != jsonAPIContentType {
+		t.Errorf("get: got Content-Type %q, want %q", ct, jsonAPIContentType)
+	}
+	data, _ := decode(t, w)["data"].(map[string]interface{})
+	attrs, _ := data["attributes"].(map[string]interface{})
+	if data["type"] != "Data" || data["id"] != "a" || attrs["x"] != 1.0 {
+		t.Errorf("get: got %v", data)
+	}
+	if _, found := attrs["_id"]; found {
+		t.Errorf("get: attributes include _id")
+	}
+
+	w = do(s, "GET", "/Data?format=jsonapi&limit=1", "")
+	if ct := w.Header().Get("Content-Type"); ct != jsonAPIContentType {
+		t.Errorf("list: got Content-Type %q, want %q", ct, jsonAPIContentType)
+	}
+	got := decode(t, w)
+	list, _ := got["data"].([]interface{})
+	if len(list) != 1 || list[0].(map[string]interface{})["id"] != "a" {
+		t.Errorf("list: got data %v", got["data"])
+	}
+	meta, _ := got["meta"].(map[string]interface{})
+	if meta["nextStartToken"] != encodeCursor(1, querySignature(nil, nil, "")) {
+		t.Errorf("list: got meta %v", got["meta"])
+	}
+	if _, found := got["items"]; found {
+		t.Errorf("list: got items alongside data")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	defer func(d time.Duration) { eventsInterval = d }(eventsInterval)
+	eventsInterval = 10 * time.Millisecond
+
+	if w := do(s, "GET", "/Data/_events", ""); w.Code != http.StatusNotAcceptable {
+		t.Errorf("without Accept: got %d, want %d", w.Code, http.StatusNotAcceptable)
+	}
+
+	r, _ := http.NewRequest("GET", "/Data/_events", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	ctx, cancel := context.WithCancel(r.Context())
+	w := httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		s.ServeHTTP(w, r.WithContext(ctx))
+		close(finished)
+	}()
+	time.Sleep(3 * eventsInterval)
+	if put := do(s, "PUT", "/Data/a", `{"x":1}`); put.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", put.Code)
+	}
+	time.Sleep(5 * eventsInterval)
+	cancel()
+	<-finished
+
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	if len(events) != 1 || !strings.HasPrefix(events[0], "data: ") {
+		t.Fatalf("got events %q, want one", events)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(events[0], "data: ")), &m); err != nil {
+		t.Fatalf("event data: %v", err)
+	}
+	if m["_id"] != "a" || m["x"] != 1.0 {
+		t.Errorf("got event data %v", m)
+	}
+}
+
+func TestEventsSameSecond(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	defer func(d time.Duration) { eventsInterval = d }(eventsInterval)
+	eventsInterval = 10 * time.Millisecond
+	defer func() { nowFunc = time.Now }()
+	nowFunc = func() time.Time { return time.Unix(1420070400, 0) }
+
+	r, _ := http.NewRequest("GET", "/Data/_events", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	ctx, cancel := context.WithCancel(r.Context())
+	w := httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		s.ServeHTTP(w, r.WithContext(ctx))
+		close(finished)
+	}()
+	// Both writes have the same _updated time, but each is sent.
+	time.Sleep(3 * eventsInterval)
+	if put := do(s, "PUT", "/Data/a", `{"x":1}`); put.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", put.Code)
+	}
+	time.Sleep(5 * eventsInterval)
+	if patch := do(s, "PATCH", "/Data/a", `{"x":2}`); patch.Code != http.StatusOK {
+		t.Fatalf("PATCH: got %d", patch.Code)
+	}
+	time.Sleep(5 * eventsInterval)
+	cancel()
+	<-finished
+
+	var xs []interface{}
+	for _, e := range strings.Split(strings.TrimSpace(w.Body.String()), "\n\n") {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(e), "data: ")), &m); err != nil {
+			t.Fatalf("event data %q: %v", e, err)
+		}
+		xs = append(xs, m["x"])
+	}
+	if want := []interface{}{1.0, 2.0}; !reflect.DeepEqual(xs, want) {
+		t.Errorf("got events with x=%v, want %v", xs, want)
+	}
+}
+
+func TestStats(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for id, body := range map[string]string{
+		"a": `{"x":1,"y":{"z":10},"g":"odd"}`,
+		"b": `{"x":2,"y":{"z":"ten"},"g":"even"}`,
+		"c": `{"x":6,"g":"even"}`,
+		"d": `{"g":"odd"}`,
+	} {
+		if w := do(s, "PUT", "/Data/"+id, body); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
 		}
 	}
+	w := do(s, "GET", "/Data/_stats?fields=x,y.z,w", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: got %d", w.Code)
+	}
+	want := map[string]interface{}{
+		"count": 4.0,
+		"fields": map[string]interface{}{
+			"x":   map[string]interface{}{"count": 3.0, "min": 1.0, "max": 6.0, "sum": 9.0, "avg": 3.0},
+			"y.z": map[string]interface{}{"count": 1.0, "min": 10.0, "max": 10.0, "sum": 10.0, "avg": 10.0},
+			"w":   map[string]interface{}{"count": 0.0, "sum": 0.0},
+		},
+	}
+	if got := decode(t, w); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	w = do(s, "GET", "/Data/_stats?fields=x&where=g=even", "")
+	x, _ := decode(t, w)["fields"].(map[string]interface{})["x"].(map[string]interface{})
+	if x["sum"] != 8.0 || x["count"] != 2.0 {
+		t.Errorf("where g=even: got %v", x)
+	}
+	if w := do(s, "GET", "/Data/_stats?fields=.x", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid field: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := do(s, "GET", "/Missing/_stats", ""); w.Code != http.StatusNotFound {
+		t.Errorf("missing kind: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestListByID(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, id := range []string{"12", "123", "1234"} {
+		if w := do(s, "PUT", "/Data/"+id, `{"x":1}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	for _, c := range []struct {
+		q    string
+		want []string
+	}{
+		{"where=_id=123", []string{"123"}},
+		{"where=_id=12&where=x=1", []string{"12"}},
+		{"where=_id=12&where=x=2", []string{}},
+		{"where=_id=1", []string{}},
+		{"where=_id=9", []string{}},
+		{"or=_id=12%3B_id=1234", []string{"12", "1234"}},
+	} {
+		if got := listIDs(t, do(s, "GET", "/Data?"+c.q, "")); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.q, got, c.want)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	get := func() map[string]interface{} { return decode(t, do(s, "GET", "/Data/a", "")) }
+	if w := do(s, "PUT", "/Data/a", `{"x":1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if v := get()[versionKey]; v != 1.0 {
+		t.Fatalf("after PUT: got version %v, want 1", v)
+	}
+	for i, c := range []struct {
+		method, body string
+		want         int
+	}{
+		// Writes without a version always succeed.
+		{"PATCH", `{"x":2}`, http.StatusOK},
+		{"PATCH", `{"x":3,"_version":2}`, http.StatusOK},
+		{"PATCH", `{"x":4,"_version":2}`, http.StatusConflict},
+		{"PATCH", `{"$set":{"x":4,"_version":3}}`, http.StatusOK},
+		{"POST", `{"x":5,"_version":4}`, http.StatusOK},
+		{"POST", `{"x":6,"_version":4}`, http.StatusConflict},
+		{"PUT", `{"x":6,"_version":5}`, http.StatusOK},
+		{"PUT", `{"x":7,"_version":"6"}`, http.StatusConflict},
+	} {
+		before := get()
+		w := do(s, c.method, "/Data/a", c.body)
+		if w.Code != c.want {
+			t.Errorf("%d: %s %s: got %d, want %d", i, c.method, c.body, w.Code, c.want)
+			continue
+		}
+		after := get()
+		want := before[versionKey].(float64)
+		if c.want == http.StatusOK {
+			want++
+		}
+		if after[versionKey] != want {
+			t.Errorf("%d: %s %s: got version %v, want %v", i, c.method, c.body, after[versionKey], want)
+		}
+	}
+	if w := do(s, "PUT", "/Data/b", `{"_version":1}`); w.Code != http.StatusConflict {
+		t.Errorf("PUT new with version 1: got %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestDefaultSort(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for id, x := range map[string]string{"a": "2", "b": "3", "c": "1"} {
+		if w := do(s, "PUT", "/Data/"+id, `{"x":`+x+`}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	if got := listIDs(t, do(s, "GET", "/Data", "")); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("unconfigured: got %v", got)
+	}
+	if w := do(s, "PUT", "/_config/Data", `{"sort":"-x"}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT config: got %d", w.Code)
+	}
+	if got := listIDs(t, do(s, "GET", "/Data", "")); !reflect.DeepEqual(got, []string{"b", "a", "c"}) {
+		t.Errorf("default sort: got %v", got)
+	}
+	if got := listIDs(t, do(s, "GET", "/Data?sort=x", "")); !reflect.DeepEqual(got, []string{"c", "a", "b"}) {
+		t.Errorf("explicit sort: got %v", got)
+	}
+	if w := do(s, "PUT", "/_config/Data", `{"sort":"-"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid sort: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.auth = apiKeyAuth{}
+	s.kinds = map[string]bool{}
+
+	preflight := func() *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("OPTIONS", "/Data/a", nil)
+		r.Header.Set("Origin", "http://example.com")
+		r.Header.Set("Access-Control-Request-Method", "PUT")
+		r.Header.Set("Access-Control-Request-Headers", "Content-Type, X-API-Key")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	w := preflight()
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusNoContent)
+	}
+	for h, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Headers": "Content-Type, X-API-Key",
+		"Access-Control-Max-Age":       "",
+	} {
+		if got := w.Header().Get(h); got != want {
+			t.Errorf("%s: got %q, want %q", h, got, want)
+		}
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, "PUT") {
+		t.Errorf("Access-Control-Allow-Methods: got %q, want PUT allowed", got)
+	}
+
+	s.preflightMaxAge = 90 * time.Minute
+	if got := preflight().Header().Get("Access-Control-Max-Age"); got != "5400" {
+		t.Errorf("Access-Control-Max-Age: got %q, want 5400", got)
+	}
+
+	// Other OPTIONS requests aren't preflights.
+	if w := do(s, "OPTIONS", "/Data/a", ""); w.Code == http.StatusNoContent {
+		t.Errorf("OPTIONS without Access-Control-Request-Method: got %d", w.Code)
+	}
+}
+
+func TestImmutable(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/_config/Data", `{"immutable":["ext","a.b","later"]}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT config: got %d", w.Code)
+	}
+	// Immutable fields can be set when an object is created.
+	if w := do(s, "PUT", "/Data/x", `{"ext":"e1","a":{"b":1},"n":1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if w := do(s, "POST", "/Data", `{"ext":"e2"}`); w.Code != http.StatusOK {
+		t.Fatalf("POST: got %d", w.Code)
+	}
+	for _, c := range []struct {
+		method, body string
+		want         int
+	}{
+		{"PATCH", `{"n":2}`, http.StatusOK},
+		{"PATCH", `{"ext":"e1","n":3}`, http.StatusOK},
+		{"PATCH", `{"ext":"changed"}`, http.StatusConflict},
+		{"PATCH", `{"$unset":["ext"]}`, http.StatusConflict},
+		{"PATCH", `{"$set":{"a":{"b":2}}}`, http.StatusConflict},
+		{"PATCH", `{"$set":{"a":{"b":1,"c":2}}}`, http.StatusOK},
+		{"POST", `{"ext":"e1","a":{"b":1}}`, http.StatusOK},
+		{"POST", `{"a":{"b":1}}`, http.StatusConflict},
+		{"PUT", `{"ext":"changed","a":{"b":1}}`, http.StatusConflict},
+		// A field that wasn't set at creation can be set once.
+		{"PATCH", `{"later":1}`, http.StatusOK},
+		{"PATCH", `{"later":2}`, http.StatusConflict},
+	} {
+		w := do(s, c.method, "/Data/x", c.body)
+		if w.Code != c.want {
+			t.Errorf("%s %s: got %d, want %d", c.method, c.body, w.Code, c.want)
+		}
+		if c.want == http.StatusConflict && !strings.Contains(w.Body.String(), "can't be changed") {
+			t.Errorf("%s %s: got message %q", c.method, c.body, w.Body)
+		}
+	}
+	if got := decode(t, do(s, "GET", "/Data/x", ""))["ext"]; got != "e1" {
+		t.Errorf("ext: got %v, want e1", got)
+	}
+	if w := do(s, "PUT", "/_config/Data", `{"immutable":["a..b"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid config: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestListTotalCount(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for i := 0; i < 15; i++ {
+		if w := do(s, "POST", "/Data", `{"x":`+strconv.Itoa(i%3)+`}`); w.Code != http.StatusOK {
+			t.Fatalf("POST: got %d", w.Code)
+		}
+	}
+	for q, want := range map[string]string{
+		"":                   "15",
+		"?where=x=1":         "5",
+		"?where=x!=1&sort=x": "10",
+		"?where=x=3":         "0",
+		"?limit=2":           "15",
+	} {
+		w := do(s, "HEAD", "/Data"+q, "")
+		if w.Code != http.StatusOK {
+			t.Errorf("HEAD %s: got %d", q, w.Code)
+		}
+		if got := w.Header().Get("X-Total-Count"); got != want {
+			t.Errorf("HEAD %s: got X-Total-Count %q, want %q", q, got, want)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("HEAD %s: got a body", q)
+		}
+	}
+	if got := do(s, "GET", "/Data", "").Header().Get("X-Total-Count"); got != "" {
+		t.Errorf("GET: got X-Total-Count %q, want none", got)
+	}
+}
+
+func TestKeyCase(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/Data/a", `{"first_name":"Ann","home_address":{"zip_code":1},"view_count":1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	w := do(s, "GET", "/Data/a?keyCase=camel", "")
+	want := map[string]interface{}{"firstName": "Ann", "homeAddress": map[string]interface{}{"zipCode": 1.0}, "viewCount": 1.0}
+	got := decode(t, w)
+	for k, v := range want {
+		if !reflect.DeepEqual(got[k], v) {
+			t.Errorf("GET: got %s=%v, want %v", k, got[k], v)
+		}
+	}
+	if got[idKey] != "a" {
+		t.Errorf("GET: got _id=%v, want a", got[idKey])
+	}
+
+	// camelCase writes are stored in snake_case.
+	for _, c := range []struct{ method, path, body string }{
+		{"PATCH", "/Data/a?keyCase=camel", `{"lastName":"Bee"}`},
+		{"PATCH", "/Data/a?keyCase=camel", `{"$unset":["homeAddress"]}`},
+		{"POST", "/Data/a/_inc?keyCase=camel", `{"field":"viewCount"}`},
+	} {
+		if w := do(s, c.method, c.path, c.body); w.Code != http.StatusOK {
+			t.Fatalf("%s %s: got %d", c.method, c.body, w.Code)
+		}
+	}
+	stored := decode(t, do(s, "GET", "/Data/a", ""))
+	if _, found := stored["home_address"]; found || stored["last_name"] != "Bee" || stored["view_count"] != 2.0 {
+		t.Errorf("stored: got %v", stored)
+	}
+
+	w = do(s, "GET", "/Data?keyCase=camel&where=lastName=Bee&sort=-viewCount", "")
+	items, _ := decode(t, w)["items"].([]interface{})
+	if len(items) != 1 || items[0].(map[string]interface{})["lastName"] != "Bee" {
+		t.Errorf("list: got %v", items)
+	}
+	if w := do(s, "GET", "/Data/a?keyCase=kebab", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("keyCase=kebab: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestListETag(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, id := range []string{"a", "b", "c"} {
+		if w := do(s, "PUT", "/Data/"+id, `{"x":1}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", path, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	etag := get("/Data", "").Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("got ETag %q, want a weak ETag", etag)
+	}
+	w := get("/Data", etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("unchanged: got %d with %d bytes, want %d", w.Code, w.Body.Len(), http.StatusNotModified)
+	}
+	if w := get("/Data", `"other", `+etag); w.Code != http.StatusNotModified {
+		t.Errorf("one of several: got %d, want %d", w.Code, http.StatusNotModified)
+	}
+	if w := get("/Data?limit=2", etag); w.Code != http.StatusOK {
+		t.Errorf("different query: got %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// Any change to a listed object changes the ETag, even within a second.
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"PATCH", "/Data/b", `{"x":1}`, http.StatusOK},
+		{"DELETE", "/Data/c", "", http.StatusNoContent},
+		{"PUT", "/Data/d", `{"x":1}`, http.StatusOK},
+	} {
+		if w := do(s, c.method, c.path, c.body); w.Code != c.code {
+			t.Fatalf("%s %s: got %d", c.method, c.path, w.Code)
+		}
+		w := get("/Data", etag)
+		if w.Code != http.StatusOK {
+			t.Errorf("after %s %s: got %d, want %d", c.method, c.path, w.Code, http.StatusOK)
+		}
+		etag = w.Header().Get("ETag")
+	}
+
+	// Objects past the page don't affect it.
+	etag = get("/Data?limit=1", "").Header().Get("ETag")
+	if w := do(s, "PATCH", "/Data/b", `{"x":2}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH: got %d", w.Code)
+	}
+	if w := get("/Data?limit=1", etag); w.Code != http.StatusNotModified {
+		t.Errorf("change off the page: got %d, want %d", w.Code, http.StatusNotModified)
+	}
+}
+
+func TestDerived(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/_config/People", `{"derived":{"fullName":"first + \" \" + upper(last)"}}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT config: got %d", w.Code)
+	}
+	w := do(s, "POST", "/People", `{"first":"Ann","last":"Bee","fullName":"ignored"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST: got %d", w.Code)
+	}
+	id := decode(t, w)[idKey].(string)
+	if got := decode(t, do(s, "GET", "/People/"+id, ""))["fullName"]; got != "Ann BEE" {
+		t.Errorf("after POST: got fullName %v, want %q", got, "Ann BEE")
+	}
+	if w := do(s, "PATCH", "/People/"+id, `{"last":"Cee"}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH: got %d", w.Code)
+	}
+	if got := decode(t, do(s, "GET", "/People/"+id, ""))["fullName"]; got != "Ann CEE" {
+		t.Errorf("after PATCH: got fullName %v, want %q", got, "Ann CEE")
+	}
+	if w := do(s, "POST", "/People/"+id, `{"first":"Dee"}`); w.Code != http.StatusOK {
+		t.Fatalf("POST replace: got %d", w.Code)
+	}
+	if got := decode(t, do(s, "GET", "/People/"+id, ""))["fullName"]; got != "Dee " {
+		t.Errorf("after replace: got fullName %v, want %q", got, "Dee ")
+	}
+
+	for _, cfg := range []string{
+		`{"derived":{"fullName":"first +"}}`,
+		`{"derived":{"_full":"first"}}`,
+		`{"derived":{"a.b":"first"}}`,
+	} {
+		if w := do(s, "PUT", "/_config/People", cfg); w.Code != http.StatusBadRequest {
+			t.Errorf("PUT config %s: got %d, want %d", cfg, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for id, body := range map[string]string{
+		"a": `{"status":"open","tags":["x","y"],"n":2}`,
+		"b": `{"status":"closed","tags":["y"],"n":1}`,
+		"c": `{"status":"open","tags":[],"n":2}`,
+		"d": `{"status":null,"n":"2"}`,
+		"e": `{"n":1}`,
+	} {
+		if w := do(s, "PUT", "/Data/"+id, body); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	for _, c := range []struct {
+		q    string
+		want []interface{}
+	}{
+		{"field=status", []interface{}{nil, "closed", "open"}},
+		{"field=tags", []interface{}{"x", "y"}},
+		{"field=n", []interface{}{1.0, 2.0, "2"}},
+		{"field=status&where=n=2", []interface{}{"open"}},
+		{"field=missing", []interface{}{}},
+	} {
+		w := do(s, "GET", "/Data/_distinct?"+c.q, "")
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got %d", c.q, w.Code)
+			continue
+		}
+		if got := decode(t, w)["values"]; !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.q, got, c.want)
+		}
+	}
+	if w := do(s, "GET", "/Data/_distinct", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("no field: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMaxEntity(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.maxEntity = 200
+
+	big := `{"s":"` + strings.Repeat("x", 200) + `"}`
+	w := do(s, "POST", "/Data", big)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("POST: got %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if msg := w.Body.String(); !strings.Contains(msg, "Data object") || !strings.Contains(msg, "at most 200") {
+		t.Errorf("POST: got message %q", msg)
+	}
+
+	// Objects can also grow too large by being patched.
+	if w := do(s, "PUT", "/Data/a", `{"s":"small"}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	for _, c := range []struct{ method, body string }{
+		{"PATCH", big},
+		{"POST", big},
+		{"PUT", big},
+	} {
+		if w := do(s, c.method, "/Data/a", c.body); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: got %d, want %d", c.method, w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+	if got := decode(t, do(s, "GET", "/Data/a", ""))["s"]; got != "small" {
+		t.Errorf("after rejected writes: got s=%v, want small", got)
+	}
+	line := `{"kind":"Data","entity":{"_id":"b","s":"` + strings.Repeat("x", 200) + `"}}`
+	if w := do(s, "POST", "/_import?format=json", line); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("import: got %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestTimeFormat(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	defer func() { nowFunc = time.Now }()
+	nowFunc = func() time.Time { return time.Unix(1420070400, 0) }
+
+	if w := do(s, "PUT", "/Data/a", `{"a":1,"_ttl":60}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	m := decode(t, do(s, "GET", "/Data/a?timeFormat=unix", ""))
+	if m[createdKey] != 1420070400.0 || m[updatedKey] != 1420070400.0 {
+		t.Errorf("unix: got %v, %v", m[createdKey], m[updatedKey])
+	}
+	m = decode(t, do(s, "GET", "/Data/a?timeFormat=iso", ""))
+	if m[createdKey] != "2015-01-01T00:00:00Z" || m[updatedKey] != "2015-01-01T00:00:00Z" {
+		t.Errorf("iso: got %v, %v", m[createdKey], m[updatedKey])
+	}
+	if m[expiresKey] != "2015-01-01T00:01:00Z" {
+		t.Errorf("iso: got %s=%v", expiresKey, m[expiresKey])
+	}
+
+	m = decode(t, do(s, "GET", "/Data?timeFormat=iso", ""))
+	items := m["items"].([]interface{})
+	if got := items[0].(map[string]interface{})[createdKey]; got != "2015-01-01T00:00:00Z" {
+		t.Errorf("list: got %v", got)
+	}
+	m = decode(t, do(s, "GET", "/Data?ids=a&timeFormat=iso", ""))
+	items = m["items"].([]interface{})
+	if got := items[0].(map[string]interface{})[createdKey]; got != "2015-01-01T00:00:00Z" {
+		t.Errorf("ids: got %v", got)
+	}
+	m = decode(t, do(s, "GET", "/Data", ""))
+	items = m["items"].([]interface{})
+	if got := items[0].(map[string]interface{})[createdKey]; got != 1420070400.0 {
+		t.Errorf("default: got %v", got)
+	}
+
+	for _, path := range []string{"/Data/a?timeFormat=rfc", "/Data?timeFormat=rfc"} {
+		if w := do(s, "GET", path, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: got %d, want %d", path, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestKindSeparator(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	// Even without auth, where kinds aren't namespaced, a kind containing the
+	// separator could later be mistaken for another user's kind, so it's
+	// rejected before anything is stored.
+	for _, c := range []struct{ method, path, body string }{
+		{"POST", "/alice--Data", `{"a":1}`},
+		{"PUT", "/alice--Data/a", `{"a":1}`},
+		{"PATCH", "/alice--Data/a", `{"a":1}`},
+		{"GET", "/alice--Data", ""},
+		{"GET", "/alice--Data/a", ""},
+		{"GET", "/alice--Data/_stats", ""},
+		{"DELETE", "/alice--Data?confirm=true", ""},
+		{"POST", "/alice--Data/a/_inc", `{"field":"n","by":1}`},
+	} {
+		if w := do(s, c.method, c.path, c.body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: got %d, want %d", c.method, c.path, w.Code, http.StatusBadRequest)
+		}
+	}
+	s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if strings.Contains(string(name), kindSep) {
+				t.Errorf("bucket %q was created", name)
+			}
+			return nil
+		})
+	})
+}
+
+func TestBatchInsert(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	count := func() int {
+		w := do(s, "GET", "/Data?limit=100", "")
+		if w.Code == http.StatusNotFound {
+			return 0
+		}
+		return len(decode(t, w)["items"].([]interface{}))
+	}
+	results := func(w *httptest.ResponseRecorder) []map[string]interface{} {
+		var rs []map[string]interface{}
+		for _, r := range decode(t, w)["items"].([]interface{}) {
+			rs = append(rs, r.(map[string]interface{}))
+		}
+		return rs
+	}
+	mixed := `[{"a":1},{"_bogus":1},5,{"a":2}]`
+
+	// Atomic batches store nothing if anything is invalid.
+	w := do(s, "POST", "/Data?atomic=true", mixed)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("atomic: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if msg := w.Body.String(); !strings.HasPrefix(msg, "item 1: ") {
+		t.Errorf("atomic: got message %q", msg)
+	}
+	if n := count(); n != 0 {
+		t.Errorf("after atomic: got %d objects, want 0", n)
+	}
+
+	// Otherwise the valid ones are stored, and each is reported.
+	w = do(s, "POST", "/Data", mixed)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("non-atomic: got %d, want %d", w.Code, http.StatusMultiStatus)
+	}
+	rs := results(w)
+	if len(rs) != 4 {
+		t.Fatalf("non-atomic: got %d results, want 4", len(rs))
+	}
+	for i, want := range []float64{200, 400, 400, 200} {
+		if rs[i]["status"] != want {
+			t.Errorf("item %d: got status %v, want %v", i, rs[i]["status"], want)
+		}
+		_, hasID := rs[i][idKey]
+		_, hasErr := rs[i]["error"]
+		if hasID != (want == 200) || hasErr == (want == 200) {
+			t.Errorf("item %d: got %v", i, rs[i])
+		}
+	}
+	if got := decode(t, do(s, "GET", "/Data/"+rs[3][idKey].(string), ""))["a"]; got != 2.0 {
+		t.Errorf("GET stored item: got a=%v, want 2", got)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("after non-atomic: got %d objects, want 2", n)
+	}
+
+	// Batches with no invalid entities are OK either way.
+	for _, path := range []string{"/Data", "/Data?atomic=true"} {
+		w := do(s, "POST", path, `[{"a":3},{"a":4}]`)
+		if w.Code != http.StatusOK {
+			t.Errorf("POST %s: got %d", path, w.Code)
+		} else if rs := results(w); len(rs) != 2 || rs[0]["status"] != 200.0 {
+			t.Errorf("POST %s: got %v", path, rs)
+		}
+	}
+	if n := count(); n != 6 {
+		t.Errorf("got %d objects, want 6", n)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, c := range []struct{ path, body string }{
+		{"/People/a", `{"name":"foo"}`},
+		{"/People/b", `{"name":"bar"}`},
+		{"/Pets/c", `{"name":"foo"}`},
+		{"/_config/Pets", `{"defaults":{"name":"foo"}}`},
+	} {
+		if w := do(s, "PUT", c.path, c.body); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", c.path, w.Code)
+		}
+	}
+	w := do(s, "GET", "/_search?where=name=foo", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: got %d", w.Code)
+	}
+	var got []string
+	for _, it := range decode(t, w)["items"].([]interface{}) {
+		m := it.(map[string]interface{})
+		got = append(got, fmt.Sprintf("%v/%v", m[kindKey], m[idKey]))
+	}
+	if want := []string{"People/a", "Pets/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	items := decode(t, do(s, "GET", "/_search?where=name=foo&limit=1", ""))["items"].([]interface{})
+	if len(items) != 1 {
+		t.Errorf("limit=1: got %d items", len(items))
+	}
+	if got := decode(t, do(s, "GET", "/People/a", ""))[kindKey]; got != nil {
+		t.Errorf("GET: got %s=%v, want none stored", kindKey, got)
+	}
+	if w := do(s, "POST", "/_search", `{}`); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/Data/a", `{"a":1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	bare := decode(t, do(s, "GET", "/Data/a", ""))
+	if bare[idKey] != "a" || bare["a"] != 1.0 {
+		t.Errorf("bare: got %v", bare)
+	}
+	for _, c := range []struct{ method, path, body string }{
+		{"GET", "/Data/a?envelope=true", ""},
+		{"PATCH", "/Data/a?envelope=true", `{"b":2}`},
+		{"POST", "/Data/a?envelope=true", `{"a":1}`},
+		{"PUT", "/Data/b?envelope=true", `{"a":1}`},
+		{"POST", "/Data?envelope=true", `{"a":1}`},
+	} {
+		w := do(s, c.method, c.path, c.body)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s %s: got %d", c.method, c.path, w.Code)
+			continue
+		}
+		m := decode(t, w)
+		item, ok := m["item"].(map[string]interface{})
+		if len(m) != 1 || !ok || item["a"] != 1.0 || item[idKey] == nil {
+			t.Errorf("%s %s: got %v", c.method, c.path, m)
+		}
+	}
+	// Errors and lists aren't enveloped.
+	if w := do(s, "GET", "/Data/missing?envelope=true", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET missing: got %d", w.Code)
+	}
+	if m := decode(t, do(s, "GET", "/Data?envelope=true", "")); m["items"] == nil {
+		t.Errorf("list: got %v", m)
+	}
+}
+
+func TestLargeNumericID(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	// IDs are always strings, however large a number they look like, so
+	// JavaScript clients never lose precision.
+	const id = "9007199254740993"
+	for _, c := range []struct{ method, path, body string }{
+		{"PUT", "/Data/" + id, `{"a":1}`},
+		{"PATCH", "/Data/" + id, `{"a":2}`},
+		{"POST", "/Data/" + id, `{"a":3}`},
+		{"GET", "/Data/" + id, ""},
+	} {
+		if got := decode(t, do(s, c.method, c.path, c.body))[idKey]; got != id {
+			t.Errorf("%s: got %s=%#v, want %q", c.method, idKey, got, id)
+		}
+	}
+	items := decode(t, do(s, "GET", "/Data?where=_id="+id, ""))["items"].([]interface{})
+	if len(items) != 1 || items[0].(map[string]interface{})[idKey] != id {
+		t.Errorf("list: got %v", items)
+	}
+}
+
+func TestGetWhere(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/Data/a", `{"status":"pending","n":1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if w := do(s, "GET", "/Data/a?where=status=ready", ""); w.Code != http.StatusNotFound {
+		t.Errorf("no match: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do(s, "PATCH", "/Data/a", `{"status":"ready"}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH: got %d", w.Code)
+	}
+	for _, q := range []string{"where=status=ready", "where=status=ready&where=n=1", "or=status=done%3Bstatus=ready"} {
+		w := do(s, "GET", "/Data/a?"+q, "")
+		if w.Code != http.StatusOK {
+			t.Errorf("?%s: got %d", q, w.Code)
+		} else if got := decode(t, w)["status"]; got != "ready" {
+			t.Errorf("?%s: got status %v", q, got)
+		}
+	}
+	if w := do(s, "GET", "/Data/a?where=n!=1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("n!=1: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do(s, "GET", "/Data/a?where=bogus", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid where: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMaxFilters(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.maxFilters = 3
+
+	if w := do(s, "PUT", "/Data/a", `{"a":1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if w := do(s, "PUT", "/People/p", `{}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT parent: got %d", w.Code)
+	}
+	// The filter a nested path adds for its parent doesn't count.
+	for _, c := range []struct {
+		query string
+		want  int
+	}{
+		{"where=a=1&where=b=1&where=c=1", http.StatusOK},
+		{"where=a=1&or=b=1%3Bc=1", http.StatusOK},
+		{"where=a=1&where=b=1&where=c=1&where=d=1", http.StatusBadRequest},
+		{"where=a=1&or=b=1%3Bc=1%3Bd=1", http.StatusBadRequest},
+	} {
+		for _, path := range []string{"/Data", "/Data/_stats", "/_search", "/People/p/Data"} {
+			if w := do(s, "GET", path+"?"+c.query, ""); w.Code != c.want {
+				t.Errorf("GET %s?%s: got %d, want %d", path, c.query, w.Code, c.want)
+			}
+		}
+	}
+	w := do(s, "GET", "/Data/a?where=a=1&where=b=1&where=c=1&where=d=1", "")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "at most 3") {
+		t.Errorf("GET entity: got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestListSeesWrites(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.cache = newListCache(10)
+
+	// Every list sees every write that completed before it, with or without
+	// the cache, so there's no need for a stronger consistency option.
+	for i, id := range []string{"a", "b", "c"} {
+		if w := do(s, "PUT", "/Data/"+id, `{"x":1}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+		if got := listIDs(t, do(s, "GET", "/Data?where=x=1", "")); len(got) != i+1 {
+			t.Errorf("after PUT %s: got %v", id, got)
+		}
+	}
+	if w := do(s, "DELETE", "/Data/b", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: got %d", w.Code)
+	}
+	if got := listIDs(t, do(s, "GET", "/Data?where=x=1", "")); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("after DELETE: got %v", got)
+	}
+
+	// Since lists see writes at once, there's nothing for Prefer: wait to
+	// wait for, and it's ignored.
+	if w := do(s, "PUT", "/Data/d", `{"x":1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	r, _ := http.NewRequest("GET", "/Data?where=x=1", nil)
+	r.Header.Set("Prefer", "wait=2")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	s.ServeHTTP(w, r)
+	if got := listIDs(t, w); !reflect.DeepEqual(got, []string{"a", "c", "d"}) {
+		t.Errorf("with Prefer: wait: got %v", got)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("with Prefer: wait: took %v", d)
+	}
+}
+
+func TestFirstLast(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "GET", "/Data/_first", ""); w.Code != http.StatusNotFound {
+		t.Errorf("missing kind: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	for id, body := range map[string]string{
+		"a": `{"score":5,"team":"red"}`,
+		"b": `{"score":9,"team":"blue"}`,
+		"c": `{"score":1,"team":"red"}`,
+		"d": `{"score":7,"team":"blue"}`,
+	} {
+		if w := do(s, "PUT", "/Data/"+id, body); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	for _, c := range []struct {
+		path, want string
+	}{
+		{"/Data/_first", "a"},
+		{"/Data/_last", "d"},
+		{"/Data/_first?sort=score", "c"},
+		{"/Data/_last?sort=score", "b"},
+		{"/Data/_first?sort=-score", "b"},
+		{"/Data/_last?sort=-score", "c"},
+		{"/Data/_first?sort=score&where=team=blue", "d"},
+		{"/Data/_last?where=team=red", "c"},
+		{"/Data/_first?sort=team,-score", "b"},
+	} {
+		w := do(s, "GET", c.path, "")
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: got %d", c.path, w.Code)
+		} else if got := decode(t, w)[idKey]; got != c.want {
+			t.Errorf("GET %s: got %v, want %s", c.path, got, c.want)
+		}
+	}
+	for _, path := range []string{"/Data/_first?where=team=green", "/Data/_last?where=team=green"} {
+		if w := do(s, "GET", path, ""); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: got %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+	if w := do(s, "GET", "/Data/_first?sort=-", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid sort: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDebugEntity(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/Data/a", `{"name":"Ann","address":{"city":"Seattle","geo":{"lat":47}},"tags":["x"],"extra":{},"n":null}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if w := do(s, "GET", "/Data/a?debug=true", ""); w.Code != http.StatusForbidden {
+		t.Errorf("debug off: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	s.debug = true
+	w := do(s, "GET", "/Data/a?debug=true", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: got %d", w.Code)
+	}
+	var got struct {
+		Entity     map[string]interface{}
+		Stored     string
+		Size       int
+		Properties []debugProperty
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Entity["name"] != "Ann" || got.Size != len(got.Stored) || !strings.Contains(got.Stored, `"city":"Seattle"`) {
+		t.Errorf("got %+v", got)
+	}
+	want := []debugProperty{
+		{createdKey, "number", false},
+		{idKey, "string", false},
+		{updatedKey, "number", false},
+		{versionKey, "number", false},
+		{"address.city", "string", false},
+		{"address.geo.lat", "number", false},
+		{"extra", "object", false},
+		{"n", "null", false},
+		{"name", "string", false},
+		{"tags", "array", true},
+	}
+	if !reflect.DeepEqual(got.Properties, want) {
+		t.Errorf("got properties\n%v\nwant\n%v", got.Properties, want)
+	}
+	if w := do(s, "GET", "/Data/missing?debug=true", ""); w.Code != http.StatusNotFound {
+		t.Errorf("missing: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// With auth, only admins may debug, even their own entities.
+	s.auth = apiKeyAuth{"k1": "alice", "k2": "admin"}
+	s.admins = map[string]bool{"admin": true}
+	as := func(key, path string) int {
+		r, _ := http.NewRequest("GET", path, nil)
+		r.Header.Set(apiKeyHeader, key)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	for _, path := range []string{"/Data/a?debug=true", "/Data?debug=true"} {
+		if code := as("k1", path); code != http.StatusForbidden {
+			t.Errorf("GET %s as a user: got %d, want %d", path, code, http.StatusForbidden)
+		}
+		if code := as("k2", path); code == http.StatusForbidden {
+			t.Errorf("GET %s as an admin: got %d", path, code)
+		}
+	}
+}
+
+func TestEndToEnd(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	// Serve the handler the way main does, over a real connection.
+	ts := httptest.NewServer(&logHandler{h: s, logf: func(string, ...interface{}) {}})
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/Data", "application/json", strings.NewReader(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST: got %d, %v", resp.StatusCode, err)
+	}
+	id, _ := created[idKey].(string)
+
+	resp, err = http.Get(ts.URL + "/Data?where=a=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list struct{ Items []map[string]interface{} }
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || len(list.Items) != 1 || list.Items[0][idKey] != id {
+		t.Errorf("list: got %d, %v, %v", resp.StatusCode, list, err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("list: got Content-Type %q", ct)
+	}
+
+	req, _ := http.NewRequest("DELETE", ts.URL+"/Data/"+id, nil)
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE: got %d", resp.StatusCode)
+	}
+	if resp, err = http.Get(ts.URL + "/Data/" + id); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET deleted: got %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestHiddenFields(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/_config/Users", `{"hidden":["passwordHash","secret.key"]}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT config: got %d", w.Code)
+	}
+	if w := do(s, "PUT", "/Users/a", `{"name":"Ann","passwordHash":"xyz","secret":{"key":"k","hint":"h"}}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	} else if strings.Contains(w.Body.String(), "xyz") {
+		t.Errorf("PUT: got %s", w.Body.String())
+	}
+	for _, path := range []string{"/Users/a", "/Users", "/Users?ids=a", "/Users/_first", "/_search?where=name=Ann", "/Users?where=passwordHash=xyz"} {
+		w := do(s, "GET", path, "")
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: got %d", path, w.Code)
+		} else if body := w.Body.String(); strings.Contains(body, "xyz") || strings.Contains(body, `"key"`) || !strings.Contains(body, `"hint"`) {
+			t.Errorf("GET %s: got %s", path, body)
+		}
+	}
+	if got := listIDs(t, do(s, "GET", "/Users?where=passwordHash=nope", "")); len(got) != 0 {
+		t.Errorf("filter on hidden field: got %v", got)
+	}
+	if w := do(s, "PATCH", "/Users/a", `{"name":"Bea"}`); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "xyz") {
+		t.Errorf("PATCH: got %d %s", w.Code, w.Body.String())
+	}
+	for _, path := range []string{"/Users/_distinct?field=passwordHash", "/Users/_distinct?field=secret", "/Users/_stats?fields=secret.key"} {
+		if w := do(s, "GET", path, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: got %d, want %d", path, w.Code, http.StatusBadRequest)
+		}
+	}
+	// Incrementing a hidden field would return its value.
+	for _, field := range []string{"passwordHash", "secret"} {
+		if w := do(s, "POST", "/Users/a/_inc", `{"field":"`+field+`","by":0}`); w.Code != http.StatusBadRequest {
+			t.Errorf("_inc %s: got %d %s, want %d", field, w.Code, w.Body.String(), http.StatusBadRequest)
+		}
+	}
+	if w := do(s, "GET", "/_export", ""); !strings.Contains(w.Body.String(), "xyz") {
+		t.Errorf("export: got %s", w.Body.String())
+	}
+	if w := do(s, "PUT", "/_config/Users", `{"hidden":["_id"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("hidden _id: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRename(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	// Enough objects to need more than one batch.
+	var lines []string
+	for i := 0; i <= rewriteBatchSize; i++ {
+		lines = append(lines, fmt.Sprintf(`{"kind":"Data","entity":{"_id":"%04d","oldName":%d}}`, i, i))
+	}
+	lines = append(lines, `{"kind":"Data","entity":{"_id":"x","other":1}}`)
+	if w := do(s, "POST", "/_import", strings.Join(lines, "\n")); w.Code != http.StatusOK {
+		t.Fatalf("import: got %d %s", w.Code, w.Body.String())
+	}
+	w := do(s, "POST", "/Data/_rename", `{"from":"oldName","to":"newName"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("rename: got %d %s", w.Code, w.Body.String())
+	}
+	if got := decode(t, w)["renamed"]; got != float64(rewriteBatchSize+1) {
+		t.Errorf("renamed: got %v, want %d", got, rewriteBatchSize+1)
+	}
+	for _, id := range []string{"0000", "0007", fmt.Sprintf("%04d", rewriteBatchSize)} {
+		m := decode(t, do(s, "GET", "/Data/"+id, ""))
+		if _, found := m["oldName"]; found || m["newName"] == nil || m[versionKey] != float64(1) {
+			t.Errorf("GET %s: got %v", id, m)
+		}
+	}
+	if m := decode(t, do(s, "GET", "/Data/x", "")); m["other"] != float64(1) || m[versionKey] != nil {
+		t.Errorf("GET x: got %v", m)
+	}
+
+	// Renaming again changes nothing.
+	if got := decode(t, do(s, "POST", "/Data/_rename", `{"from":"oldName","to":"newName"}`))["renamed"]; got != float64(0) {
+		t.Errorf("rename again: got %v, want 0", got)
+	}
+
+	// Nested fields can be renamed, but not onto a field that's already set.
+	if w := do(s, "PUT", "/Data/x", `{"a":{"b":1},"c":2}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if w := do(s, "POST", "/Data/_rename", `{"from":"a.b","to":"c"}`); w.Code != http.StatusConflict {
+		t.Errorf("conflict: got %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := do(s, "POST", "/Data/_rename", `{"from":"a.b","to":"d.e"}`); w.Code != http.StatusOK {
+		t.Errorf("nested: got %d %s", w.Code, w.Body.String())
+	}
+	if m := decode(t, do(s, "GET", "/Data/x", "")); !reflect.DeepEqual(m["a"], map[string]interface{}{}) || !reflect.DeepEqual(m["d"], map[string]interface{}{"e": float64(1)}) {
+		t.Errorf("GET x: got %v", m)
+	}
+
+	for _, body := range []string{`{"from":"a","to":"a"}`, `{"from":"a","to":"a.b"}`, `{"from":"_id","to":"id"}`, `{"from":"a"}`, `nope`} {
+		if w := do(s, "POST", "/Data/_rename", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	if w := do(s, "POST", "/Missing/_rename", `{"from":"a","to":"b"}`); w.Code != http.StatusNotFound {
+		t.Errorf("missing kind: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do(s, "GET", "/Data/_rename", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestDropField(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for id, body := range map[string]string{
+		"a": `{"obsolete":1,"keep":1}`,
+		"b": `{"obsolete":null}`,
+		"c": `{"keep":3}`,
+		"d": `{"old":{"obsolete":1,"keep":1}}`,
+	} {
+		if w := do(s, "PUT", "/Data/"+id, body); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", id, w.Code)
+		}
+	}
+	w := do(s, "POST", "/Data/_dropField", `{"field":"obsolete"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("dropField: got %d %s", w.Code, w.Body.String())
+	}
+	if got := decode(t, w)["dropped"]; got != float64(2) {
+		t.Errorf("dropped: got %v, want 2", got)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		m := decode(t, do(s, "GET", "/Data/"+id, ""))
+		if _, found := m["obsolete"]; found {
+			t.Errorf("GET %s: got %v", id, m)
+		}
+	}
+	if m := decode(t, do(s, "GET", "/Data/a", "")); m["keep"] != float64(1) || m[versionKey] != float64(2) {
+		t.Errorf("GET a: got %v", m)
+	}
+	if m := decode(t, do(s, "GET", "/Data/c", "")); m[versionKey] != float64(1) {
+		t.Errorf("GET c: got %v", m)
+	}
+	if got := listIDs(t, do(s, "GET", "/Data?where=obsolete=1", "")); len(got) != 0 {
+		t.Errorf("list: got %v", got)
+	}
+
+	if w := do(s, "POST", "/Data/_dropField", `{"field":"old.obsolete"}`); w.Code != http.StatusOK || decode(t, w)["dropped"] != float64(1) {
+		t.Errorf("nested: got %d %s", w.Code, w.Body.String())
+	}
+	if m := decode(t, do(s, "GET", "/Data/d", "")); !reflect.DeepEqual(m["old"], map[string]interface{}{"keep": float64(1)}) {
+		t.Errorf("GET d: got %v", m)
+	}
+
+	if w := do(s, "PUT", "/_config/Data", `{"immutable":["keep"]}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT config: got %d", w.Code)
+	}
+	if w := do(s, "POST", "/Data/_dropField", `{"field":"keep"}`); w.Code != http.StatusConflict {
+		t.Errorf("immutable: got %d, want %d", w.Code, http.StatusConflict)
+	}
+	for _, body := range []string{`{"field":"_id"}`, `{"field":""}`, `{"field":"a..b"}`, `nope`} {
+		if w := do(s, "POST", "/Data/_dropField", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestMoneyFields(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/_config/Items", `{"money":["price","cost.total"]}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT config: got %d", w.Code)
+	}
+	w := do(s, "PUT", "/Items/a", `{"price":9.99,"cost":{"total":0.1}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if m := decode(t, w); m["price"] != 9.99 {
+		t.Errorf("PUT: got %v", m)
+	}
+	if w := do(s, "GET", "/_export", ""); !strings.Contains(w.Body.String(), `"price":999`) || !strings.Contains(w.Body.String(), `"total":10`) {
+		t.Errorf("stored: got %s", w.Body.String())
+	}
+	if m := decode(t, do(s, "GET", "/Items/a", "")); m["price"] != 9.99 || !reflect.DeepEqual(m["cost"], map[string]interface{}{"total": 0.1}) {
+		t.Errorf("GET: got %v", m)
+	}
+	if got := listIDs(t, do(s, "GET", "/Items?where=price=9.99", "")); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("list: got %v", got)
+	}
+	if w := do(s, "GET", "/Items/_first?where=price=9.99", ""); w.Code != http.StatusOK || decode(t, w)["price"] != 9.99 {
+		t.Errorf("first: got %d %s", w.Code, w.Body.String())
+	}
+
+	// Patches see and change decimals, too.
+	r, _ := http.NewRequest("PATCH", "/Items/a", strings.NewReader(`{"price":10.5,"cost":{"total":0.1}}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Prefer", "return=diff")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH: got %d", w.Code)
+	}
+	changed, _ := decode(t, w)["changed"].(map[string]interface{})
+	if changed["price"] != 10.5 || changed["cost"] != nil {
+		t.Errorf("PATCH: got changed %v", changed)
+	}
+	if w := do(s, "PATCH", "/Items/a", `{"$inc":{"price":0.01}}`); w.Code != http.StatusOK || decode(t, w)["price"] != 10.51 {
+		t.Errorf("$inc: got %d %s", w.Code, w.Body.String())
+	}
+	if w := do(s, "PUT", "/Items/b", `{"price":1.49}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT b: got %d", w.Code)
+	}
+	stats := decode(t, do(s, "GET", "/Items/_stats?fields=price", ""))["fields"].(map[string]interface{})["price"].(map[string]interface{})
+	if stats["sum"] != float64(12) || stats["min"] != 1.49 || stats["avg"] != float64(6) {
+		t.Errorf("stats: got %v", stats)
+	}
+	// With one value, the min and max are the same, and each converted once.
+	stats = decode(t, do(s, "GET", "/Items/_stats?fields=price&where=price=1.49", ""))["fields"].(map[string]interface{})["price"].(map[string]interface{})
+	if stats["min"] != 1.49 || stats["max"] != 1.49 || stats["sum"] != 1.49 {
+		t.Errorf("stats of one: got %v", stats)
+	}
+	if got := decode(t, do(s, "GET", "/Items/_distinct?field=price", ""))["values"]; !reflect.DeepEqual(got, []interface{}{1.49, 10.51}) {
+		t.Errorf("distinct: got %v", got)
+	}
+
+	if w := do(s, "PUT", "/Items/c", `{"price":"free"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("non-number: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := do(s, "PUT", "/_config/Items", `{"money":["_id"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("money _id: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// Renames move decimals into and out of money fields.
+	if w := do(s, "PUT", "/Items/e", `{"cost":2.5}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT e: got %d", w.Code)
+	}
+	if w := do(s, "POST", "/Items/_rename", `{"from":"price","to":"oldPrice"}`); w.Code != http.StatusOK {
+		t.Fatalf("rename from money: got %d %s", w.Code, w.Body.String())
+	}
+	if m := decode(t, do(s, "GET", "/Items/b", "")); m["oldPrice"] != 1.49 {
+		t.Errorf("rename from money: got %v", m)
+	}
+	if w := do(s, "POST", "/Items/_rename", `{"from":"cost","to":"price"}`); w.Code != http.StatusConflict {
+		t.Errorf("rename non-number to money: got %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := do(s, "DELETE", "/Items/a", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE a: got %d", w.Code)
+	}
+	if w := do(s, "POST", "/Items/_rename", `{"from":"cost","to":"price"}`); w.Code != http.StatusOK {
+		t.Fatalf("rename to money: got %d %s", w.Code, w.Body.String())
+	}
+	if m := decode(t, do(s, "GET", "/Items/e", "")); m["price"] != 2.5 {
+		t.Errorf("rename to money: got %v", m)
+	}
+
+	// Derived fields see money fields as decimals.
+	if w := do(s, "PUT", "/_config/Items", `{"money":["price"],"derived":{"label":"\"$\" + price"}}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT derived config: got %d %s", w.Code, w.Body.String())
+	}
+	if m := decode(t, do(s, "PUT", "/Items/d", `{"price":9.99}`)); m["label"] != "$9.99" {
+		t.Errorf("derived PUT: got %v", m)
+	}
+	if m := decode(t, do(s, "PATCH", "/Items/d", `{"price":1.25}`)); m["label"] != "$1.25" {
+		t.Errorf("derived PATCH: got %v", m)
+	}
+	if w := do(s, "PUT", "/_config/Items", `{"money":["price"],"derived":{"price":"\"free\""}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("derived money: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestListAnyField(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	// With no indexes, every field, however deep, can be filtered and
+	// sorted on without being configured first.
+	for id, body := range map[string]string{
+		"a": `{"rarely":{"used":2},"tag":"x"}`,
+		"b": `{"rarely":{"used":1},"tag":"x"}`,
+		"c": `{"tag":"y"}`,
+	} {
+		if w := do(s, "PUT", "/Data/"+id, body); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", id, w.Code)
+		}
+	}
+	if got := listIDs(t, do(s, "GET", "/Data?where=tag=x&sort=rarely.used", "")); !reflect.DeepEqual(got, []string{"b", "a"}) {
+		t.Errorf("got %v, want [b a]", got)
+	}
+	if got := listIDs(t, do(s, "GET", "/Data?where=rarely.used=2", "")); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("got %v, want [a]", got)
+	}
+}
+
+func TestListContains(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for id, body := range map[string]string{
+		"a": `{"title":"first draft"}`,
+		"b": `{"title":"final"}`,
+		"c": `{"title":["notes","redrafted"]}`,
+		"d": `{"title":7}`,
+		"e": `{"other":"draft"}`,
+	} {
+		if w := do(s, "PUT", "/Data/"+id, body); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", id, w.Code)
+		}
+	}
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{"contains=title:draft", []string{"a", "c"}},
+		{"contains=title:Draft", []string{}},
+		{"contains=title:draft&contains=title:first", []string{"a"}},
+		{"contains=title:fi&where=_id!=a", []string{"b"}},
+		{"contains=title:st%20dr", []string{"a"}},
+	} {
+		if got := listIDs(t, do(s, "GET", "/Data?"+c.query, "")); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.query, got, c.want)
+		}
+	}
+	for _, c := range []string{"title", "title:", ":draft", "a..b:draft"} {
+		if w := do(s, "GET", "/Data?contains="+c, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("contains=%s: got %d, want %d", c, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestListKinds(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if got := decode(t, do(s, "GET", "/_kinds", ""))["kinds"]; !reflect.DeepEqual(got, []interface{}{}) {
+		t.Errorf("no kinds: got %v", got)
+	}
+	for _, path := range []string{"/Posts/p", "/Data/a", "/_config/Data", "/_private/x"} {
+		if w := do(s, "PUT", path, `{}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", path, w.Code)
+		}
+	}
+	want := []interface{}{"Data", "Posts"}
+	if got := decode(t, do(s, "GET", "/_kinds", ""))["kinds"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if w := do(s, "POST", "/_kinds", `{}`); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestNoContent(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	// An object with no fields of its own is still written out.
+	if w := do(s, "PUT", "/Data/a", `{}`); w.Code != http.StatusOK || decode(t, w)[idKey] != "a" {
+		t.Errorf("PUT: got %d %q", w.Code, w.Body.String())
+	}
+	if w := do(s, "GET", "/Data/a", ""); w.Code != http.StatusOK || decode(t, w)[idKey] != "a" {
+		t.Errorf("GET: got %d %q", w.Code, w.Body.String())
+	}
+	if w := do(s, "HEAD", "/Data/a", ""); w.Code != http.StatusOK || w.Header().Get("Content-Type") == "" {
+		t.Errorf("HEAD: got %d %v", w.Code, w.Header())
+	}
+
+	// A request with nothing to return says so.
+	w := do(s, "DELETE", "/Data/a", "")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("DELETE: got %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w.Body.Len() != 0 || w.Header().Get("Content-Type") != "" {
+		t.Errorf("DELETE: got body %q, Content-Type %q", w.Body.String(), w.Header().Get("Content-Type"))
+	}
+}
+
+func TestInsertGivenID(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	w := do(s, "POST", "/Data", `{"_id":"offline-1","a":1}`)
+	if w.Code != http.StatusOK || decode(t, w)[idKey] != "offline-1" {
+		t.Fatalf("POST: got %d %s", w.Code, w.Body.String())
+	}
+	if got := decode(t, do(s, "GET", "/Data/offline-1", ""))["a"]; got != float64(1) {
+		t.Errorf("GET: got a=%v, want 1", got)
+	}
+
+	// Creating it again conflicts, and leaves it alone.
+	if w := do(s, "POST", "/Data", `{"_id":"offline-1","a":2}`); w.Code != http.StatusConflict {
+		t.Errorf("POST again: got %d, want %d", w.Code, http.StatusConflict)
+	}
+	if got := decode(t, do(s, "GET", "/Data/offline-1", ""))["a"]; got != float64(1) {
+		t.Errorf("GET: got a=%v, want 1", got)
+	}
+
+	// Whole numbers are used as strings, without losing precision.
+	if got := decode(t, do(s, "POST", "/Data", `{"_id":9007199254740993}`))[idKey]; got != "9007199254740993" {
+		t.Errorf("numeric ID: got %#v", got)
+	}
+
+	// An expired object's ID can be used again.
+	if w := do(s, "POST", "/Data", `{"_id":"gone","_ttl":0}`); w.Code != http.StatusOK {
+		t.Fatalf("POST expiring: got %d", w.Code)
+	}
+	if w := do(s, "POST", "/Data", `{"_id":"gone"}`); w.Code != http.StatusOK {
+		t.Errorf("POST over expired: got %d, want %d", w.Code, http.StatusOK)
+	}
+
+	for _, id := range []string{`""`, `"_first"`, `"a/b"`, `1.5`, `-1`, `true`, `{}`} {
+		if w := do(s, "POST", "/Data", `{"_id":`+id+`}`); w.Code != http.StatusBadRequest {
+			t.Errorf("_id %s: got %d, want %d", id, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Items of a batch conflict one at a time.
+	w = do(s, "POST", "/Data", `[{"_id":"offline-2"},{"_id":"offline-1"}]`)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("batch: got %d", w.Code)
+	}
+	var got struct{ Items []batchResult }
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Items) != 2 || got.Items[0].ID != "offline-2" || got.Items[1].Status != http.StatusConflict {
+		t.Errorf("batch: got %+v", got.Items)
+	}
+}
+
+func TestPretty(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/Data/a", `{"a":{"b":1}}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	} else if strings.Contains(strings.TrimSpace(w.Body.String()), "\n") {
+		t.Errorf("PUT: got %q, want compact", w.Body.String())
+	}
+	for _, path := range []string{"/Data/a?pretty=true", "/Data?pretty=true", "/Data/_first?pretty=true&envelope=true"} {
+		w := do(s, "GET", path, "")
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: got %d", path, w.Code)
+		}
+		if body := w.Body.String(); !strings.HasPrefix(body, "{\n  \"") || !strings.Contains(body, "\n    ") {
+			t.Errorf("GET %s: got %q, want indented", path, body)
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Errorf("GET %s: %v", path, err)
+		}
+	}
+	if w := do(s, "GET", "/Data?pretty=false", ""); strings.Contains(strings.TrimSpace(w.Body.String()), "\n") {
+		t.Errorf("pretty=false: got %q, want compact", w.Body.String())
+	}
+
+	// Errors and empty responses are left alone.
+	if w := do(s, "GET", "/Data/missing?pretty=true", ""); w.Code != http.StatusNotFound {
+		t.Errorf("missing: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do(s, "DELETE", "/Data/a?pretty=true", ""); w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("DELETE: got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestListIDRange(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, id := range []string{"099", "100", "150", "199", "200", "250"} {
+		if w := do(s, "PUT", "/Data/"+id, `{"odd":`+strconv.FormatBool(id[2]%2 == 1)+`}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", id, w.Code)
+		}
+	}
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{"idFrom=100&idTo=200", []string{"100", "150", "199"}},
+		{"idFrom=100", []string{"100", "150", "199", "200", "250"}},
+		{"idTo=150", []string{"099", "100"}},
+		{"idFrom=1&idTo=2", []string{"100", "150", "199"}},
+		{"idFrom=100&idTo=200&where=odd=true", []string{"199"}},
+		{"idFrom=100&idTo=200&sort=-_id", []string{"199", "150", "100"}},
+		{"idFrom=200&idTo=100", []string{}},
+	} {
+		if got := listIDs(t, do(s, "GET", "/Data?"+c.query, "")); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.query, got, c.want)
+		}
+	}
+
+	// IDs compare as strings, so numbers only sort by value if they're
+	// padded to the same width.
+	if w := do(s, "PUT", "/Data/1000", `{}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if got := listIDs(t, do(s, "GET", "/Data?idFrom=100&idTo=150", "")); !reflect.DeepEqual(got, []string{"100", "1000"}) {
+		t.Errorf("got %v, want [100 1000]", got)
+	}
+
+	// Ranges page like any other filter.
+	w := do(s, "GET", "/Data?idFrom=100&idTo=200&limit=2", "")
+	if got := listIDs(t, w); !reflect.DeepEqual(got, []string{"100", "1000"}) {
+		t.Errorf("page 1: got %v", got)
+	}
+	next := decode(t, w)["nextStartToken"].(string)
+	if got := listIDs(t, do(s, "GET", "/Data?idFrom=100&idTo=200&limit=2&start="+next, "")); !reflect.DeepEqual(got, []string{"150", "199"}) {
+		t.Errorf("page 2: got %v", got)
+	}
+}
+
+func TestTrailingData(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/Data/a", `{"a":1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	for _, body := range []string{`{"a":1} x`, `{"a":1}{"b":2}`, `{"a":1}]`, `null`} {
+		for _, req := range []struct{ method, path string }{
+			{"POST", "/Data"},
+			{"PUT", "/Data/a"},
+			{"PATCH", "/Data/a"},
+		} {
+			if w := do(s, req.method, req.path, body); w.Code != http.StatusBadRequest {
+				t.Errorf("%s %s %q: got %d, want %d", req.method, req.path, body, w.Code, http.StatusBadRequest)
+			}
+		}
+	}
+	// Trailing whitespace is fine.
+	if w := do(s, "POST", "/Data", "{\"a\":1}\n\t "); w.Code != http.StatusOK {
+		t.Errorf("trailing whitespace: got %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestInsertNDJSON(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	post := func(body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "/Data", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-ndjson")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := post("{\"_id\":\"a\",\"n\":1}\n{\"_id\":\"b\",\"n\":2}\n\n{\"_id\":\"c\",\"n\":3}\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST: got %d %s", w.Code, w.Body.String())
+	}
+	var got struct{ Items []batchResult }
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Items) != 3 {
+		t.Fatalf("got %d results, want 3: %s", len(got.Items), w.Body.String())
+	}
+	if ids := listIDs(t, do(s, "GET", "/Data", "")); !reflect.DeepEqual(ids, []string{"a", "b", "c"}) {
+		t.Errorf("listed %v", ids)
+	}
+
+	// A bad line rejects the whole body.
+	if w := post("{\"_id\":\"d\"}\n{\"_id\":\n"); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "line 2") {
+		t.Errorf("bad line: got %d %s", w.Code, w.Body.String())
+	}
+	if w := do(s, "GET", "/Data/d", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET d: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// Only collections take NDJSON.
+	r, _ := http.NewRequest("PUT", "/Data/a", strings.NewReader(`{"n":4}`))
+	r.Header.Set("Content-Type", "application/x-ndjson")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("PUT: got %d, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestUniqueFields(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/_config/User", `{"unique":["_id"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("unique _id: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := do(s, "PUT", "/_config/User", `{"unique":["email"]}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT config: got %d %s", w.Code, w.Body.String())
+	}
+	if w := do(s, "PUT", "/User/a", `{"email":"a@example.com"}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT a: got %d %s", w.Code, w.Body.String())
+	}
+
+	// A duplicate is rejected, saying what it duplicates.
+	w := do(s, "POST", "/User", `{"email":"a@example.com"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("duplicate: got %d, want %d", w.Code, http.StatusConflict)
+	}
+	for _, want := range []string{"email", `"a@example.com"`, `"a"`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("duplicate: got %q, want it to mention %s", w.Body.String(), want)
+		}
+	}
+	// A distinct value, or none, is fine.
+	for _, body := range []string{`{"email":"b@example.com"}`, `{}`, `{}`, `{"email":null}`} {
+		if w := do(s, "POST", "/User", body); w.Code != http.StatusOK {
+			t.Errorf("POST %s: got %d %s", body, w.Code, w.Body.String())
+		}
+	}
+	if w := do(s, "PUT", "/User/b", `{"email":"c@example.com"}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT b: got %d %s", w.Code, w.Body.String())
+	}
+
+	// Updates are checked too, but an object doesn't conflict with itself.
+	if w := do(s, "PATCH", "/User/b", `{"email":"a@example.com"}`); w.Code != http.StatusConflict {
+		t.Errorf("PATCH to duplicate: got %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := do(s, "PUT", "/User/b", `{"email":"a@example.com"}`); w.Code != http.StatusConflict {
+		t.Errorf("PUT to duplicate: got %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := do(s, "PATCH", "/User/a", `{"name":"A"}`); w.Code != http.StatusOK {
+		t.Errorf("PATCH a: got %d %s", w.Code, w.Body.String())
+	}
+
+	// Changing or deleting an object frees its values.
+	if w := do(s, "PATCH", "/User/a", `{"email":"d@example.com"}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH a: got %d %s", w.Code, w.Body.String())
+	}
+	if w := do(s, "PATCH", "/User/b", `{"email":"a@example.com"}`); w.Code != http.StatusOK {
+		t.Errorf("PATCH b to a's old value: got %d %s", w.Code, w.Body.String())
+	}
+	do(s, "DELETE", "/User/a", "")
+	if w := do(s, "POST", "/User", `{"email":"d@example.com"}`); w.Code != http.StatusOK {
+		t.Errorf("POST deleted value: got %d %s", w.Code, w.Body.String())
+	}
+
+	// Objects of a batch can conflict with each other.
+	w = do(s, "POST", "/User", `[{"email":"e@example.com"},{"email":"e@example.com"}]`)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("batch: got %d %s", w.Code, w.Body.String())
+	}
+	var got struct{ Items []batchResult }
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Items) != 2 || got.Items[0].Status != http.StatusOK || got.Items[1].Status != http.StatusConflict {
+		t.Errorf("batch: got %s", w.Body.String())
+	}
+
+	// Renames claim the values they move into unique fields, and free those
+	// they move out.
+	if w := do(s, "PUT", "/User/f", `{"mail":"f@example.com","old":"a@example.com"}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT f: got %d %s", w.Code, w.Body.String())
+	}
+	if w := do(s, "POST", "/User/_rename", `{"from":"old","to":"email"}`); w.Code != http.StatusConflict {
+		t.Errorf("rename to duplicate: got %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := do(s, "POST", "/User/_rename", `{"from":"mail","to":"email"}`); w.Code != http.StatusOK {
+		t.Fatalf("rename: got %d %s", w.Code, w.Body.String())
+	}
+	if w := do(s, "POST", "/User", `{"email":"f@example.com"}`); w.Code != http.StatusConflict {
+		t.Errorf("POST renamed value: got %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := do(s, "POST", "/User/_rename", `{"from":"email","to":"mail"}`); w.Code != http.StatusOK {
+		t.Fatalf("rename back: got %d %s", w.Code, w.Body.String())
+	}
+	if w := do(s, "POST", "/User", `{"email":"f@example.com"}`); w.Code != http.StatusOK {
+		t.Errorf("POST value renamed away: got %d %s", w.Code, w.Body.String())
+	}
+	// Objects of the same batch of a rename can conflict with each other.
+	for _, id := range []string{"g", "h"} {
+		if w := do(s, "PUT", "/User/"+id, `{"other":"g@example.com"}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d %s", id, w.Code, w.Body.String())
+		}
+	}
+	if w := do(s, "POST", "/User/_rename", `{"from":"other","to":"email"}`); w.Code != http.StatusConflict {
+		t.Errorf("rename to each other's values: got %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	if w := do(s, "GET", "/_unique", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET index: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	entry := encodeKey(uniqueKind, "User\x00email\x00"+`"f@example.com"`)
+	if w := do(s, "GET", "/_key/"+entry, ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET index entry by key: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// The index isn't exported, so exports can be imported again.
+	w = do(s, "GET", "/_export", "")
+	if strings.Contains(w.Body.String(), uniqueKind) {
+		t.Errorf("export: got %s", w.Body.String())
+	}
+	s2, done2 := newTestServer(t)
+	defer done2()
+	if w := do(s2, "POST", "/_import", w.Body.String()); w.Code != http.StatusOK {
+		t.Errorf("import: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMetaOnly(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, id := range []string{"a", "b"} {
+		if w := do(s, "PUT", "/Data/"+id, `{"name":"x","nested":{"n":1}}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", id, w.Code)
+		}
+	}
+	check := func(name string, m map[string]interface{}) {
+		var keys []string
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if want := []string{createdKey, idKey, kindKey, updatedKey}; !reflect.DeepEqual(keys, want) {
+			t.Errorf("%s: got fields %v, want %v", name, keys, want)
+		}
+		if m[kindKey] != "Data" {
+			t.Errorf("%s: got %s=%v, want Data", name, kindKey, m[kindKey])
+		}
+	}
+
+	check("GET", decode(t, do(s, "GET", "/Data/a?metaOnly=true", "")))
+	for _, path := range []string{"/Data?metaOnly=true", "/Data?ids=a,b&metaOnly=true"} {
+		items, _ := decode(t, do(s, "GET", path, ""))["items"].([]interface{})
+		if len(items) != 2 {
+			t.Fatalf("%s: got %d items, want 2", path, len(items))
+		}
+		for _, it := range items {
+			check(path, it.(map[string]interface{}))
+		}
+	}
+	// Without metaOnly, objects are whole.
+	if got := decode(t, do(s, "GET", "/Data/a", ""))["name"]; got != "x" {
+		t.Errorf("GET: got name=%v, want x", got)
+	}
+}
+
+func TestKindInBody(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	// A body that says it's of another kind is rejected, however it's
+	// written.
+	if w := do(s, "PUT", "/People/a", `{"name":"a"}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	for _, c := range []struct{ method, path, body string }{
+		{"POST", "/People", `{"_kind":"Pets"}`},
+		{"POST", "/People", `{"_kind":1}`},
+		{"PUT", "/People/a", `{"_kind":"Pets"}`},
+		{"PUT", "/People/b", `{"_kind":"Pets"}`},
+		{"PATCH", "/People/a", `{"_kind":"Pets"}`},
+		{"PATCH", "/People/a", `{"$set":{"_kind":"Pets"}}`},
+	} {
+		w := do(s, c.method, c.path, c.body)
+		if w.Code != http.StatusConflict {
+			t.Errorf("%s %s %s: got %d, want %d", c.method, c.path, c.body, w.Code, http.StatusConflict)
+		} else if !strings.Contains(w.Body.String(), `"People"`) {
+			t.Errorf("%s %s %s: got %q, want it to name the kind", c.method, c.path, c.body, w.Body.String())
+		}
+	}
+	if w := do(s, "GET", "/People/b", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET b: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// The same kind is fine, and isn't stored.
+	for _, c := range []struct{ method, path string }{
+		{"POST", "/People"},
+		{"PUT", "/People/a"},
+		{"PATCH", "/People/a"},
+	} {
+		w := do(s, c.method, c.path, `{"_kind":"People","name":"a"}`)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s %s: got %d %s", c.method, c.path, w.Code, w.Body.String())
+		} else if got, found := decode(t, w)[kindKey]; found {
+			t.Errorf("%s %s: got %s=%v, want none stored", c.method, c.path, kindKey, got)
+		}
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	// Big enough that net/http wouldn't work out the length itself.
+	big := strings.Repeat("x", 10000)
+	if w := do(s, "PUT", "/Data/a", `{"big":"`+big+`","nested":{"n":1}}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	for _, q := range []string{"", "?pretty=true"} {
+		resp, err := http.Get(ts.URL + "/Data/a" + q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("GET %s: %v", q, err)
+		}
+		if got, want := resp.Header.Get("Content-Length"), strconv.Itoa(len(body)); got != want {
+			t.Errorf("GET %s: got Content-Length %q, want %q", q, got, want)
+		}
+	}
+
+	resp, err := http.Head(ts.URL + "/Data/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	get := do(s, "GET", "/Data/a", "")
+	if got, want := resp.Header.Get("Content-Length"), strconv.Itoa(get.Body.Len()); got != want {
+		t.Errorf("HEAD: got Content-Length %q, want the GET's %q", got, want)
+	}
+	if w := do(s, "HEAD", "/Data/a", ""); w.Body.Len() != 0 {
+		t.Errorf("HEAD: got body %q", w.Body.String())
+	}
+}
+
+func TestRecent(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	defer func() { nowFunc = time.Now }()
+
+	// Objects are created in one order, then updated in another.
+	now := int64(1420070400)
+	put := func(id string) {
+		now++
+		nowFunc = func() time.Time { return time.Unix(now, 0) }
+		if w := do(s, "PUT", "/Data/"+id, `{"x":1}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", id, w.Code)
+		}
+	}
+	for _, id := range []string{"a", "b", "c", "d"} {
+		put(id)
+	}
+	for _, id := range []string{"c", "a"} {
+		put(id)
+	}
+
+	if got, want := listIDs(t, do(s, "GET", "/Data/_recent", "")), []string{"a", "c", "d", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	w := do(s, "GET", "/Data/_recent?limit=2", "")
+	if got, want := listIDs(t, w), []string{"a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("limit=2: got %v, want %v", got, want)
+	}
+	// The next page carries on from there.
+	next, _ := decode(t, w)["nextStartToken"].(string)
+	if next == "" {
+		t.Fatalf("limit=2: no nextStartToken in %s", w.Body.String())
+	}
+	if got, want := listIDs(t, do(s, "GET", "/Data/_recent?limit=2&start="+next, "")), []string{"d", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("next page: got %v, want %v", got, want)
+	}
+	// Filters work as for lists, but the sort can't be changed.
+	put("e")
+	do(s, "PATCH", "/Data/e", `{"x":2}`)
+	if got, want := listIDs(t, do(s, "GET", "/Data/_recent?where=x=1&limit=1", "")), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("where: got %v, want %v", got, want)
+	}
+	if w := do(s, "GET", "/Data/_recent?sort=x", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("sort: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := do(s, "POST", "/Data/_recent", `{}`); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestReadOnlyKind(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/Data/a", `{"a":1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if w := do(s, "PUT", "/_config/Data", `{"readOnly":true}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT config: got %d", w.Code)
+	}
+	for _, c := range []struct{ method, path, body string }{
+		{"POST", "/Data", `{"a":2}`},
+		{"POST", "/Data", `[{"a":2}]`},
+		{"PUT", "/Data/a", `{"a":2}`},
+		{"PUT", "/Data/b", `{"a":2}`},
+		{"PATCH", "/Data/a", `{"a":2}`},
+		{"POST", "/Data/a/_inc", `{"field":"a"}`},
+		{"POST", "/Data/_rename", `{"from":"a","to":"b"}`},
+		{"DELETE", "/Data/a", ""},
+		{"DELETE", "/Data?confirm=true", ""},
+	} {
+		if w := do(s, c.method, c.path, c.body); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: got %d, want %d", c.method, c.path, w.Code, http.StatusForbidden)
+		}
+	}
+	// Reads work, and nothing was written.
+	if got := decode(t, do(s, "GET", "/Data/a", ""))["a"]; got != 1.0 {
+		t.Errorf("GET: got a=%v, want 1", got)
+	}
+	if got := listIDs(t, do(s, "GET", "/Data", "")); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("list: got %v", got)
+	}
+	if w := do(s, "GET", "/Data/_stats", ""); w.Code != http.StatusOK {
+		t.Errorf("stats: got %d", w.Code)
+	}
+	// Imports are how a read-only kind is populated.
+	r, _ := http.NewRequest("POST", "/_import", strings.NewReader(`{"kind":"Data","entity":{"_id":"c","a":3}}`+"\n"))
+	r.Header.Set("Content-Type", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("import: got %d %s", w.Code, w.Body.String())
+	}
+	if got := decode(t, do(s, "GET", "/Data/c", ""))["a"]; got != 3.0 {
+		t.Errorf("GET imported: got a=%v, want 3", got)
+	}
+	// Other kinds can still be written, and the kind can be made writable
+	// again.
+	if w := do(s, "PUT", "/Other/a", `{"a":1}`); w.Code != http.StatusOK {
+		t.Errorf("PUT other kind: got %d", w.Code)
+	}
+	if w := do(s, "PUT", "/_config/Data", `{}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT config: got %d", w.Code)
+	}
+	if w := do(s, "PATCH", "/Data/a", `{"a":2}`); w.Code != http.StatusOK {
+		t.Errorf("PATCH after config change: got %d", w.Code)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, id := range []string{"a", "b", "c d"} {
+		if w := do(s, "PUT", "/Data/"+url.PathEscape(id), `{"x":1}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", id, w.Code)
+		}
+	}
+	self := func(m map[string]interface{}) interface{} {
+		links, _ := m[linksKey].(map[string]interface{})
+		return links["self"]
+	}
+
+	if got := self(decode(t, do(s, "GET", "/Data/c%20d?links=true", ""))); got != "/Data/c%20d" {
+		t.Errorf("GET: got self %v, want /Data/c%%20d", got)
+	}
+	if _, found := decode(t, do(s, "GET", "/Data/a", ""))[linksKey]; found {
+		t.Errorf("GET without links=true: got %s", linksKey)
+	}
+	items, _ := decode(t, do(s, "GET", "/Data?ids=a,b&links=true", ""))["items"].([]interface{})
+	if len(items) != 2 || self(items[1].(map[string]interface{})) != "/Data/b" {
+		t.Errorf("ids: got %v", items)
+	}
+
+	// Lists link to each object, to themselves, and to the next page.
+	m := decode(t, do(s, "GET", "/Data?limit=2&links=true", ""))
+	items, _ = m["items"].([]interface{})
+	if len(items) != 2 || self(items[0].(map[string]interface{})) != "/Data/a" {
+		t.Errorf("list: got items %v", items)
+	}
+	links, _ := m[linksKey].(map[string]interface{})
+	if links["self"] != "/Data?limit=2&links=true" {
+		t.Errorf("list: got self %v", links["self"])
+	}
+	next, _ := links["next"].(string)
+	if want := "/Data?limit=2&links=true&start=" + url.QueryEscape(m["nextStartToken"].(string)); next != want {
+		t.Fatalf("list: got next %q, want %q", next, want)
+	}
+	m = decode(t, do(s, "GET", next, ""))
+	if got := listIDs(t, do(s, "GET", next, "")); !reflect.DeepEqual(got, []string{"c d"}) {
+		t.Errorf("next page: got %v", got)
+	}
+	if links, _ := m[linksKey].(map[string]interface{}); links["self"] != next || links["next"] != nil {
+		t.Errorf("last page: got links %v", links)
+	}
+}
+
+func TestEncryptedFields(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/_config/People", `{"encrypted":["ssn"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("config without a key: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	f, err := ioutil.TempFile("", "simply-put-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef")) + "\n")
+	f.Close()
+	if s.fieldCipher, err = loadFieldCipher(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := do(s, "PUT", "/_config/People", `{"encrypted":["ssn"],"unique":["ssn"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("unique encrypted field: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := do(s, "PUT", "/_config/People", `{"encrypted":["ssn","card.number"]}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT config: got %d %s", w.Code, w.Body.String())
+	}
+	w := do(s, "PUT", "/People/a", `{"name":"Ann","ssn":"123-45-6789","card":{"number":4111111111111111}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d %s", w.Code, w.Body.String())
+	}
+	if m := decode(t, w); m["ssn"] != "123-45-6789" {
+		t.Errorf("PUT: got ssn=%v", m["ssn"])
+	}
+
+	// The values are stored as ciphertext.
+	stored := func() map[string]interface{} {
+		var m map[string]interface{}
+		s.db.View(func(tx *bolt.Tx) error {
+			v := tx.Bucket([]byte("People")).Get([]byte("a"))
+			if strings.Contains(string(v), "123-45-6789") || strings.Contains(string(v), "4111111111111111") {
+				t.Errorf("stored plaintext: %s", v)
+			}
+			m, _ = fromJSON(v)
+			return nil
+		})
+		return m
+	}
+	m := stored()
+	for _, f := range []string{"ssn", "card.number"} {
+		if v, _ := lookup(m, f); !strings.HasPrefix(fmt.Sprint(v), encryptedPrefix) {
+			t.Errorf("stored %s=%v, want ciphertext", f, v)
+		}
+	}
+	if m["name"] != "Ann" {
+		t.Errorf("stored name=%v, want plaintext", m["name"])
+	}
+
+	// They're decrypted on read.
+	check := func(name string, m map[string]interface{}) {
+		if m["ssn"] != "123-45-6789" {
+			t.Errorf("%s: got ssn=%v", name, m["ssn"])
+		}
+		if v, _ := lookup(m, "card.number"); v != 4111111111111111.0 {
+			t.Errorf("%s: got card.number=%v", name, v)
+		}
+	}
+	check("GET", decode(t, do(s, "GET", "/People/a", "")))
+	items, _ := decode(t, do(s, "GET", "/People", ""))["items"].([]interface{})
+	if len(items) != 1 {
+		t.Fatalf("list: got %v", items)
+	}
+	check("list", items[0].(map[string]interface{}))
+
+	// Patching another field leaves them alone, and a diff doesn't include
+	// them.
+	r, _ := http.NewRequest("PATCH", "/People/a", strings.NewReader(`{"name":"Anne"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Prefer", "return=diff")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if changed, _ := decode(t, w)["changed"].(map[string]interface{}); changed["name"] != "Anne" || changed["ssn"] != nil || changed["card"] != nil {
+		t.Errorf("PATCH diff: got %s", w.Body.String())
+	}
+	check("GET after PATCH", decode(t, do(s, "GET", "/People/a", "")))
+	if w := do(s, "PATCH", "/People/a", `{"ssn":"987-65-4321"}`); w.Code != http.StatusOK || decode(t, w)["ssn"] != "987-65-4321" {
+		t.Errorf("PATCH ssn: got %d %s", w.Code, w.Body.String())
+	}
+	if v, _ := stored()["ssn"].(string); !strings.HasPrefix(v, encryptedPrefix) {
+		t.Errorf("stored ssn=%v after PATCH, want ciphertext", v)
+	}
+
+	// Encrypted fields can't be queried.
+	for _, path := range []string{
+		"/People?where=ssn=987-65-4321",
+		"/People?or=name=x%3Bssn=y",
+		"/People?contains=card.number:4",
+		"/People?sort=-card",
+		"/People/_first?sort=ssn",
+		"/People/_stats?fields=ssn",
+		"/People/_distinct?field=card.number",
+		"/People/a?where=ssn=1",
+		"/_search?where=ssn=1",
+	} {
+		if w := do(s, "GET", path, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: got %d, want %d", path, w.Code, http.StatusBadRequest)
+		}
+	}
+	if got := listIDs(t, do(s, "GET", "/People?where=name=Anne", "")); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("where on another field: got %v", got)
+	}
+}
+
+func TestNestedPaths(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, id := range []string{"a", "b"} {
+		if w := do(s, "PUT", "/People/"+id, `{"name":"`+id+`"}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got %d", id, w.Code)
+		}
+	}
+
+	// Children are created under their parent, and given its key.
+	w := do(s, "POST", "/People/a/Posts", `{"title":"first"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST: got %d %s", w.Code, w.Body.String())
+	}
+	first := decode(t, w)
+	if first[parentKey] != "People/a" {
+		t.Errorf("POST: got %s=%v, want People/a", parentKey, first[parentKey])
+	}
+	for _, c := range []struct{ method, path, body string }{
+		{"PUT", "/People/a/Posts/second", `{"title":"second"}`},
+		{"POST", "/People/a/Posts", `[{"_id":"third"},{"_id":"fourth","_parent":"People/a"}]`},
+		{"PUT", "/People/b/Posts/other", `{"title":"other"}`},
+	} {
+		if w := do(s, c.method, c.path, c.body); w.Code != http.StatusOK {
+			t.Fatalf("%s %s: got %d %s", c.method, c.path, w.Code, w.Body.String())
+		}
+	}
+
+	// Lists and queries under a parent only see its children, while the
+	// kind's own path sees them all.
+	rest := first[idKey].(string)
+	for _, c := range []struct {
+		path string
+		want []string
+	}{
+		{"/People/a/Posts?sort=_id", []string{rest, "fourth", "second", "third"}},
+		{"/People/b/Posts", []string{"other"}},
+		{"/People/a/Posts?where=title=second", []string{"second"}},
+		{"/Posts?where=_parent=People/b", []string{"other"}},
+	} {
+		sort.Strings(c.want)
+		w := do(s, "GET", c.path, "")
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: got %d", c.path, w.Code)
+		} else if got := listIDs(t, w); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("GET %s: got %v, want %v", c.path, got, c.want)
+		}
+	}
+	if w := do(s, "GET", "/Posts", ""); len(listIDs(t, w)) != 5 {
+		t.Errorf("GET /Posts: got %v, want all 5", listIDs(t, w))
+	}
+	if w := do(s, "GET", "/People/b/Posts/_stats", ""); w.Code != http.StatusOK || decode(t, w)["count"] != 1.0 {
+		t.Errorf("GET _stats: got %d %s, want a count of 1", w.Code, w.Body.String())
+	}
+
+	// Other parents' children are missing under the wrong parent, as are
+	// children of missing parents.
+	for _, c := range []struct{ method, path, body string }{
+		{"GET", "/People/b/Posts/second", ""},
+		{"PATCH", "/People/b/Posts/second", `{"title":"moved"}`},
+		{"PUT", "/People/b/Posts/second", `{"title":"moved"}`},
+		{"DELETE", "/People/b/Posts/second", ""},
+		{"GET", "/People/c/Posts", ""},
+		{"POST", "/People/c/Posts", `{"title":"orphan"}`},
+	} {
+		if w := do(s, c.method, c.path, c.body); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s: got %d, want %d", c.method, c.path, w.Code, http.StatusNotFound)
+		}
+	}
+	if w := do(s, "GET", "/People/a/Posts/second", ""); w.Code != http.StatusOK {
+		t.Errorf("GET second: got %d", w.Code)
+	}
+	items, _ := decode(t, do(s, "GET", "/People/b/Posts?ids=other,second", ""))["items"].([]interface{})
+	if len(items) != 2 || items[0].(map[string]interface{})[idKey] != "other" || items[1] != nil {
+		t.Errorf("GET ids: got %v, want other and null", items)
+	}
+	if got := listIDs(t, do(s, "GET", "/People/b/Posts?ids=other,second&omitMissing=true", "")); !reflect.DeepEqual(got, []string{"other"}) {
+		t.Errorf("GET ids with omitMissing: got %v, want [other]", got)
+	}
+
+	// Parents, once given, can't be changed, but needn't be given again.
+	for _, c := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{"POST", "/People/b/Posts", `{"_parent":"People/a"}`, http.StatusConflict},
+		{"PUT", "/Posts/second", `{"_parent":"People/b"}`, http.StatusConflict},
+		{"PATCH", "/Posts/second", `{"_parent":"People/b"}`, http.StatusConflict},
+		{"POST", "/Posts", `{"_parent":"People/c"}`, http.StatusBadRequest},
+		{"POST", "/Posts", `{"_parent":1}`, http.StatusBadRequest},
+		{"DELETE", "/People/a/Posts?confirm=true", "", http.StatusMethodNotAllowed},
+		{"POST", "/Posts/second", `{"title":"replaced"}`, http.StatusOK},
+		{"PATCH", "/People/a/Posts/second", `{"title":"patched"}`, http.StatusOK},
+	} {
+		if w := do(s, c.method, c.path, c.body); w.Code != c.want {
+			t.Errorf("%s %s %s: got %d, want %d", c.method, c.path, c.body, w.Code, c.want)
+		}
+	}
+	w = do(s, "GET", "/Posts/second", "")
+	if m := decode(t, w); m[parentKey] != "People/a" || m["title"] != "patched" {
+		t.Errorf("GET second: got %v", m)
+	}
+
+	// Sub-resources of children work under the parent too, but not
+	// under another.
+	if w := do(s, "POST", "/People/a/Posts/second/_inc", `{"field":"likes"}`); w.Code != http.StatusOK || decode(t, w)["likes"] != 1.0 {
+		t.Errorf("_inc: got %d %s", w.Code, w.Body.String())
+	}
+	if w := do(s, "POST", "/People/b/Posts/second/_inc", `{"field":"likes"}`); w.Code != http.StatusNotFound {
+		t.Errorf("_inc under another parent: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do(s, "PATCH", "/Posts/second", `{"_readonly":true}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH lock: got %d", w.Code)
+	}
+	if w := do(s, "POST", "/People/a/Posts/second/_unlock", ""); w.Code != http.StatusOK {
+		t.Errorf("_unlock: got %d %s", w.Code, w.Body.String())
+	}
+
+	if w := do(s, "DELETE", "/People/a/Posts/second", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE: got %d", w.Code)
+	}
+}
+
+func TestListDebug(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, body := range []string{`{"_id":"a","age":1}`, `{"_id":"b","age":2}`, `{"_id":"c","age":3}`} {
+		if w := do(s, "POST", "/People", body); w.Code != http.StatusOK {
+			t.Fatalf("POST %s: got %d", body, w.Code)
+		}
+	}
+	const params = "where=age!=3&where=_id=b&or=age=2%3Bname=x&contains=name:b&sort=name,-age&limit=1&debug=true"
+	if w := do(s, "GET", "/People?"+params, ""); w.Code != http.StatusForbidden {
+		t.Errorf("GET without -debug: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+	s.debug = true
+
+	// Without debug=true, lists are as usual.
+	if w := do(s, "GET", "/People", ""); strings.Contains(w.Body.String(), queryKey) {
+		t.Errorf("GET: got %s, want no %s", w.Body.String(), queryKey)
+	}
+
+	w := do(s, "GET", "/People?"+params, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: got %d %s", w.Code, w.Body.String())
+	}
+	want := map[string]interface{}{
+		"limit":  1.0,
+		"offset": 0.0,
+		"sort": []interface{}{
+			map[string]interface{}{"field": "name", "desc": false},
+			map[string]interface{}{"field": "age", "desc": true},
+		},
+		"filters": []interface{}{
+			map[string]interface{}{"field": "age", "op": "!=", "value": 3.0},
+			map[string]interface{}{"field": "_id", "op": "=", "value": "b"},
+			map[string]interface{}{"field": "name", "op": "contains", "value": "b"},
+		},
+		"or": []interface{}{[]interface{}{
+			map[string]interface{}{"field": "age", "op": "=", "value": 2.0},
+			map[string]interface{}{"field": "name", "op": "=", "value": "x"},
+		}},
+		"cursor": false,
+	}
+	if got := decode(t, w)[queryKey]; !reflect.DeepEqual(got, want) {
+		t.Errorf("GET: got %s %v\nwant %v", queryKey, got, want)
+	}
+
+	// Later pages give the offset their cursor starts at.
+	w = do(s, "GET", "/People?limit=1&debug=true", "")
+	next, _ := decode(t, w)["nextStartToken"].(string)
+	w = do(s, "GET", "/People?limit=1&debug=true&start="+next, "")
+	if q, _ := decode(t, w)[queryKey].(map[string]interface{}); q["offset"] != 1.0 || q["cursor"] != true {
+		t.Errorf("GET next page: got %s %v, want offset 1 from a cursor", queryKey, q)
+	}
+
+	// JSON:API documents give it in their meta.
+	w = do(s, "GET", "/People?debug=true&format=jsonapi", "")
+	if meta, _ := decode(t, w)["meta"].(map[string]interface{}); meta[queryKey] == nil {
+		t.Errorf("GET JSON:API: got %s, want meta.%s", w.Body.String(), queryKey)
+	}
+}
+
+func TestPresentItemsField(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	// An entity with a field called "items" of its own is still presented
+	// as a single entity, not as a list.
+	if w := do(s, "PUT", "/_config/Orders", `{"hidden":["secret"],"money":["total"]}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT config: got %d", w.Code)
+	}
+	if w := do(s, "PUT", "/Orders/a", `{"secret":"xyz","total":1.5,"items":[{"sku":"x"}],"_readonly":true}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	for _, path := range []string{"/Orders/a", "/Orders/_first"} {
+		m := decode(t, do(s, "GET", path, ""))
+		if _, found := m["secret"]; found || m["total"] != 1.5 {
+			t.Errorf("GET %s: got %v", path, m)
+		}
+	}
+	m := decode(t, do(s, "GET", "/Orders/a?links=true&timeFormat=iso", ""))
+	if _, found := m[linksKey]; !found {
+		t.Errorf("links: got %v", m)
+	}
+	if _, ok := m[createdKey].(string); !ok {
+		t.Errorf("timeFormat: got %s=%v", createdKey, m[createdKey])
+	}
+	m = decode(t, do(s, "GET", "/Orders/a?metaOnly=true", ""))
+	if _, found := m["items"]; found {
+		t.Errorf("metaOnly: got %v", m)
+	}
+
+	w := do(s, "POST", "/Orders/a/_unlock", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("_unlock: got %d %s", w.Code, w.Body.String())
+	}
+	m = decode(t, w)
+	if _, found := m["secret"]; found || m["total"] != 1.5 || m[readOnlyKey] != nil {
+		t.Errorf("_unlock: got %v", m)
+	}
+}
+
+func TestMaxBody(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.maxBody = 16
+
+	if w := do(s, "PUT", "/Data/a", `{"a":1}`); w.Code != http.StatusOK {
+		t.Errorf("PUT under limit: got %d", w.Code)
+	}
+	for _, m := range []string{"POST", "PUT", "PATCH"} {
+		path := "/Data/a"
+		if m == "POST" {
+			path = "/Data"
+		}
+		if w := do(s, m, path, `{"a":"this is far too long"}`); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s over limit: got %d, want %d", m, w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+	if got := decode(t, do(s, "GET", "/Data/a", ""))["a"]; got != 1.0 {
+		t.Errorf("after over-limit writes: got a=%v, want 1", got)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	defer func() { nowFunc = time.Now }()
+	now := time.Unix(1000, 0)
+	nowFunc = func() time.Time { return now }
+
+	if w := do(s, "PUT", "/Data/short", `{"a":1,"_ttl":60}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if w := do(s, "PUT", "/Data/long", `{"a":1,"_ttl":600}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if w := do(s, "PUT", "/Data/forever", `{"a":1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	m := decode(t, do(s, "GET", "/Data/short", ""))
+	if m[expiresKey] != 1060.0 {
+		t.Errorf("GET: got %s=%v, want 1060", expiresKey, m[expiresKey])
+	}
+	if _, found := m[ttlKey]; found {
+		t.Errorf("GET: got %s, want none", ttlKey)
+	}
+
+	// After its TTL, the entity is gone from get and list.
+	now = time.Unix(1060, 0)
+	if w := do(s, "GET", "/Data/short", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET expired: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do(s, "PATCH", "/Data/short", `{"a":2}`); w.Code != http.StatusNotFound {
+		t.Errorf("PATCH expired: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if got := listIDs(t, do(s, "GET", "/Data", "")); !reflect.DeepEqual(got, []string{"forever", "long"}) {
+		t.Errorf("list: got %v", got)
+	}
+
+	// Replacing an entity keeps its expiry.
+	if w := do(s, "POST", "/Data/long", `{"a":2}`); w.Code != http.StatusOK {
+		t.Fatalf("POST: got %d", w.Code)
+	}
+	if got := decode(t, do(s, "GET", "/Data/long", ""))[expiresKey]; got != 1600.0 {
+		t.Errorf("GET replaced: got %s=%v, want 1600", expiresKey, got)
+	}
+
+	// Purging deletes only expired entities.
+	w := do(s, "POST", "/_purge", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("purge: got %d", w.Code)
+	}
+	if got := decode(t, w)["deleted"]; got != 1.0 {
+		t.Errorf("purge: got deleted=%v, want 1", got)
+	}
+	now = time.Unix(2000, 0)
+	if got := decode(t, do(s, "POST", "/_purge", ""))["deleted"]; got != 1.0 {
+		t.Errorf("second purge: got deleted=%v, want 1", got)
+	}
+	now = time.Unix(1000, 0)
+	if got := listIDs(t, do(s, "GET", "/Data", "")); !reflect.DeepEqual(got, []string{"forever"}) {
+		t.Errorf("list after purge: got %v", got)
+	}
+
+	if w := do(s, "PUT", "/Data/bad", `{"_ttl":"soon"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT bad ttl: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDeleteKind(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	const n = deleteBatchSize + 5
+	for i := 0; i < n; i++ {
+		if w := do(s, "PUT", "/Data/"+strconv.Itoa(i), `{"a":1}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	if w := do(s, "PUT", "/Other/a", `{"a":1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+
+	if w := do(s, "DELETE", "/Data", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("DELETE without confirm: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	w := do(s, "DELETE", "/Data?confirm=true", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("DELETE: got %d", w.Code)
+	}
+	if got := decode(t, w)["deleted"]; got != float64(n) {
+		t.Errorf("DELETE: got deleted=%v, want %d", got, n)
+	}
+	if w := do(s, "GET", "/Data/0", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET deleted: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do(s, "GET", "/Data", ""); w.Code != http.StatusNotFound {
+		t.Errorf("list deleted kind: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := do(s, "GET", "/Other/a", ""); w.Code != http.StatusOK {
+		t.Errorf("GET other kind: got %d", w.Code)
+	}
+	if w := do(s, "DELETE", "/Data?confirm=true", ""); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE missing kind: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestPatchReturnDiff(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	defer func() { nowFunc = time.Now }()
+	nowFunc = func() time.Time { return time.Unix(1000, 0) }
+
+	if w := do(s, "PUT", "/Data/a", `{"a":1,"b":"foo","c":[1,2]}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	nowFunc = func() time.Time { return time.Unix(2000, 0) }
+	r, _ := http.NewRequest("PATCH", "/Data/a", strings.NewReader(`{"a":2,"b":"foo","c":[1,2]}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Prefer", "return=diff")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH: got %d", w.Code)
+	}
+	want := map[string]interface{}{
+		idKey: "a",
+		"changed": map[string]interface{}{
+			"a":        2.0,
+			updatedKey: 2000.0,
+			versionKey: 2.0,
+		},
+	}
+	if got := decode(t, w); !reflect.DeepEqual(got, want) {
+		t.Errorf("PATCH diff;\n got %v\nwant %v", got, want)
+	}
+
+	// Without the preference, the whole entity is returned.
+	if got := decode(t, do(s, "PATCH", "/Data/a", `{"a":3}`)); got["b"] != "foo" {
+		t.Errorf("PATCH: got %v, want whole entity", got)
+	}
+}
+
+func TestChangedFields(t *testing.T) {
+	before := map[string]interface{}{"a": 1.0, "b": "x", "c": []interface{}{1.0}}
+	after := map[string]interface{}{"a": 1.0, "c": []interface{}{2.0}, "d": true}
+	want := map[string]interface{}{"b": nil, "c": []interface{}{2.0}, "d": true}
+	if got := changedFields(before, after); !reflect.DeepEqual(got, want) {
+		t.Errorf("changedFields;\n got %v\nwant %v", got, want)
+	}
+}
+
+func TestSplitNamespace(t *testing.T) {
+	cases := []struct {
+		kind, ns, bare string
+	}{
+		{"Data", "", "Data"},
+		{"user--Data", "user--", "Data"},
+		{"user--_config", "user--", "_config"},
+		{"a---Data", "a---", "Data"},
+	}
+	for _, c := range cases {
+		ns, bare := splitNamespace(c.kind)
+		if ns != c.ns || bare != c.bare {
+			t.Errorf("splitNamespace(%s); got %s,%s want %s,%s", c.kind, ns, bare, c.ns, c.bare)
+		}
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, id := range []string{"a", "b", "c"} {
+		if w := do(s, "PUT", "/Data/"+id, `{"x":1}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	ids := func(w *httptest.ResponseRecorder) []interface{} {
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET: got %d", w.Code)
+		}
+		var got []interface{}
+		for _, i := range decode(t, w)["items"].([]interface{}) {
+			if i == nil {
+				got = append(got, nil)
+			} else {
+				got = append(got, i.(map[string]interface{})[idKey])
+			}
+		}
+		return got
+	}
+	if got, want := ids(do(s, "GET", "/Data?ids=c,missing,a", "")), []interface{}{"c", nil, "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GET ids; got %v want %v", got, want)
+	}
+	if got, want := ids(do(s, "GET", "/Data?ids=c,missing,a&omitMissing=true", "")), []interface{}{"c", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GET ids omitting missing; got %v want %v", got, want)
+	}
+	if got, want := ids(do(s, "GET", "/Other?ids=a", "")), []interface{}{nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GET ids of missing kind; got %v want %v", got, want)
+	}
+}
+
+// encoding/json always writes map keys in sorted order, so responses are
+// deterministic without any special handling.
+func TestStableKeyOrder(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/Data/a", `{"z":1,"b":{"y":2,"c":3,"m":{"q":1,"d":2}},"a":[{"k":1,"e":2}]}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	first := do(s, "GET", "/Data/a", "").Body.String()
+	for i := 0; i < 20; i++ {
+		if got := do(s, "GET", "/Data/a", "").Body.String(); got != first {
+			t.Fatalf("GET %d;\n got %s\nwant %s", i, got, first)
+		}
+	}
+	if got := do(s, "GET", "/Data", "").Body.String(); !strings.Contains(got, `{"_created":`) {
+		t.Errorf("list: got %s, want sorted keys", got)
+	}
+	want := `"a":[{"e":2,"k":1}],"b":{"c":3,"m":{"d":2,"q":1},"y":2},"z":1}`
+	if !strings.HasSuffix(strings.TrimSpace(first), want) {
+		t.Errorf("GET;\n got %s\nwant keys sorted like %s", first, want)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/Data/a", `{"a":1,"_readonly":true}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	for _, c := range []struct {
+		method, path, body string
+	}{
+		{"PUT", "/Data/a", `{"a":2}`},
+		{"POST", "/Data/a", `{"a":2}`},
+		{"PATCH", "/Data/a", `{"a":2}`},
+		{"POST", "/Data/a/_inc", `{"field":"a"}`},
+		{"DELETE", "/Data/a", ""},
+	} {
+		if w := do(s, c.method, c.path, c.body); w.Code != http.StatusConflict {
+			t.Errorf("%s %s locked: got %d, want %d", c.method, c.path, w.Code, http.StatusConflict)
+		}
+	}
+	if got := decode(t, do(s, "GET", "/Data/a", ""))["a"]; got != 1.0 {
+		t.Errorf("GET locked: got a=%v, want 1", got)
+	}
+
+	// Forcing overrides the lock.
+	if w := do(s, "PATCH", "/Data/a?force=true", `{"a":3}`); w.Code != http.StatusOK {
+		t.Errorf("PATCH forced: got %d", w.Code)
+	}
+	m := decode(t, do(s, "GET", "/Data/a", ""))
+	if m["a"] != 3.0 || m[readOnlyKey] != true {
+		t.Errorf("GET after forced PATCH: got %v", m)
+	}
+
+	// Unlocking clears the lock.
+	if w := do(s, "POST", "/Data/a/_unlock", ""); w.Code != http.StatusOK {
+		t.Fatalf("unlock: got %d", w.Code)
+	}
+	if _, found := decode(t, do(s, "GET", "/Data/a", ""))[readOnlyKey]; found {
+		t.Errorf("GET after unlock: got %s, want none", readOnlyKey)
+	}
+	if w := do(s, "PATCH", "/Data/a", `{"a":4}`); w.Code != http.StatusOK {
+		t.Errorf("PATCH unlocked: got %d", w.Code)
+	}
+
+	if w := do(s, "PUT", "/Data/b", `{"_readonly":true}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if w := do(s, "DELETE", "/Data/b?force=true", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE forced: got %d", w.Code)
+	}
+	if w := do(s, "GET", "/Data/b", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET after forced DELETE: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestListLinkHeader(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, id := range []string{"a", "b", "c"} {
+		if w := do(s, "PUT", "/Data/"+id, `{"x":1,"y":"`+id+`"}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	w := do(s, "GET", "http://example.com/Data?limit=1&where=x=1&sort=-y", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: got %d", w.Code)
+	}
+	tok := decode(t, w)["nextStartToken"].(string)
+	link := w.Header().Get("Link")
+	if !strings.HasPrefix(link, "<") || !strings.HasSuffix(link, `>; rel="next"`) {
+		t.Fatalf("Link: got %q", link)
+	}
+	next, err := url.Parse(link[1:strings.Index(link, ">")])
+	if err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	if next.Host != "example.com" || next.Path != "/Data" {
+		t.Errorf("Link: got %s, want http://example.com/Data?...", next)
+	}
+	want := url.Values{"limit": {"1"}, "where": {"x=1"}, "sort": {"-y"}, "start": {tok}}
+	if got := next.Query(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Link params;\n got %v\nwant %v", got, want)
+	}
+
+	// Following the links visits every page.
+	var ids []string
+	path := "http://example.com/Data?limit=1&where=x=1&sort=-y"
+	for path != "" {
+		w := do(s, "GET", path, "")
+		ids = append(ids, listIDs(t, w)...)
+		path = ""
+		if link := w.Header().Get("Link"); link != "" {
+			path = link[1:strings.Index(link, ">")]
+		}
+	}
+	if want := []string{"c", "b", "a"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("following links: got %v, want %v", ids, want)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, c := range []struct {
+		method, path, contentType string
+		want                      int
+	}{
+		{"PUT", "/Data/a", "application/json", http.StatusOK},
+		{"PUT", "/Data/a", "application/json; charset=utf-8", http.StatusOK},
+		{"POST", "/Data", "application/json", http.StatusOK},
+		{"PATCH", "/Data/a", "application/json", http.StatusOK},
+		{"PUT", "/Data/a?format=json", "application/x-www-form-urlencoded", http.StatusOK},
+
+		{"PUT", "/Data/a", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"POST", "/Data", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"POST", "/Data/a", "text/plain", http.StatusUnsupportedMediaType},
+		{"PATCH", "/Data/a", "", http.StatusUnsupportedMediaType},
+	} {
+		r, _ := http.NewRequest(c.method, c.path, strings.NewReader(`{"a":1}`))
+		if c.contentType != "" {
+			r.Header.Set("Content-Type", c.contentType)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s %s as %q: got %d, want %d", c.method, c.path, c.contentType, w.Code, c.want)
+		}
+	}
+
+	// Requests without a body don't need a content type.
+	if w := do(s, "POST", "/Data/a/_unlock", ""); w.Code != http.StatusOK {
+		t.Errorf("POST without body: got %d", w.Code)
+	}
+}
+
+func TestListOr(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for id, body := range map[string]string{
+		"a": `{"status":"active","priority":"low","owner":"me"}`,
+		"b": `{"status":"archived","priority":"high","owner":"me"}`,
+		"c": `{"status":"active","priority":"high","owner":"me"}`,
+		"d": `{"status":"archived","priority":"low","owner":"me"}`,
+		"e": `{"status":"active","priority":"high","owner":"you"}`,
+	} {
+		if w := do(s, "PUT", "/Data/"+id, body); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{"or=status=active%3Bpriority=high", []string{"a", "b", "c", "e"}},
+		{"or=status=active%3Bpriority=high&where=owner=me", []string{"a", "b", "c"}},
+		{"or=status=active%3Bpriority=high&or=priority=low", []string{"a"}},
+	} {
+		w := do(s, "GET", "/Data?"+c.query, "")
+		if got := listIDs(t, w); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("GET ?%s; got %v want %v", c.query, got, c.want)
+		}
+	}
+}
+
+func TestListRepeatedWhere(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for id, body := range map[string]string{
+		"a": `{"n":1,"tags":["x"]}`,
+		"b": `{"n":2,"tags":["x","y"]}`,
+		"c": `{"n":3,"tags":["y"]}`,
+	} {
+		if w := do(s, "PUT", "/Data/"+id, body); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		// Filters on the same field must all match, so on an array field
+		// they find objects with all the values...
+		{"where=tags=x&where=tags=y", []string{"b"}},
+		// ...and on other fields, objects with none of them. Use or to
+		// find objects with any of the values.
+		{"where=n=1&where=n=2", []string{}},
+		{"or=n=1%3Bn=2", []string{"a", "b"}},
+		{"where=n=1&where=n=1", []string{"a"}},
+	} {
+		w := do(s, "GET", "/Data?"+c.query, "")
+		if w.Code != http.StatusOK {
+			t.Errorf("GET ?%s: got %d", c.query, w.Code)
+		} else if got := listIDs(t, w); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("GET ?%s; got %v want %v", c.query, got, c.want)
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	s.maxDepth = 3
+
+	ok := `{"a":{"b":[1,2]}}`
+	deep := `{"a":{"b":[1,{"c":1}]}}`
+	if w := do(s, "PUT", "/Data/a", ok); w.Code != http.StatusOK {
+		t.Errorf("PUT at max depth: got %d", w.Code)
+	}
+	for _, c := range []struct {
+		method, path, body string
+	}{
+		{"PUT", "/Data/b", deep},
+		{"POST", "/Data", deep},
+		{"POST", "/Data/a", deep},
+		{"PATCH", "/Data/a", deep},
+		{"PATCH", "/Data/a", `{"$set":{"a":{"b":{"c":{}}}}}`},
+	} {
+		w := do(s, c.method, c.path, c.body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s too deep: got %d, want %d", c.method, c.path, w.Code, http.StatusBadRequest)
+		}
+		if !strings.Contains(w.Body.String(), "3 levels") {
+			t.Errorf("%s %s too deep: got message %q", c.method, c.path, w.Body.String())
+		}
+	}
+}
+
+func TestNestedDeeper(t *testing.T) {
+	cases := []struct {
+		body string
+		max  int
+		want bool
+	}{
+		{`{}`, 1, false},
+		{`{"a":1}`, 1, false},
+		{`{"a":{}}`, 1, true},
+		{`{"a":[]}`, 2, false},
+		{`{"a":[[1]]}`, 2, true},
+	}
+	for _, c := range cases {
+		m, err := fromJSON([]byte(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := nestedDeeper(m, c.max); got != c.want {
+			t.Errorf("nestedDeeper(%s, %d); got %t want %t", c.body, c.max, got, c.want)
+		}
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	for _, body := range []string{
+		`{"a.b":1}`,
+		`{"a":{"b.c":1}}`,
+		`{"a":[{"b.c":1}]}`,
+		`{"_secret":1}`,
+	} {
+		w := do(s, "PUT", "/Data/a", body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s: got %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+		if !strings.Contains(w.Body.String(), "invalid field name") {
+			t.Errorf("PUT %s: got message %q", body, w.Body.String())
+		}
+	}
+
+	// Underscores are fine in nested objects, and metadata can be sent back.
+	w := do(s, "PUT", "/Data/a", `{"a":{"_b":1}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	if w := do(s, "POST", "/Data/a", w.Body.String()); w.Code != http.StatusOK {
+		t.Errorf("POST fetched entity: got %d", w.Code)
+	}
+	if w := do(s, "PATCH", "/Data/a", `{"$set":{"x.y":1}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("PATCH with dotted name: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestArrayOrder(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/Data/a", `{"list":[1,2,3,4,5],"other":1}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	for _, c := range []struct {
+		method, body string
+		want         []interface{}
+	}{
+		{"POST", `{"list":[5,"four",3,null,1]}`, []interface{}{5.0, "four", 3.0, nil, 1.0}},
+		{"PATCH", `{"list":[9,1,8,2,7]}`, []interface{}{9.0, 1.0, 8.0, 2.0, 7.0}},
+		{"PATCH", `{"$set":{"list":[{"b":1},{"a":2},[3],true,"x"]}}`, []interface{}{
+			map[string]interface{}{"b": 1.0}, map[string]interface{}{"a": 2.0}, []interface{}{3.0}, true, "x"}},
+		// Changing another field leaves the array alone.
+		{"PATCH", `{"other":2}`, []interface{}{
+			map[string]interface{}{"b": 1.0}, map[string]interface{}{"a": 2.0}, []interface{}{3.0}, true, "x"}},
+	} {
+		if w := do(s, c.method, "/Data/a", c.body); w.Code != http.StatusOK {
+			t.Fatalf("%s %s: got %d", c.method, c.body, w.Code)
+		}
+		if got := decode(t, do(s, "GET", "/Data/a", ""))["list"]; !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s %s: got %v, want %v", c.method, c.body, got, c.want)
+		}
+	}
+}
+
+func TestBoolAndNullRoundTrip(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	if w := do(s, "PUT", "/Data/a", `{"t":true,"f":false,"n":null,"list":[true,null,false]}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	m := decode(t, do(s, "GET", "/Data/a", ""))
+	for k, want := range map[string]interface{}{
+		"t":    true,
+		"f":    false,
+		"n":    nil,
+		"list": []interface{}{true, nil, false},
+	} {
+		got, found := m[k]
+		if !found {
+			t.Errorf("GET: missing %s", k)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("GET: got %s=%v, want %v", k, got, want)
+		}
+	}
+
+	// Nulls are stored, not dropped, so they can be filtered on.
+	if w := do(s, "PUT", "/Data/b", `{"t":false}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+	for _, c := range []struct {
+		where string
+		want  []string
+	}{
+		{"n=null", []string{"a"}},
+		{"t=true", []string{"a"}},
+		{"t=false", []string{"b"}},
+		{"list=null", []string{"a"}},
+	} {
+		if got := listIDs(t, do(s, "GET", "/Data?where="+c.where, "")); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("GET where=%s; got %v want %v", c.where, got, c.want)
+		}
+	}
+
+	// Patching a field to null keeps the field.
+	if w := do(s, "PATCH", "/Data/a", `{"t":null}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH: got %d", w.Code)
+	}
+	if v, found := decode(t, do(s, "GET", "/Data/a", ""))["t"]; !found || v != nil {
+		t.Errorf("GET after PATCH: got t=%v,%t want null", v, found)
+	}
+}
+
+func TestListUpdatedSince(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	defer func() { nowFunc = time.Now }()
+
+	nowFunc = func() time.Time { return time.Unix(1000, 0) }
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if w := do(s, "PUT", "/Data/"+id, `{"x":1}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	nowFunc = func() time.Time { return time.Unix(2000, 0) }
+	if w := do(s, "PATCH", "/Data/b", `{"x":2}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH: got %d", w.Code)
+	}
+	nowFunc = func() time.Time { return time.Unix(3000, 0) }
+	if w := do(s, "POST", "/Data/d", `{"x":3}`); w.Code != http.StatusOK {
+		t.Fatalf("POST: got %d", w.Code)
+	}
+
+	for _, c := range []struct {
+		since string
+		want  []string
+	}{
+		{"1500", []string{"b", "d"}},
+		{"2000", []string{"d"}},
+		{"3000", []string{}},
+	} {
+		w := do(s, "GET", "/Data?updatedSince="+c.since, "")
+		if got := listIDs(t, w); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("GET updatedSince=%s; got %v want %v", c.since, got, c.want)
+		}
+	}
+
+	// An inequality filter can be combined with a sort on any other field.
+	w := do(s, "GET", "/Data?updatedSince=1500&sort=-x", "")
+	if got := listIDs(t, w); !reflect.DeepEqual(got, []string{"d", "b"}) {
+		t.Errorf("GET updatedSince=1500&sort=-x; got %v", got)
+	}
+}
+
+func TestListCreatedRange(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	defer func() { nowFunc = time.Now }()
+
+	for i, id := range []string{"a", "b", "c"} {
+		created := time.Date(2015, 1, i+1, 0, 0, 0, 0, time.UTC)
+		nowFunc = func() time.Time { return created }
+		if w := do(s, "PUT", "/Data/"+id, `{}`); w.Code != http.StatusOK {
+			t.Fatalf("PUT: got %d", w.Code)
+		}
+	}
+	jan2 := strconv.FormatInt(time.Date(2015, 1, 2, 0, 0, 0, 0, time.UTC).Unix(), 10)
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{"createdAfter=" + jan2, []string{"c"}},
+		{"createdBefore=" + jan2, []string{"a"}},
+		{"createdAfter=2015-01-01T12:00:00Z&createdBefore=2015-01-02T12:00:00Z", []string{"b"}},
+		{"createdAfter=2015-01-01T00:00:00%2B01:00", []string{"a", "b", "c"}},
+		{"createdAfter=2015-01-03T00:00:00Z", []string{}},
+	} {
+		w := do(s, "GET", "/Data?"+c.query, "")
+		if got := listIDs(t, w); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("GET ?%s; got %v want %v", c.query, got, c.want)
+		}
+	}
+	for _, q := range []string{"createdAfter=yesterday", "createdBefore=2015-01-01"} {
+		if w := do(s, "GET", "/Data?"+q, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("GET ?%s: got %d, want %d", q, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestInsertSetsUpdated(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+	defer func() { nowFunc = time.Now }()
+
+	nowFunc = func() time.Time { return time.Unix(1000, 0) }
+	for _, c := range []struct {
+		method, path string
+	}{
+		{"POST", "/Data"},
+		{"PUT", "/Data/a"},
+	} {
+		m := decode(t, do(s, c.method, c.path, `{"x":1}`))
+		if m[createdKey] != 1000.0 || m[updatedKey] != 1000.0 {
+			t.Errorf("%s %s: got %s=%v %s=%v, want both 1000", c.method, c.path, createdKey, m[createdKey], updatedKey, m[updatedKey])
+		}
+	}
+
+	// Updates still refresh _updated.
+	nowFunc = func() time.Time { return time.Unix(2000, 0) }
+	for _, method := range []string{"POST", "PATCH"} {
+		m := decode(t, do(s, method, "/Data/a", `{"x":2}`))
+		if m[createdKey] != 1000.0 || m[updatedKey] != 2000.0 {
+			t.Errorf("%s: got %s=%v %s=%v, want 1000 and 2000", method, createdKey, m[createdKey], updatedKey, m[updatedKey])
+		}
+	}
+	if got := listIDs(t, do(s, "GET", "/Data?updatedSince=500", "")); len(got) != 2 {
+		t.Errorf("GET updatedSince=500: got %v, want both entities", got)
+	}
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// statsID is the ID, as in /<Kind>/_stats, that returns aggregate
+	// statistics about a kind.
+	statsID = "_stats"
+
+	// distinctID is the ID, as in /<Kind>/_distinct, that returns the
+	// distinct values of a field.
+	distinctID = "_distinct"
+)
+
+// fieldStats aggregates the numeric values of a field.
+type fieldStats struct {
+	Count int      `json:"count"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+	Sum   float64  `json:"sum"`
+	Avg   *float64 `json:"avg,omitempty"`
+}
+
+func (fs *fieldStats) add(v float64) {
+	// Min and Max get copies of their own, so that fromCents doesn't
+	// convert a value they share twice.
+	if fs.Count == 0 || v < *fs.Min {
+		min := v
+		fs.Min = &min
+	}
+	if fs.Count == 0 || v > *fs.Max {
+		max := v
+		fs.Max = &max
+	}
+	fs.Count++
+	fs.Sum += v
+}
+
+// fromCents converts the aggregates of a money field from cents to decimals.
+func (fs *fieldStats) fromCents() {
+	for _, v := range []*float64{fs.Min, fs.Max, &fs.Sum} {
+		if v != nil {
+			*v /= centsPerUnit
+		}
+	}
+}
+
+// stats returns the number of entities of a kind matching uq's filters, and
+// for each of fields, the count, min, max, sum and average of its numeric
+// values. Non-numeric values are ignored. Every entity of the kind is read,
+// one at a time, so only the aggregates are held in memory.
+func (s *Server) stats(kind string, uq userQuery, fields []string) ([]byte, int) {
+	for _, f := range fields {
+		if !validPath(f) {
+			return nil, http.StatusBadRequest
+		}
+	}
+	n := 0
+	money := map[string]bool{}
+	agg := map[string]*fieldStats{}
+	for _, f := range fields {
+		agg[f] = &fieldStats{}
+	}
+	code, msg := http.StatusOK, ""
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(kind))
+		if b == nil {
+			code = http.StatusNotFound
+			return nil
+		}
+		cfg, err := s.loadConfig(tx, kind)
+		if err != nil {
+			log.Printf("config: %v", err)
+			return err
+		}
+		for _, f := range fields {
+			if cfg.reveals(f) {
+				code, msg = http.StatusBadRequest, "field "+f+" is hidden"
+				return nil
+			}
+			if cfg.encrypts(f) {
+				code, msg = http.StatusBadRequest, "field "+f+" is encrypted"
+				return nil
+			}
+			if cfg.isMoney(f) {
+				money[f] = true
+			}
+		}
+		if err := cfg.checkQuery(uq); err != nil {
+			code, msg = http.StatusBadRequest, err.Error()
+			return nil
+		}
+		uq := cfg.storedQuery(uq)
+		return b.ForEach(func(k, v []byte) error {
+			m, err := fromJSON(v)
+			if err != nil {
+				log.Printf("json: %v", err)
+				return err
+			}
+			if expired(m) || !matchesFilters(m, uq.Filters) || !matchesOr(m, uq.Or) {
+				return nil
+			}
+			n++
+			for _, f := range fields {
+				if v, ok := lookup(m, f); ok {
+					if x, ok := v.(float64); ok {
+						agg[f].add(x)
+					}
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+	if code != http.StatusOK {
+		return []byte(msg), code
+	}
+	for f, fs := range agg {
+		if money[f] {
+			fs.fromCents()
+		}
+		if fs.Count > 0 {
+			avg := fs.Sum / float64(fs.Count)
+			fs.Avg = &avg
+		}
+	}
+	out, err := toJSON(map[string]interface{}{"count": n, "fields": agg})
+	if err != nil {
+		log.Printf("json: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	return out, http.StatusOK
+}
+
+// distinct returns the distinct values of a field among the entities of a kind
+// matching uq's filters, as {"values":[...]}, in sort order. Each element of an
+// array value counts as a value, and entities missing the field are ignored.
+func (s *Server) distinct(kind string, uq userQuery, field string) ([]byte, int) {
+	if !validPath(field) {
+		return nil, http.StatusBadRequest
+	}
+	seen := map[string]bool{}
+	values := []interface{}{}
+	money := false
+	add := func(v interface{}) error {
+		if x, ok := v.(float64); ok && money {
+			v = x / centsPerUnit
+		}
+		k, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if !seen[string(k)] {
+			seen[string(k)] = true
+			values = append(values, v)
+		}
+		return nil
+	}
+	code, msg := http.StatusOK, ""
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(kind))
+		if b == nil {
+			code = http.StatusNotFound
+			return nil
+		}
+		cfg, err := s.loadConfig(tx, kind)
+		if err != nil {
+			log.Printf("config: %v", err)
+			return err
+		}
+		if cfg.reveals(field) {
+			code, msg = http.StatusBadRequest, "field "+field+" is hidden"
+			return nil
+		}
+		if cfg.encrypts(field) {
+			code, msg = http.StatusBadRequest, "field "+field+" is encrypted"
+			return nil
+		}
+		money = cfg.isMoney(field)
+		if err := cfg.checkQuery(uq); err != nil {
+			code, msg = http.StatusBadRequest, err.Error()
+			return nil
+		}
+		uq := cfg.storedQuery(uq)
+		return b.ForEach(func(k, v []byte) error {
+			m, err := fromJSON(v)
+			if err != nil {
+				log.Printf("json: %v", err)
+				return err
+			}
+			if expired(m) || !matchesFilters(m, uq.Filters) || !matchesOr(m, uq.Or) {
+				return nil
+			}
+			fv, found := lookup(m, field)
+			if !found {
+				return nil
+			}
+			if vs, ok := fv.([]interface{}); ok {
+				for _, e := range vs {
+					if err := add(e); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			return add(fv)
+		})
+	})
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+	if code != http.StatusOK {
+		return []byte(msg), code
+	}
+	sort.Stable(byValue(values))
+	out, err := toJSON(map[string]interface{}{"values": values})
+	if err != nil {
+		log.Printf("json: %v", err)
+		return nil, http.StatusInternalServerError
+	}
+	return out, http.StatusOK
+}
+
+// byValue sorts decoded JSON values with compareValues.
+type byValue []interface{}
+
+func (s byValue) Len() int           { return len(s) }
+func (s byValue) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byValue) Less(i, j int) bool { return compareValues(s[i], s[j]) < 0 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// timeKeys are the metadata fields holding timestamps, stored as Unix seconds.
+var timeKeys = []string{createdKey, updatedKey, expiresKey}
+
+// isoTimes reports whether a request's timeFormat param asks for timestamps
+// formatted as ISO 8601 strings rather than Unix seconds, the default.
+func isoTimes(r *http.Request) (bool, error) {
+	switch r.FormValue("timeFormat") {
+	case "", "unix":
+		return false, nil
+	case "iso":
+		return true, nil
+	}
+	return false, errors.New("timeFormat must be iso or unix")
+}
+
+// parseTime parses a timestamp given as Unix seconds or in ISO 8601 format,
+// like "2015-01-01T00:00:00Z", into Unix seconds.
+func parseTime(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
+
+// formatTimes formats an entity's metadata timestamps as ISO 8601 strings in
+// UTC, e.g. "2015-01-01T00:00:00Z".
+func formatTimes(m map[string]interface{}) {
+	for _, k := range timeKeys {
+		if t, ok := m[k].(float64); ok {
+			m[k] = time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+		}
+	}
+}
+
+// shape is what an encoded response holds.
+type shape int
+
+const (
+	// oneEntity is a single entity.
+	oneEntity shape = iota
+	// entityList is a list of entities, in {"items":[...]}.
+	entityList
+	// entityDiff is the changed fields of an entity, in
+	// {"_id":...,"changed":{...}}.
+	entityDiff
+)
+
+// eachEntity calls fn with each entity in an encoded response of the given
+// shape, and returns the response re-encoded. The fields changed by a diff
+// are passed as an entity. Callers say which shape they have, since an
+// entity may well have a field called "items" of its own.
+func eachEntity(b []byte, sh shape, fn func(m map[string]interface{})) ([]byte, error) {
+	doc, err := fromJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	switch sh {
+	case entityList:
+		items, _ := doc["items"].([]interface{})
+		for _, it := range items {
+			if m, ok := it.(map[string]interface{}); ok {
+				fn(m)
+			}
+		}
+	case entityDiff:
+		if changed, ok := doc["changed"].(map[string]interface{}); ok {
+			fn(changed)
+		}
+	default:
+		fn(doc)
+	}
+	return toJSON(doc)
+}
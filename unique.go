@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/boltdb/bolt"
+)
+
+// uniqueKind is the kind, in each namespace, that indexes the values of
+// unique fields. Each entry is keyed by a kind, field and value, and names the
+// entity with that value. Clients can't read or write it directly.
+const uniqueKind = "_unique"
+
+// uniqueEntry is an entry of the unique index.
+type uniqueEntry struct {
+	ID string `json:"id"`
+}
+
+// uniqueKey returns the key under which the value v of a unique field of a
+// kind is indexed, and v as JSON. Since JSON objects are encoded with their
+// keys in order, values that are equal always have the same key.
+func uniqueKey(bare, field string, v interface{}) ([]byte, string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", err
+	}
+	return []byte(bare + "\x00" + field + "\x00" + string(b)), string(b), nil
+}
+
+// claimUnique checks that no other entity of a kind has the same value as m
+// for any of the kind's unique fields. If none does, it indexes m's values in
+// place of old's, which may be nil. If one does, it returns a message saying
+// which field and value, for a 409 Conflict, and writes nothing. Fields that
+// are missing or null aren't indexed, so any number of entities can lack
+// them.
+//
+// Entries for entities that have since been deleted, expired or changed are
+// left in the index, rather than cleaned up by every write that could cause
+// them, so an entry only counts if the entity it names still has the value.
+func claimUnique(tx *bolt.Tx, cfg *kindConfig, kind, id string, old, m map[string]interface{}) (string, error) {
+	if len(cfg.Unique) == 0 {
+		return "", nil
+	}
+	ns, bare := splitNamespace(kind)
+	idx, err := tx.CreateBucketIfNotExists([]byte(ns + uniqueKind))
+	if err != nil {
+		log.Printf("bucket: %v", err)
+		return "", err
+	}
+	b := tx.Bucket([]byte(kind))
+	var claims [][]byte
+	for _, f := range cfg.Unique {
+		v, found := lookup(m, f)
+		if !found || v == nil {
+			continue
+		}
+		k, val, err := uniqueKey(bare, f, v)
+		if err != nil {
+			log.Printf("json: %v", err)
+			return "", err
+		}
+		holder, err := uniqueHolder(idx, b, bare, f, k)
+		if err != nil {
+			return "", err
+		}
+		if holder != "" && holder != id {
+			return fmt.Sprintf("unique field %s already has the value %s, in %s %q", f, val, idKey, holder), nil
+		}
+		claims = append(claims, k)
+	}
+
+	for _, f := range cfg.Unique {
+		v, found := lookup(old, f)
+		if !found || v == nil {
+			continue
+		}
+		k, _, err := uniqueKey(bare, f, v)
+		if err != nil {
+			log.Printf("json: %v", err)
+			return "", err
+		}
+		var e uniqueEntry
+		if v := idx.Get(k); v == nil || json.Unmarshal(v, &e) != nil || e.ID != id {
+			continue
+		}
+		if err := idx.Delete(k); err != nil {
+			log.Printf("delete: %v", err)
+			return "", err
+		}
+	}
+	entry, err := json.Marshal(uniqueEntry{id})
+	if err != nil {
+		log.Printf("json: %v", err)
+		return "", err
+	}
+	for _, k := range claims {
+		if err := idx.Put(k, entry); err != nil {
+			log.Printf("put: %v", err)
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// uniqueHolder returns the ID of the entity of bucket b indexed under k, the
+// key of a value of field f, if there is one and it still has that value.
+func uniqueHolder(idx, b *bolt.Bucket, bare, f string, k []byte) (string, error) {
+	v := idx.Get(k)
+	if v == nil {
+		return "", nil
+	}
+	var e uniqueEntry
+	if err := json.Unmarshal(v, &e); err != nil {
+		log.Printf("json: %v", err)
+		return "", err
+	}
+	if v = b.Get([]byte(e.ID)); v == nil {
+		return "", nil
+	}
+	m, err := fromJSON(v)
+	if err != nil {
+		log.Printf("json: %v", err)
+		return "", err
+	}
+	if expired(m) {
+		return "", nil
+	}
+	if hv, found := lookup(m, f); found {
+		if hk, _, err := uniqueKey(bare, f, hv); err == nil && string(hk) == string(k) {
+			return e.ID, nil
+		}
+	}
+	return "", nil
+}